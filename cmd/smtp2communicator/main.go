@@ -6,16 +6,36 @@ import (
 	"flag"
 	"fmt"
 	"io/fs"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 
 	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/dedup"
+	"smtp2communicator/internal/digest"
+	"smtp2communicator/internal/health"
+	api "smtp2communicator/internal/input/api"
+	cli "smtp2communicator/internal/input/cli"
 	stdin "smtp2communicator/internal/input/stdin"
 	tcp "smtp2communicator/internal/input/tcp"
+	"smtp2communicator/internal/metrics"
 	m "smtp2communicator/internal/misc"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/internal/quiet"
+	"smtp2communicator/internal/routing"
+	"smtp2communicator/internal/spool"
 	"smtp2communicator/pkg/logger"
 	"smtp2communicator/pkg/utils"
 
+	// output channels register themselves with the output package
+	_ "smtp2communicator/internal/output/file"
+	_ "smtp2communicator/internal/output/slack"
+	_ "smtp2communicator/internal/output/teams"
+	_ "smtp2communicator/internal/output/telegram"
+	_ "smtp2communicator/internal/output/whatsapp"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -112,17 +132,47 @@ func main() {
 	systemdUninstallFlag := flag.Bool("systemdUninstall", false, "stop, disable and delete Systemd service")
 	configurationExample := flag.Bool("configurationExample", false, "print to stdout example configuration file")
 	versionFlag := flag.Bool("version", false, "print version to stdout")
-	// TODO add option to allow to pass free text to the tool so any message (not only email) can be sent
 
 	// sendmail flags, to support the way Cron invokes it to pipe a message to it via stdin
 	// Nov 25 19:14:01 desktop cron[108918]: [/usr/sbin/sendmail -FCronDaemon -i -B8BITMIME -oem auser]
+	// they are needed only if this tool is called by its own name, when run
+	// as sendmail all sendmail options are parsed by stdin.ParseSendmail
 	flag.Bool("FCronDaemon", false, "does nothing, required by Cron")
 	flag.Bool("i", false, "does nothing, required by Cron")
 	flag.Bool("oi", false, "does nothing, required by NeoMutt")
 	flag.Bool("B8BITMIME", false, "does nothing, required by Cron")
 	flag.Bool("oem", false, "does nothing, required by Cron")
 
-	flag.Parse()
+	// when run as sendmail (e.g. linked to /usr/sbin/sendmail) arguments are
+	// those of sendmail, options of this tool keep their defaults
+	var sendmailOptions stdin.SendmailOptions
+	sendmailMode := filepath.Base(os.Args[0]) == "sendmail"
+	if sendmailMode {
+		sendmailOptions, err = stdin.ParseSendmail(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(stdin.ExitUsage)
+		}
+		if sendmailOptions.Mode == stdin.ModeAliases {
+			os.Exit(0)
+		}
+	} else {
+		flag.Parse()
+	}
+
+	// send mode, free text given on command line is sent instead of an email
+	var sendOptions cli.SendOptions
+	sendMode := !sendmailMode && flag.Arg(0) == cli.Command
+	if sendMode {
+		sendOptions, err = cli.ParseSend(flag.Args()[1:], os.Stderr)
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 
 	// version printing
 	if *versionFlag {
@@ -197,10 +247,82 @@ func main() {
 	msgChan := make(chan c.Message, 1)
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	go m.Dispatcher(ctx, conf.Channels, msgChan, &wg)
+	channels, failedChannels := output.FromConfiguration(ctx, conf.Channels)
+	validated := output.Validate(ctx, channels)
+
+	// spool keeps messages until they are delivered, it's optional
+	var sp *spool.Spool
+	if len(conf.Spool.DirPath) != 0 {
+		sp, err = spool.New(conf.Spool)
+		if err != nil {
+			log.Errorf("Can't open spool, failed deliveries won't be retried: %v", err)
+		}
+	}
+
+	// dedup suppresses repeated messages, it's optional
+	var dd *dedup.Dedup
+	if len(conf.Dedup.StatePath) != 0 {
+		dd, err = dedup.New(conf.Dedup)
+		if err != nil {
+			log.Errorf("Can't set up dedup, repeated messages won't be suppressed: %v", err)
+		}
+	}
+
+	channelNames := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		channelNames = append(channelNames, channel.Name())
+	}
+	router, err := routing.New(ctx, conf.Routes, conf.DefaultRoute, channelNames)
+	if err != nil {
+		log.Errorf("Can't set up routes: %v", err)
+		os.Exit(1)
+	}
+
+	quietHours, err := quiet.New(ctx, conf.QuietHours, channelNames, output.SilentChannels(channels))
+	if err != nil {
+		log.Errorf("Can't set up quiet hours: %v", err)
+		os.Exit(1)
+	}
+	if quietHours.Defers() && sp == nil {
+		log.Warn("Deferring messages during quiet hours needs spool, they will be delivered silently instead")
+	}
+
+	// digests collect messages of some routes and send them periodically
+	var dg *digest.Digests
+	if digestRoutes := router.DigestRoutes(); len(digestRoutes) != 0 {
+		dg, err = digest.New(conf.Digest, digestRoutes)
+		if err != nil {
+			log.Errorf("Can't set up digests, messages of routes with digest will be sent right away: %v", err)
+		}
+	}
+
+	go m.Dispatcher(ctx, channels, router, sp, dd, dg, quietHours, msgChan, &wg)
+
+	// send message given on command line and exit
+	if sendMode {
+		if err = cli.ProcessSend(ctx, sendOptions, os.Stdin, channelNames, router, msgChan, &wg); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// as sendmail the message is read until stdin is closed, there's never
+	// a listener to start
+	if sendmailMode {
+		if err = stdin.ProcessSendmail(ctx, os.Stdin, msgChan, &wg, sendmailOptions); err != nil {
+			log.Error(err)
+			var exitErr *stdin.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.Code)
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	// process stdin input if any (exits if there was a message on stdin)
-	if stdin.ProcessStdin(ctx, os.Stdin, msgChan, &wg, stdinTimeout) {
+	if stdin.ProcessStdin(ctx, os.Stdin, msgChan, &wg, stdinTimeout, stdin.SendmailOptions{}) {
 		os.Exit(0)
 	}
 
@@ -214,6 +336,73 @@ func main() {
 
 	m.SignalHandler(ctx, cronSendmailMTAPath, mtaStubInstalled)
 
+	tlsConfig, err := tcp.LoadTLSConfig(conf.TLS)
+	if err != nil {
+		log.Errorf("Can't set up TLS: %v", err)
+		os.Exit(1)
+	}
+
+	auth, err := tcp.LoadAuthenticator(conf.Auth)
+	if err != nil {
+		log.Errorf("Can't set up SMTP AUTH: %v", err)
+		os.Exit(1)
+	}
+	if auth != nil && tlsConfig == nil && !conf.Auth.AllowInsecure {
+		log.Warn("SMTP AUTH is offered over TLS only but TLS is not configured")
+	}
+
+	// HTTP listener exposing metrics and health probes, it's optional
+	if len(conf.HTTP.Listen) != 0 {
+		queueDepth := func() int {
+			depth := len(msgChan)
+			if sp != nil {
+				depth += sp.Len()
+			}
+			return depth
+		}
+		if err := metrics.RegisterQueueDepth(queueDepth); err != nil {
+			log.Errorf("Can't expose queue depth metric: %v", err)
+		}
+
+		checker := health.New(*configurationFileFlag)
+		checker.Queue(queueDepth, conf.HTTP.MaxQueue)
+		for _, name := range channelNames {
+			err, verified := validated[name]
+			checker.Channel(name, verified, err)
+		}
+		for name, err := range failedChannels {
+			checker.Channel(name, false, err)
+		}
+		checker.Listener("smtp", net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)), false)
+		if tlsConfig != nil && conf.TLS.ImplicitPort != 0 {
+			checker.Listener("smtps", net.JoinHostPort(conf.Host, fmt.Sprint(conf.TLS.ImplicitPort)), true)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/healthz", checker.HealthzHandler())
+		mux.Handle("/readyz", checker.ReadyzHandler())
+
+		// JSON API accepting messages is enabled by setting its tokens
+		if len(conf.HTTP.API.Tokens) != 0 {
+			handler, err := api.Handler(ctx, conf.HTTP.API, channelNames, msgChan)
+			if err != nil {
+				log.Errorf("Can't set up API: %v", err)
+				os.Exit(1)
+			}
+			mux.Handle(api.Path, handler)
+		}
+		if err = m.HTTPServer(ctx, conf.HTTP, mux); err != nil {
+			log.Errorf("Can't start HTTP listener: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// start implicit TLS listener if requested
+	if tlsConfig != nil && conf.TLS.ImplicitPort != 0 {
+		go tcp.ProcessTLS(ctx, msgChan, conf.Host, conf.TLS.ImplicitPort, tlsConfig, auth)
+	}
+
 	// start listener and handle tcp connections
-	tcp.ProcessTCP(ctx, msgChan, conf.Host, conf.Port)
+	tcp.ProcessTCP(ctx, msgChan, conf.Host, conf.Port, tlsConfig, auth)
 }
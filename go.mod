@@ -3,14 +3,24 @@ module smtp2communicator
 go 1.21.1
 
 require (
-	github.com/DusanKasan/parsemail v1.2.0
 	github.com/PaulSonOfLars/gotgbot/v2 v2.0.0-rc.23
+	github.com/prometheus/client_golang v1.19.1
 	github.com/slack-go/slack v0.12.3
 	go.uber.org/zap v1.26.0
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
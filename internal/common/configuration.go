@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"smtp2communicator/pkg/logger"
 	"smtp2communicator/pkg/utils"
@@ -13,37 +14,162 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-type FileChannel struct {
-	Enabled bool
+// Channels is configuration of all output channels keyed by channel name
+//
+// Each entry is decoded by the output channel registered under the same name
+// so that new channels don't require changes here.
+type Channels map[string]yaml.Node
+
+// SpoolConfig is configuration of the directory messages are kept in until
+// delivered
+//
+// Spool is disabled if DirPath is empty. RetryMin and RetryMax bound the
+// exponential backoff between delivery attempts, MaxAge is how long to keep
+// trying before giving up.
+type SpoolConfig struct {
+	DirPath  string        `yaml:"dirPath"`
+	RetryMin time.Duration `yaml:"retryMin,omitempty"`
+	RetryMax time.Duration `yaml:"retryMax,omitempty"`
+	MaxAge   time.Duration `yaml:"maxAge,omitempty"`
+}
+
+// DedupConfig is configuration of suppressing repeated messages
+//
+// Dedup is disabled if StatePath is empty. Messages with the same
+// fingerprint, made of listed Fields (subject, body, from, to), received
+// within Window since the first of them was sent are suppressed and a single
+// summary is sent once the window closes. Numbers, dates and ids in subject
+// and body are ignored so that e.g. timestamps don't make messages differ.
+type DedupConfig struct {
+	StatePath string        `yaml:"statePath"`
+	Window    time.Duration `yaml:"window,omitempty"`
+	Fields    []string      `yaml:"fields,omitempty"`
+}
+
+// DigestConfig is configuration of the directory messages collected into
+// digests are kept in until the digests are sent
+type DigestConfig struct {
 	DirPath string `yaml:"dirPath"`
 }
-type TelegramChannel struct {
-	Enabled bool
-	UserId  int64  `yaml:"userId"`
-	BotKey  string `yaml:"botKey"`
+
+// QuietHours is a time window in which messages to listed channels are
+// deferred until the window ends, delivered without notification or dropped
+//
+// From and To are times of day (e.g. 22:00 and 07:00) in TimeZone, local
+// time zone if not set, and the window may span midnight. Days are days of
+// week (e.g. mon, tue or mon-fri) the window starts on, all days if not set.
+// Action is one of defer (default), silent or drop.
+type QuietHours struct {
+	Name     string   `yaml:"name,omitempty"`
+	Channels []string `yaml:"channels"`
+	Days     []string `yaml:"days,omitempty"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	TimeZone string   `yaml:"timeZone,omitempty"`
+	Action   string   `yaml:"action,omitempty"`
+}
+
+// HTTPConfig is configuration of the HTTP listener serving metrics and
+// health probes
+//
+// The listener is disabled if Listen, an address like 127.0.0.1:9465, is
+// empty. MaxQueue is the number of messages waiting for delivery above which
+// the service reports it isn't ready, 100 if not set.
+type HTTPConfig struct {
+	Listen   string    `yaml:"listen"`
+	MaxQueue int       `yaml:"maxQueue,omitempty"`
+	API      APIConfig `yaml:"api,omitempty"`
+}
+
+// APIConfig is configuration of the JSON API accepting messages on the HTTP
+// listener
+//
+// The API is disabled if there are no Tokens, every request must carry one
+// of them as a bearer token. MaxBodySize limits size of a request, 1 MiB if
+// not set. Timeout is how long a request waits for delivery if asked to,
+// 1 minute if not set.
+type APIConfig struct {
+	Tokens      []string      `yaml:"tokens,omitempty"`
+	MaxBodySize int64         `yaml:"maxBodySize,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
 }
-type SlackChannel struct {
-	Enabled bool
-	UserId  string `yaml:"userId"`
-	BotKey  string `yaml:"botKey"`
+
+// TLSConfig is configuration of TLS on the SMTP listener
+//
+// TLS is disabled if CertFile is empty. If enabled STARTTLS is offered on
+// the plain port and, if ImplicitPort is set, TLS only (SMTPS) listener is
+// started on that port. MinVersion is one of 1.0, 1.1, 1.2 (default), 1.3.
+type TLSConfig struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	MinVersion   string `yaml:"minVersion,omitempty"`
+	ImplicitPort int    `yaml:"implicitPort,omitempty"`
+}
+
+// AuthConfig is configuration of SMTP AUTH on the listener
+//
+// AUTH is disabled if CredentialsFile is empty. It is offered only over TLS
+// unless AllowInsecure is set. If Required is set then messages from clients
+// that didn't authenticate are rejected.
+type AuthConfig struct {
+	CredentialsFile string `yaml:"credentialsFile"`
+	Required        bool   `yaml:"required"`
+	AllowInsecure   bool   `yaml:"allowInsecure,omitempty"`
 }
-type TeamsChannel struct {
-	Enabled bool
+
+// Match is a set of conditions a message must meet to match a route
+//
+// Every condition is a glob (e.g. '*@backup.example.com') or, if prefixed
+// with 're:', a regular expression. Empty conditions match anything.
+type Match struct {
+	From    string            `yaml:"from,omitempty"`
+	To      string            `yaml:"to,omitempty"`
+	Subject string            `yaml:"subject,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
 }
-type WhatsupChannel struct {
-	Enabled bool
+
+// RouteDigest collects messages of a route into a single digest message
+//
+// Schedule is an interval (e.g. 24h) counted from the first collected
+// message or a crontab like schedule (e.g. '0 7 * * *'). If Attach is set
+// then message bodies are sent in an attached file instead of in the digest.
+type RouteDigest struct {
+	Schedule string `yaml:"schedule"`
+	Attach   bool   `yaml:"attach,omitempty"`
 }
-type Channels struct {
-	File     FileChannel
-	Telegram TelegramChannel
-	Slack    SlackChannel
-	Teams    TeamsChannel
-	Whatsup  WhatsupChannel
+
+// Route sends messages matching its conditions to listed channels
+//
+// If Stop is set then no more routes are evaluated after this one matched.
+// If Digest is set then messages are sent in periodic digests instead of
+// right away. Messages matched by a route with Urgent set are delivered
+// during quiet hours too.
+type Route struct {
+	Name     string       `yaml:"name,omitempty"`
+	Match    Match        `yaml:"match"`
+	Channels []string     `yaml:"channels"`
+	Stop     bool         `yaml:"stop,omitempty"`
+	Urgent   bool         `yaml:"urgent,omitempty"`
+	Digest   *RouteDigest `yaml:"digest,omitempty"`
 }
+
 type Configuration struct {
 	Host     string
-	Port     int `yaml:"tcpPort"`
+	Port     int        `yaml:"tcpPort"`
+	TLS      TLSConfig  `yaml:"tls,omitempty"`
+	Auth     AuthConfig `yaml:"auth,omitempty"`
+	HTTP     HTTPConfig `yaml:"http,omitempty"`
+	Spool    SpoolConfig
+	Dedup    DedupConfig  `yaml:"dedup,omitempty"`
+	Digest   DigestConfig `yaml:"digest,omitempty"`
 	Channels Channels
+	// Routes decide which channels a message is sent to, messages not
+	// matched by any route go to DefaultRoute or, if not set, to all channels
+	Routes       []Route  `yaml:"routes,omitempty"`
+	DefaultRoute []string `yaml:"defaultRoute,omitempty"`
+	// QuietHours defer, silence or drop messages to some channels at
+	// given times
+	QuietHours []QuietHours `yaml:"quietHours,omitempty"`
 }
 
 // GetConfiguration loads and returns configuration object
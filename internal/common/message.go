@@ -1,6 +1,12 @@
 package common
 
-import "time"
+import (
+	"net/mail"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
 
 type Message struct {
 	Time    time.Time
@@ -9,4 +15,162 @@ type Message struct {
 	To      string
 	Subject string
 	Body    string
+
+	// Attachments are files attached to or embedded in the email
+	Attachments []Attachment `yaml:",omitempty" json:",omitempty"`
+
+	// Parts, if set, are sections the body ends with, e.g. bodies of
+	// messages collected into a digest, which channels able to do so show
+	// collapsed; Body holds them too for the other channels, see Lead
+	Parts []Part `yaml:"-" json:",omitempty"`
+
+	// Urgent messages are delivered during quiet hours too
+	Urgent bool `yaml:",omitempty" json:",omitempty"`
+
+	// Silent asks the channel to deliver the message without notification,
+	// it's set for a single delivery during quiet hours
+	Silent bool `yaml:"-" json:"-"`
+
+	// Channels, if set, are the channels the message is sent to instead of
+	// those chosen by routes
+	Channels []string `yaml:"-" json:"-"`
+
+	// DeliveredTo are recipients of the channel the message was delivered to
+	// by earlier attempts which failed for other recipients, it's set for
+	// a single delivery so that retries skip them
+	DeliveredTo []string `yaml:"-" json:"-"`
+
+	// Accepted, if set, receives result of accepting the message by the
+	// dispatcher so that the input can confirm it to the sender only once
+	// the message is safely stored; it must be buffered
+	Accepted chan<- error `yaml:"-" json:"-"`
+
+	// Delivered, if set, receives outcome of the first attempt to deliver
+	// the message so that the input can tell it to the sender; it must be
+	// buffered
+	Delivered chan<- Delivery `yaml:"-" json:"-"`
+}
+
+// Delivery states of a message in a channel
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryDeferred  = "deferred"
+	DeliveryDropped   = "dropped"
+)
+
+// Delivery is outcome of the first attempt to deliver a message
+type Delivery struct {
+	// Digests are names of digests the message was collected into
+	Digests []string `json:"digests,omitempty"`
+	// Suppressed is set if the message is a repeat and wasn't sent
+	Suppressed bool `json:"suppressed,omitempty"`
+	// Channels has outcome of delivery to every channel the message was
+	// sent to
+	Channels map[string]ChannelDelivery `json:"channels,omitempty"`
+}
+
+// ChannelDelivery is outcome of delivery of a message to a channel
+type ChannelDelivery struct {
+	// State is one of DeliveryDelivered, DeliveryFailed, DeliveryDeferred
+	// or DeliveryDropped
+	State string `json:"state"`
+	// Error is why delivery failed
+	Error string `json:"error,omitempty"`
+	// Until is when delivery deferred during quiet hours is attempted again
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Record saves outcome of delivery to a channel, nil Delivery ignores it
+func (d *Delivery) Record(channel string, delivery ChannelDelivery) {
+	if d == nil {
+		return
+	}
+	if d.Channels == nil {
+		d.Channels = map[string]ChannelDelivery{}
+	}
+	d.Channels[channel] = delivery
+}
+
+// Failed tells if delivery to any channel failed
+func (d Delivery) Failed() bool {
+	for _, channel := range d.Channels {
+		if channel.State == DeliveryFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Part is a titled section at the end of the body of a message
+type Part struct {
+	Title string
+	Text  string
+}
+
+// JoinParts returns text of parts the way they end the body of a message
+func JoinParts(parts []Part) string {
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString("=== " + part.Title + " ===\n" + part.Text)
+	}
+	return b.String()
+}
+
+// Lead returns the body without the parts it ends with
+//
+// Returns false if the message has no parts or the body doesn't end with
+// them, e.g. because it was changed, in which case the body is to be shown
+// as it is.
+func (m Message) Lead() (lead string, ok bool) {
+	if len(m.Parts) == 0 {
+		return "", false
+	}
+	return strings.CutSuffix(m.Body, JoinParts(m.Parts))
+}
+
+// Attachment is a file attached to or embedded (e.g. inline image) in the
+// email
+type Attachment struct {
+	Filename    string
+	ContentType string `yaml:"contentType"`
+	Inline      bool   `yaml:",omitempty"`
+	Data        []byte `yaml:"-"`
+}
+
+// LocalSender returns address of the current user at this host, the sender
+// of messages submitted locally without one
+func LocalSender() string {
+	name := "smtp2communicator"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + hostname
+}
+
+// HeadersFromMail converts parsed email headers to Message headers
+//
+// Keys are in canonical form (e.g. 'X-Cron-Env') and values of headers
+// present more than once are joined with ", ".
+//
+// Parameters:
+//
+// - header (mail.Header): headers of parsed email
+//
+// Returns:
+//
+// - headers (map[string]string): headers
+func HeadersFromMail(header mail.Header) (headers map[string]string) {
+	headers = make(map[string]string, len(header))
+	for key, values := range header {
+		headers[key] = strings.Join(values, ", ")
+	}
+	return
 }
@@ -1,81 +1,237 @@
 package common
 
-import "strings"
+import (
+	"strings"
+	"unicode/utf8"
+)
 
-// Splitter splitts a message into defined chunks
+// Unit is the unit a channel measures length of messages in
+type Unit int
+
+const (
+	// Bytes counts bytes of UTF-8 encoded text
+	Bytes Unit = iota
+	// Runes counts Unicode code points
+	Runes
+	// UTF16 counts UTF-16 code units, as Telegram does
+	UTF16
+)
+
+// Length returns length of text in the unit
+func (u Unit) Length(text string) (length int) {
+	switch u {
+	case Runes:
+		return utf8.RuneCountInString(text)
+	case UTF16:
+		for _, r := range text {
+			length += runeLength(u, r, 1)
+		}
+		return length
+	default:
+		return len(text)
+	}
+}
+
+// runeLength returns length of a single rune taking size bytes in the text
+func runeLength(u Unit, r rune, size int) int {
+	switch u {
+	case Runes:
+		return 1
+	case UTF16:
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	default:
+		return size
+	}
+}
+
+// Limit is the longest message a channel accepts
+type Limit struct {
+	Size int
+	Unit Unit
+}
+
+const (
+	// lookBack is how far back from the limit a line break or space to
+	// split at is looked for
+	lookBack = 250
+	// reserve is room kept in every chunk but the last one for continuation
+	// marker and closing code fence ("\n```\n...")
+	reserve = 8
+	// minMarkedSize is the smallest limit continuation markers and code
+	// fences are used with
+	minMarkedSize = 4 * reserve
+	// fence starts and ends markdown code block
+	fence = "```"
+)
+
+// Splitter splits a message into chunks not longer than the limit
 //
-// This function will take a message and split it into "chunk" sized parts +
-// leading and trailing "..." dots (6 characters in total).
+// The message is split preferably at a line break, or at a space, found
+// close to the limit. Chunks are marked with "..." at the end and at the
+// beginning of the following chunk. Chunks are never split in the middle of
+// a rune, and code blocks (```) split between chunks are closed at the end of
+// a chunk and reopened in the next one. Only if the limit is too small for
+// that the chunks are cut without markers and code fences.
 //
 // Parameters:
 //
-// - chunk (int): chunk size
+// - limit (Limit): longest chunk, zero or negative size means no limit
 // - message (string): a message to split
 //
 // Returns:
 //
 // - messages ([]string): slice of chunks
-func Splitter(chunk int, message string) (messages []string) {
-	// If chunk is 0 or negative or messages shorter than chunk, return the whole message.
-	if chunk <= 0 || len(message) < chunk {
+func Splitter(limit Limit, message string) (messages []string) {
+	if limit.Size <= 0 || limit.Unit.Length(message) <= limit.Size {
 		return []string{message}
 	}
+	marked := limit.Size >= minMarkedSize
 
-	var leadingStr, trailingStr string
-	start := 0
-	end := chunk
+	rest := message
+	leading := ""
+	openFence := ""
 	for {
-		if end > len(message) {
-			end = len(message)
-		} else {
-			// this is not the end of a message yet so look for place to split
-			originalEnd := end
-			for {
-				// we want to split either on space or newline character if possible
-				if message[end] != ' ' && message[end] != '\n' {
-					end--
-					// if we went back 250 characters and clearly still no good point to split
-					// then just split at the original value of "end"
-					if originalEnd-end > 250 {
-						end = originalEnd
-						break
-					}
-
-					// if we splitted on new line then the "..." should be
-					// also added on line of its own
-					if message[end] == '\n' {
-						leadingStr = "...\n"
-						trailingStr = "\n..."
-					} else {
-						leadingStr = "..."
-						trailingStr = "..."
-					}
-				} else {
-					break
-				}
-			}
+		prefix := leading
+		if len(openFence) != 0 {
+			prefix += openFence + "\n"
+		}
+		if fits(limit, prefix+rest) {
+			return append(messages, prefix+rest)
 		}
 
-		// if start == end then we reached end of the message
-		if start == end {
-			break
+		available := limit.Size - limit.Unit.Length(prefix)
+		if marked {
+			available -= reserve
 		}
+		cut, separator := splitPoint(limit.Unit, rest, available)
 
-		subMsg := strings.TrimSpace(message[start:end])
+		chunk := rest[:cut]
+		if !marked {
+			// nothing marks the split so the separator is kept
+			messages = append(messages, chunk)
+			rest = rest[cut:]
+			continue
+		}
+		rest = rest[cut+len(separator):]
 
-		messages = append(messages, leadingStr+subMsg+trailingStr)
+		openFence = fenceState(chunk, openFence)
+		if limit.Unit.Length(openFence) > limit.Size/4 {
+			// reopen the code block without too long info string
+			openFence = fence
+		}
+		chunk = prefix + strings.TrimRight(chunk, " \n")
+		if len(openFence) != 0 {
+			chunk += "\n" + fence
+		}
+		if separator == "\n" || len(openFence) != 0 {
+			chunk += "\n..."
+			leading = "...\n"
+		} else {
+			chunk += "..."
+			leading = "..."
+		}
+		messages = append(messages, chunk)
+	}
+}
 
-		start = end
-		end += chunk
+// fits tells if text is not longer than the limit
+//
+// Unlike comparing Length with the limit it reads only as much of the text
+// as needed.
+func fits(limit Limit, text string) bool {
+	if len(text) <= limit.Size {
+		// no unit counts more than a byte per byte
+		return true
+	}
+	length := 0
+	for i, r := range text {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		length += runeLength(limit.Unit, r, size)
+		if length > limit.Size {
+			return false
+		}
 	}
+	return true
+}
 
-	// trim leading "..." in first message
-	messages[0] = messages[0][3:]
+// splitPoint finds where to split text so that the first part is not longer
+// than available length
+//
+// Returns byte offset of the split and the separator found there (line
+// break, space or nothing) which is to be dropped. At least one rune is
+// always taken to make progress.
+func splitPoint(unit Unit, text string, available int) (cut int, separator string) {
+	// longest prefix of whole runes fitting into available length
+	length := 0
+	limit := 0
+	for i, r := range text {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		length += runeLength(unit, r, size)
+		if length > available {
+			break
+		}
+		limit = i + size
+	}
+	if limit == 0 {
+		_, limit = utf8.DecodeRuneInString(text)
+	}
+	if limit >= len(text) {
+		return len(text), ""
+	}
 
-	// trim trailing "..." in last message
-	lastMessageId := len(messages) - 1
-	lastMessageLen := len(messages[lastMessageId])
-	messages[lastMessageId] = messages[lastMessageId][0 : lastMessageLen-3]
+	// text[limit] is the first byte not fitting, if it is a separator the
+	// text fits exactly
+	window := text[:limit+1]
+	if start := limit - lookBack; start > 0 {
+		window = text[start : limit+1]
+	}
+	offset := limit + 1 - len(window)
+	if i := strings.LastIndexByte(window, '\n'); i > 0 || i == 0 && offset > 0 {
+		return offset + i, "\n"
+	}
+	if i := strings.LastIndexByte(window, ' '); i > 0 || i == 0 && offset > 0 {
+		return offset + i, " "
+	}
 
-	return messages
+	// no separator, don't cut a code fence in halves if possible
+	cut = limit
+	for cut > 0 && text[cut-1] == '`' && text[cut] == '`' {
+		cut--
+	}
+	if cut == 0 {
+		cut = limit
+	}
+	return cut, ""
+}
+
+// fenceState returns code fence line open at the end of text
+//
+// Parameters:
+//
+// - text (string): text to scan
+// - open (string): fence line open at the beginning of text or empty string
+//
+// Returns:
+//
+// - open (string): fence line (e.g. "```go") still open or empty string
+func fenceState(text string, open string) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, fence) {
+			continue
+		}
+		if len(open) == 0 && strings.Contains(line[len(fence):], fence) {
+			// code on a single line
+			continue
+		}
+		if len(open) != 0 {
+			open = ""
+		} else {
+			open = line
+		}
+	}
+	return open
 }
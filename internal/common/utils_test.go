@@ -1,7 +1,9 @@
 package common
 
 import (
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 var loremIpsum = `Lorem ipsum dolor sit amet. Id fuga quia et provident recusandae vel quibusdam galisum ut exercitationem aliquam. Ut ullam voluptatum in rerum officiis quo enim quae qui nostrum eveniet vel aspernatur fugiat. Aut minima sapiente aut accusamus dignissimos aut praesentium dolore. Et maxime modi ut assumenda minima aut tempora quia ut omnis quas vel modi eaque.
@@ -11,13 +13,125 @@ Aut recusandae natus At quis galisum est omnis quia et minima galisum. Et necess
 In neque illo ut quas omnis et expedita delectus et quia aperiam ex voluptatem sunt. Id voluptas exercitationem et provident consequatur et fuga cupiditate.`
 
 func TestSplitter(t *testing.T) {
+	// split at the end of the first paragraph
+	paragraph := strings.Index(loremIpsum, "\n\n")
 	lorem := []string{
-		loremIpsum[:496] + "...", "..." + loremIpsum[497:],
+		loremIpsum[:paragraph] + "\n...", "...\n" + loremIpsum[paragraph+2:],
+	}
+	result := Splitter(Limit{Size: 500, Unit: Bytes}, loremIpsum)
+	if len(result) != len(lorem) {
+		t.Fatalf("Expected %d chunks, got %d", len(lorem), len(result))
 	}
-	result := Splitter(500, loremIpsum)
 	for i, r := range result {
 		if r != lorem[i] {
 			t.Fatalf("Returned splitted string is not the same as input: '%s' != '%s'\n", r, lorem[i])
 		}
 	}
 }
+
+func TestUnitLength(t *testing.T) {
+	text := "zażółć 👍"
+	if l := Bytes.Length(text); l != 15 {
+		t.Errorf("Expected 15 bytes, got %d", l)
+	}
+	if l := Runes.Length(text); l != 8 {
+		t.Errorf("Expected 8 runes, got %d", l)
+	}
+	if l := UTF16.Length(text); l != 9 {
+		t.Errorf("Expected 9 UTF-16 code units, got %d", l)
+	}
+}
+
+func TestSplitterRunes(t *testing.T) {
+	// no separators, the chunks have to be cut between runes
+	message := strings.Repeat("ż👍", 100)
+	for _, limit := range []Limit{{Size: 51, Unit: Bytes}, {Size: 51, Unit: Runes}, {Size: 51, Unit: UTF16}, {Size: 5, Unit: Bytes}} {
+		checkChunks(t, limit, message, Splitter(limit, message))
+	}
+}
+
+func TestSplitterCodeFence(t *testing.T) {
+	message := "Output:\n```sh\n" + strings.Repeat("line of output\n", 20) + "```\nDone"
+	limit := Limit{Size: 100, Unit: Bytes}
+	chunks := Splitter(limit, message)
+	checkChunks(t, limit, message, chunks)
+
+	if len(chunks) < 3 {
+		t.Fatalf("Expected at least 3 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if i > 0 && !strings.HasPrefix(chunk, "...\n```sh\n") && i < len(chunks)-1 {
+			t.Errorf("Chunk %d doesn't reopen code block: %q", i, chunk)
+		}
+		if i < len(chunks)-1 && !strings.HasSuffix(chunk, "\n```\n...") {
+			t.Errorf("Chunk %d doesn't close code block: %q", i, chunk)
+		}
+	}
+	if last := chunks[len(chunks)-1]; !strings.HasSuffix(last, "```\nDone") {
+		t.Errorf("Unexpected last chunk: %q", last)
+	}
+}
+
+func FuzzSplitter(f *testing.F) {
+	f.Add(loremIpsum, 100, 0)
+	f.Add("```go\nfunc main() {}\n```\n"+loremIpsum, 40, 1)
+	f.Add(strings.Repeat("👍ż a\n", 50), 33, 2)
+	f.Add("\xff\xfe invalid \xc3", 8, 0)
+	f.Add("``````````", 32, 2)
+
+	f.Fuzz(func(t *testing.T, message string, size int, unit int) {
+		if size < 4 || size > 10000 {
+			t.Skip()
+		}
+		limit := Limit{Size: size, Unit: Unit(unit % 3)}
+		if limit.Unit < 0 {
+			limit.Unit = -limit.Unit
+		}
+		checkChunks(t, limit, message, Splitter(limit, message))
+	})
+}
+
+// checkChunks verifies properties every split has to have
+//
+// Every chunk fits the limit, valid UTF-8 stays valid, all but the last
+// chunk have closed code blocks (if the limit allows markers) and the text is not lost or reordered; only
+// markers, code fences and whitespace can be added or dropped.
+func checkChunks(t *testing.T, limit Limit, message string, chunks []string) {
+	t.Helper()
+
+	if len(chunks) == 0 {
+		t.Fatalf("No chunks returned")
+	}
+	for i, chunk := range chunks {
+		if length := limit.Unit.Length(chunk); length > limit.Size {
+			t.Fatalf("Chunk %d is %d long, over the limit %d: %q", i, length, limit.Size, chunk)
+		}
+		if utf8.ValidString(message) && !utf8.ValidString(chunk) {
+			t.Fatalf("Chunk %d is not valid UTF-8: %q", i, chunk)
+		}
+		if limit.Size >= minMarkedSize && i < len(chunks)-1 && fenceState(chunk, "") != "" {
+			t.Fatalf("Chunk %d has open code block: %q", i, chunk)
+		}
+	}
+
+	strip := func(s string) []byte {
+		return []byte(strings.Map(func(r rune) rune {
+			if r == '.' || r == '`' || r == ' ' || r == '\n' {
+				return -1
+			}
+			return r
+		}, s))
+	}
+	// the message has to be a subsequence of the chunks as reopened code
+	// blocks repeat the fence info string
+	want, got := strip(message), strip(strings.Join(chunks, ""))
+	j := 0
+	for i := 0; i < len(got) && j < len(want); i++ {
+		if got[i] == want[j] {
+			j++
+		}
+	}
+	if j != len(want) {
+		t.Fatalf("Text lost or reordered when split at %d: %q", limit.Size, chunks)
+	}
+}
@@ -0,0 +1,269 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/statefile"
+)
+
+const (
+	defaultWindow = time.Hour
+
+	// maxCheckInterval is the longest time a closed window waits for its
+	// summary to be sent
+	maxCheckInterval = time.Minute
+)
+
+// Fields a fingerprint can be made of
+const (
+	FieldSubject = "subject"
+	FieldBody    = "body"
+	FieldFrom    = "from"
+	FieldTo      = "to"
+)
+
+var defaultFields = []string{FieldSubject, FieldBody, FieldFrom}
+
+var (
+	// numberRegex matches numbers, including hexadecimal ones like ids or
+	// hashes, which are replaced by a placeholder when normalising text
+	numberRegex = regexp.MustCompile(`(?i)\b(0x)?[0-9a-f]*[0-9][0-9a-f]*\b|[0-9]+`)
+)
+
+// window is state of repeats of a single message
+type window struct {
+	// Start is when the message that opened the window was sent
+	Start time.Time
+	// End is when the window closes
+	End time.Time
+	// Count is number of suppressed repeats
+	Count int
+	// Last is the last suppressed repeat, without attachments
+	Last common.Message
+	// LastSeen is when the last repeat was suppressed
+	LastSeen time.Time
+	// Channels are names of channels the message was sent to
+	Channels []string
+}
+
+// Summary is a message to be sent when a window with suppressed repeats closes
+type Summary struct {
+	Message  common.Message
+	Channels []string
+}
+
+// Dedup suppresses messages repeated within a time window
+//
+// State is kept in a file, locked while being updated, so that it survives
+// restarts and is shared by the service and sendmail invocations.
+type Dedup struct {
+	path   string
+	window time.Duration
+	fields []string
+}
+
+// New sets up deduplication with state kept in given file
+//
+// Parameters:
+//
+// - conf (common.DedupConfig): dedup configuration
+//
+// Returns:
+//
+// - d (*Dedup): dedup
+// - err (error): error if any or nil
+func New(conf common.DedupConfig) (d *Dedup, err error) {
+	if len(conf.StatePath) == 0 {
+		return nil, errors.New("dedup statePath not set")
+	}
+
+	d = &Dedup{
+		path:   conf.StatePath,
+		window: conf.Window,
+	}
+	if d.window <= 0 {
+		d.window = defaultWindow
+	}
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = defaultFields
+	}
+	for _, field := range fields {
+		switch strings.ToLower(field) {
+		case FieldSubject, FieldBody, FieldFrom, FieldTo:
+			d.fields = append(d.fields, strings.ToLower(field))
+		default:
+			return nil, fmt.Errorf("unknown dedup field %q, use %s, %s, %s or %s", field, FieldSubject, FieldBody, FieldFrom, FieldTo)
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(d.path), 0o700); err != nil {
+		return nil, fmt.Errorf("can't create dedup state directory: %w", err)
+	}
+	return d, nil
+}
+
+// CheckInterval returns how often closed windows should be looked for
+func (d *Dedup) CheckInterval() time.Duration {
+	return min(max(d.window/4, time.Second), maxCheckInterval)
+}
+
+// Check tells if a message is a repeat to be suppressed
+//
+// The first message with given fingerprint opens a window and is to be
+// sent, its repeats received before the window closes are counted and are
+// to be suppressed.
+//
+// Parameters:
+//
+// - msg (common.Message): received message
+// - channels ([]string): names of channels the message is to be sent to
+// - now (time.Time): time the message is dispatched at
+//
+// Returns:
+//
+// - suppress (bool): true if the message is a repeat
+// - err (error): error if any or nil
+func (d *Dedup) Check(msg common.Message, channels []string, now time.Time) (suppress bool, err error) {
+	err = d.update(func(windows map[string]*window) bool {
+		key := d.fingerprint(msg)
+
+		w, ok := windows[key]
+		if ok && now.Before(w.End) {
+			w.Count++
+			w.Last = msg
+			w.Last.Attachments = nil
+			w.LastSeen = now
+			suppress = true
+			return true
+		}
+
+		windows[key] = &window{
+			Start:    now,
+			End:      now.Add(d.window),
+			Last:     common.Message{From: msg.From, To: msg.To, Subject: msg.Subject, Headers: msg.Headers},
+			Channels: channels,
+		}
+		return true
+	})
+	return suppress, err
+}
+
+// Closed removes windows closed at given time
+//
+// Parameters:
+//
+// - now (time.Time): current time
+//
+// Returns:
+//
+// - summaries ([]Summary): summaries of closed windows with suppressed repeats
+// - err (error): error if any or nil
+func (d *Dedup) Closed(now time.Time) (summaries []Summary, err error) {
+	var closed []*window
+	err = d.update(func(windows map[string]*window) (changed bool) {
+		for key, w := range windows {
+			if now.Before(w.End) {
+				continue
+			}
+			delete(windows, key)
+			changed = true
+			if w.Count > 0 {
+				closed = append(closed, w)
+			}
+		}
+		return changed
+	})
+
+	sort.Slice(closed, func(i, j int) bool {
+		return closed[i].Start.Before(closed[j].Start)
+	})
+	for _, w := range closed {
+		summaries = append(summaries, Summary{Message: summary(w, now), Channels: w.Channels})
+	}
+	return summaries, err
+}
+
+// fingerprint returns fingerprint of configured message fields
+//
+// Subject and body are normalised first: numbers and ids are replaced by a
+// placeholder, whitespace is collapsed and letters are lowercased.
+func (d *Dedup) fingerprint(msg common.Message) string {
+	hash := sha256.New()
+	for _, field := range d.fields {
+		var value string
+		switch field {
+		case FieldSubject:
+			value = normalise(msg.Subject)
+		case FieldBody:
+			value = normalise(msg.Body)
+		case FieldFrom:
+			value = strings.ToLower(strings.TrimSpace(msg.From))
+		case FieldTo:
+			value = strings.ToLower(strings.TrimSpace(msg.To))
+		}
+		fmt.Fprintf(hash, "%s:%d:%s\n", field, len(value), value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalise returns text with the parts that usually differ between repeats
+// of the same message (dates, times, counters, ids) replaced by "#"
+func normalise(text string) string {
+	text = numberRegex.ReplaceAllString(strings.ToLower(text), "#")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// summary returns message telling how many times a message was repeated
+func summary(w *window, now time.Time) common.Message {
+	times := "times"
+	if w.Count == 1 {
+		times = "time"
+	}
+
+	body := fmt.Sprintf("The message was repeated %d %s since %s, last time at %s.",
+		w.Count, times, w.Start.Format(time.RFC1123Z), w.LastSeen.Format(time.RFC1123Z))
+	if len(strings.TrimSpace(w.Last.Body)) != 0 {
+		body += "\n\nLast repeat:\n\n" + w.Last.Body
+	}
+
+	return common.Message{
+		Time:    now,
+		Headers: w.Last.Headers,
+		From:    w.Last.From,
+		To:      w.Last.To,
+		Subject: fmt.Sprintf("%s (repeated %d %s)", w.Last.Subject, w.Count, times),
+		Body:    body,
+	}
+}
+
+// update loads state, passes it to change and saves it if changed, all
+// under lock
+func (d *Dedup) update(change func(windows map[string]*window) (changed bool)) (err error) {
+	lock, err := statefile.Lock(d.path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	windows := map[string]*window{}
+	// missing state file means no windows
+	if err = statefile.Read(d.path, &windows); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !change(windows) {
+		return nil
+	}
+	return statefile.Write(d.path, windows)
+}
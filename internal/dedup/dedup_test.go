@@ -0,0 +1,119 @@
+package dedup
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestDedupWindow(t *testing.T) {
+	conf := common.DedupConfig{
+		StatePath: filepath.Join(t.TempDir(), "state", "dedup.json"),
+		Window:    time.Hour,
+	}
+	d, err := New(conf)
+	if err != nil {
+		t.Fatalf("Can't create dedup: %v", err)
+	}
+
+	start := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+	msg := common.Message{
+		From:    "root@example.com",
+		Subject: "Cron <root@host> /usr/local/bin/backup",
+		Body:    "2024-03-01 02:00:01 backup failed: disk full (pid 4242)",
+	}
+
+	if suppress, err := d.Check(msg, []string{"telegram"}, start); err != nil || suppress {
+		t.Fatalf("First message suppressed: %v", err)
+	}
+
+	// repeats differing only in numbers are suppressed, also after restart
+	for i := 1; i <= 3; i++ {
+		d, err = New(conf)
+		if err != nil {
+			t.Fatalf("Can't reopen dedup: %v", err)
+		}
+		repeat := msg
+		repeat.Body = strings.ReplaceAll(repeat.Body, "4242", "43"+strings.Repeat("1", i))
+		repeat.Body = strings.ReplaceAll(repeat.Body, "02:00:01", "02:0"+string(rune('0'+i))+":01")
+		if suppress, err := d.Check(repeat, []string{"telegram"}, start.Add(time.Duration(i)*time.Minute)); err != nil || !suppress {
+			t.Fatalf("Repeat %d not suppressed: %v", i, err)
+		}
+	}
+
+	// other message isn't suppressed
+	other := msg
+	other.Body = "backup succeeded"
+	if suppress, _ := d.Check(other, []string{"telegram"}, start.Add(time.Minute)); suppress {
+		t.Fatalf("Different message suppressed")
+	}
+
+	if summaries, err := d.Closed(start.Add(59 * time.Minute)); err != nil || len(summaries) != 0 {
+		t.Fatalf("Expected no summary before window closes, got %d (%v)", len(summaries), err)
+	}
+
+	summaries, err := d.Closed(start.Add(time.Hour))
+	if err != nil || len(summaries) != 1 {
+		t.Fatalf("Expected 1 summary, got %d (%v)", len(summaries), err)
+	}
+	summary := summaries[0]
+	if summary.Message.Subject != msg.Subject+" (repeated 3 times)" {
+		t.Fatalf("Unexpected summary subject: %s", summary.Message.Subject)
+	}
+	if !strings.Contains(summary.Message.Body, "repeated 3 times since Fri, 01 Mar 2024 02:00:00 +0000") ||
+		!strings.Contains(summary.Message.Body, "pid 4311") {
+		t.Fatalf("Unexpected summary body: %s", summary.Message.Body)
+	}
+	if len(summary.Channels) != 1 || summary.Channels[0] != "telegram" {
+		t.Fatalf("Unexpected summary channels: %v", summary.Channels)
+	}
+
+	// summary is sent once and the next message opens a new window
+	if summaries, _ := d.Closed(start.Add(2 * time.Hour)); len(summaries) != 0 {
+		t.Fatalf("Summary returned again")
+	}
+	if suppress, _ := d.Check(msg, []string{"telegram"}, start.Add(2*time.Hour)); suppress {
+		t.Fatalf("Message after window closed suppressed")
+	}
+}
+
+func TestDedupFields(t *testing.T) {
+	if _, err := New(common.DedupConfig{StatePath: filepath.Join(t.TempDir(), "dedup.json"), Fields: []string{"header"}}); err == nil {
+		t.Fatalf("Unknown field accepted")
+	}
+
+	d, err := New(common.DedupConfig{StatePath: filepath.Join(t.TempDir(), "dedup.json"), Fields: []string{"Subject"}})
+	if err != nil {
+		t.Fatalf("Can't create dedup: %v", err)
+	}
+
+	first := common.Message{From: "a@example.com", Subject: "Disk  usage 91%", Body: "sda1"}
+	second := common.Message{From: "b@example.com", Subject: "disk usage 97%", Body: "sdb1"}
+	if d.fingerprint(first) != d.fingerprint(second) {
+		t.Fatalf("Messages with the same subject have different fingerprints")
+	}
+
+	d.fields = defaultFields
+	if d.fingerprint(first) == d.fingerprint(second) {
+		t.Fatalf("Messages from different senders have the same fingerprint")
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"Backup took 93s at 2024-03-01T02:00:00Z", "backup took #s at #-#-#t#:#:#z"},
+		{"job 5f3a9c1e  failed\n\twith  0x1F", "job # failed with #"},
+		{"no numbers here", "no numbers here"},
+	}
+	for _, test := range tests {
+		if normalised := normalise(test.text); normalised != test.expected {
+			t.Errorf("normalise(%q) = %q, expected %q", test.text, normalised, test.expected)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package digest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/statefile"
+)
+
+const (
+	// maxCheckInterval is the longest time a due digest waits to be sent
+	maxCheckInterval = time.Minute
+
+	// longest From and Subject shown in the table of messages
+	maxFromLength    = 40
+	maxSubjectLength = 80
+
+	// attachmentName is name of the file with bodies of collected messages
+	attachmentName = "digest.txt"
+
+	bufferExt = ".json"
+)
+
+// buffer holds messages collected into a digest
+type buffer struct {
+	// Since is when the first message was collected
+	Since time.Time
+	// Due is when the digest is to be sent
+	Due      time.Time
+	Messages []common.Message
+}
+
+// digest is configuration of a single digest
+type digest struct {
+	schedule schedule
+	attach   bool
+}
+
+// Batch is a digest due to be sent
+type Batch struct {
+	// Name is name of the route the digest was collected for
+	Name    string
+	Message common.Message
+}
+
+// Digests collects messages of routes with digest and combines them into
+// single messages when their schedules are due
+//
+// Messages of every digest are kept in their own file, locked while being
+// updated, so that they survive restarts and can be collected by the service
+// and sendmail invocations alike.
+type Digests struct {
+	dir     string
+	digests map[string]*digest
+}
+
+// New sets up digests of given routes with messages kept in a directory
+//
+// Parameters:
+//
+// - conf (common.DigestConfig): digest configuration
+// - routes (map[string]common.RouteDigest): digest configuration keyed by route name
+//
+// Returns:
+//
+// - d (*Digests): digests
+// - err (error): error if any or nil
+func New(conf common.DigestConfig, routes map[string]common.RouteDigest) (d *Digests, err error) {
+	if len(conf.DirPath) == 0 {
+		return nil, errors.New("digest dirPath not set")
+	}
+
+	d = &Digests{
+		dir:     conf.DirPath,
+		digests: make(map[string]*digest, len(routes)),
+	}
+	for name, route := range routes {
+		s, err := parseSchedule(route.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		d.digests[name] = &digest{schedule: s, attach: route.Attach}
+	}
+
+	if err = os.MkdirAll(d.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("can't create digest directory: %w", err)
+	}
+	return d, nil
+}
+
+// CheckInterval returns how often digests should be checked if they are due
+func (d *Digests) CheckInterval() time.Duration {
+	interval := maxCheckInterval
+	for _, digest := range d.digests {
+		if e, ok := digest.schedule.(every); ok {
+			interval = min(interval, max(time.Duration(e)/4, time.Second))
+		}
+	}
+	return interval
+}
+
+// Add collects a message into a digest
+//
+// The first message collected into an empty digest sets when the digest is
+// due.
+//
+// Parameters:
+//
+// - name (string): name of the route with digest
+// - msg (common.Message): message to collect
+// - now (time.Time): time the message is collected at
+//
+// Returns:
+//
+// - err (error): error if any or nil
+func (d *Digests) Add(name string, msg common.Message, now time.Time) (err error) {
+	digest, ok := d.digests[name]
+	if !ok {
+		return fmt.Errorf("unknown digest %s", name)
+	}
+
+	return d.update(name, func(buf *buffer) bool {
+		if len(buf.Messages) == 0 {
+			buf.Since = now
+			buf.Due = digest.schedule.next(now)
+		}
+		msg.Accepted = nil
+		buf.Messages = append(buf.Messages, msg)
+		return true
+	})
+}
+
+// Due returns digests due at given time and empties them
+//
+// Parameters:
+//
+// - now (time.Time): current time
+//
+// Returns:
+//
+// - batches ([]Batch): combined messages of due digests
+// - err (error): error if any or nil
+func (d *Digests) Due(now time.Time) (batches []Batch, err error) {
+	names := make([]string, 0, len(d.digests))
+	for name := range d.digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		err := d.update(name, func(buf *buffer) bool {
+			if len(buf.Messages) == 0 || now.Before(buf.Due) {
+				return false
+			}
+			batches = append(batches, Batch{Name: name, Message: combine(name, buf, d.digests[name].attach, now)})
+			*buf = buffer{}
+			return true
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return batches, errors.Join(errs...)
+}
+
+// combine returns single message with all messages of a digest
+//
+// The message starts with a table of collected messages followed by their
+// bodies, as parts channels can show collapsed, or if attach is set the
+// bodies are in an attached file. All attachments of collected messages are
+// attached too.
+func combine(name string, buf *buffer, attach bool, now time.Time) common.Message {
+	count := fmt.Sprintf("%d messages", len(buf.Messages))
+	if len(buf.Messages) == 1 {
+		count = "1 message"
+	}
+
+	msg := common.Message{
+		Time:    now,
+		From:    same(buf.Messages, func(m common.Message) string { return m.From }),
+		To:      same(buf.Messages, func(m common.Message) string { return m.To }),
+		Subject: fmt.Sprintf("Digest %s: %s", name, count),
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s since %s:\n\n", count, buf.Since.Format(time.RFC1123Z))
+	body.WriteString(table(buf.Messages))
+
+	parts := make([]common.Part, 0, len(buf.Messages))
+	for i, m := range buf.Messages {
+		parts = append(parts, common.Part{
+			Title: fmt.Sprintf("%d. %s", i+1, m.Subject),
+			Text: fmt.Sprintf("From: %s\nTo: %s\nTime: %s\n\n%s",
+				m.From, m.To, m.Time.Format(time.RFC1123Z), strings.TrimRight(m.Body, "\n")),
+		})
+		msg.Attachments = append(msg.Attachments, m.Attachments...)
+	}
+
+	if attach {
+		fmt.Fprintf(&body, "\nBodies of the messages are in the attached %s.", attachmentName)
+		msg.Attachments = append([]common.Attachment{{
+			Filename:    attachmentName,
+			ContentType: "text/plain",
+			Data:        []byte(common.JoinParts(parts) + "\n"),
+		}}, msg.Attachments...)
+	} else {
+		body.WriteString("\n" + common.JoinParts(parts))
+		msg.Parts = parts
+	}
+
+	msg.Body = body.String()
+	return msg
+}
+
+// table returns table with time, sender and subject of every message
+func table(messages []common.Message) string {
+	rows := [][]string{{"#", "Time", "From", "Subject"}}
+	for i, m := range messages {
+		rows = append(rows, []string{
+			fmt.Sprint(i + 1),
+			m.Time.Format("2006-01-02 15:04"),
+			format.Truncate(maxFromLength, format.OneLine(m.From)),
+			format.Truncate(maxSubjectLength, format.OneLine(m.Subject)),
+		})
+	}
+
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	var b strings.Builder
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+		}
+		b.WriteString(strings.TrimRight(strings.Join(cells, " | "), " ") + "\n")
+	}
+	return b.String()
+}
+
+// same returns the field if it's the same in all messages or empty string
+func same(messages []common.Message, field func(common.Message) string) string {
+	value := field(messages[0])
+	for _, m := range messages[1:] {
+		if field(m) != value {
+			return ""
+		}
+	}
+	return value
+}
+
+// update loads digest buffer, passes it to change and saves it if changed,
+// all under lock
+func (d *Digests) update(name string, change func(buf *buffer) (changed bool)) (err error) {
+	path := filepath.Join(d.dir, url.PathEscape(name)+bufferExt)
+
+	lock, err := statefile.Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	buf := &buffer{}
+	// missing file means empty buffer
+	if err = statefile.Read(path, buf); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !change(buf) {
+		return nil
+	}
+	if len(buf.Messages) == 0 {
+		if err = os.Remove(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return statefile.Write(path, buf)
+}
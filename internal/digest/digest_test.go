@@ -0,0 +1,148 @@
+package digest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestDigest(t *testing.T) {
+	conf := common.DigestConfig{DirPath: t.TempDir()}
+	routes := map[string]common.RouteDigest{
+		"backups":  {Schedule: "0 7 * * *"},
+		"logwatch": {Schedule: "6h", Attach: true},
+	}
+	d, err := New(conf, routes)
+	if err != nil {
+		t.Fatalf("Can't create digests: %v", err)
+	}
+
+	start := time.Date(2024, 3, 1, 2, 0, 0, 0, time.Local)
+	for i, subject := range []string{"Backup of /home OK", "Backup of /etc OK"} {
+		msg := common.Message{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			From:    "root@backup.example.com",
+			To:      "admin@example.com",
+			Subject: subject,
+			Body:    "backed up 42 files",
+		}
+		if err = d.Add("backups", msg, msg.Time); err != nil {
+			t.Fatalf("Can't add message: %v", err)
+		}
+	}
+	if err = d.Add("unknown", common.Message{}, start); err == nil {
+		t.Fatalf("Message added to unknown digest")
+	}
+
+	// collected messages survive restart
+	d, err = New(conf, routes)
+	if err != nil {
+		t.Fatalf("Can't reopen digests: %v", err)
+	}
+
+	if batches, err := d.Due(start.Add(4*time.Hour + 59*time.Minute)); err != nil || len(batches) != 0 {
+		t.Fatalf("Expected no digest before 7:00, got %d (%v)", len(batches), err)
+	}
+
+	batches, err := d.Due(start.Add(5 * time.Hour))
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("Expected 1 digest at 7:00, got %d (%v)", len(batches), err)
+	}
+	batch := batches[0]
+	if batch.Name != "backups" || batch.Message.Subject != "Digest backups: 2 messages" {
+		t.Fatalf("Unexpected digest %s: %s", batch.Name, batch.Message.Subject)
+	}
+	if batch.Message.From != "root@backup.example.com" || batch.Message.To != "admin@example.com" {
+		t.Fatalf("Unexpected digest From/To: %s/%s", batch.Message.From, batch.Message.To)
+	}
+	expectedTable := "" +
+		"# | Time             | From                    | Subject\n" +
+		"1 | 2024-03-01 02:00 | root@backup.example.com | Backup of /home OK\n" +
+		"2 | 2024-03-01 02:01 | root@backup.example.com | Backup of /etc OK\n"
+	if !strings.Contains(batch.Message.Body, expectedTable) {
+		t.Fatalf("Table not found in digest:\n%s", batch.Message.Body)
+	}
+	if !strings.Contains(batch.Message.Body, "=== 2. Backup of /etc OK ===") || strings.Count(batch.Message.Body, "backed up 42 files") != 2 {
+		t.Fatalf("Bodies not found in digest:\n%s", batch.Message.Body)
+	}
+	if parts := batch.Message.Parts; len(parts) != 2 || parts[1].Title != "2. Backup of /etc OK" || !strings.HasSuffix(parts[1].Text, "\n\nbacked up 42 files") {
+		t.Fatalf("Unexpected parts: %+v", parts)
+	}
+	if lead, ok := batch.Message.Lead(); !ok || !strings.HasSuffix(lead, expectedTable+"\n") {
+		t.Fatalf("Unexpected lead %t:\n%s", ok, lead)
+	}
+
+	// digest is sent once
+	if batches, _ := d.Due(start.Add(48 * time.Hour)); len(batches) != 0 {
+		t.Fatalf("Digest returned again")
+	}
+}
+
+func TestDigestAttach(t *testing.T) {
+	d, err := New(common.DigestConfig{DirPath: t.TempDir()}, map[string]common.RouteDigest{
+		"logwatch": {Schedule: "6h", Attach: true},
+	})
+	if err != nil {
+		t.Fatalf("Can't create digests: %v", err)
+	}
+
+	start := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+	attachment := common.Attachment{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n")}
+	d.Add("logwatch", common.Message{Time: start, From: "a@example.com", Subject: "Logwatch", Body: "all quiet", Attachments: []common.Attachment{attachment}}, start)
+	d.Add("logwatch", common.Message{Time: start, From: "b@example.com", Subject: "Logwatch", Body: "disk full"}, start.Add(5*time.Hour))
+
+	batches, err := d.Due(start.Add(6 * time.Hour))
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("Expected 1 digest 6h after the first message, got %d (%v)", len(batches), err)
+	}
+	msg := batches[0].Message
+	if len(msg.From) != 0 {
+		t.Fatalf("Expected empty From of messages from different senders, got %s", msg.From)
+	}
+	if strings.Contains(msg.Body, "disk full") || !strings.Contains(msg.Body, "attached digest.txt") || len(msg.Parts) != 0 {
+		t.Fatalf("Bodies not moved to attachment:\n%s", msg.Body)
+	}
+	if len(msg.Attachments) != 2 || msg.Attachments[0].Filename != "digest.txt" || msg.Attachments[1].Filename != "report.csv" {
+		t.Fatalf("Unexpected attachments: %v", msg.Attachments)
+	}
+	if !strings.Contains(string(msg.Attachments[0].Data), "all quiet") || !strings.Contains(string(msg.Attachments[0].Data), "disk full") {
+		t.Fatalf("Bodies not found in attachment:\n%s", msg.Attachments[0].Data)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// Friday
+	now := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		schedule string
+		expected time.Time
+	}{
+		{"90m", now.Add(90 * time.Minute)},
+		{"0 7 * * *", time.Date(2024, 3, 2, 7, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2024, 3, 1, 7, 40, 0, 0, time.UTC)},
+		{"30 8-18/2 * * 1-5", time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, 3, 3, 9, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 1", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.schedule)
+		if err != nil {
+			t.Errorf("Can't parse %q: %v", test.schedule, err)
+			continue
+		}
+		if next := s.next(now); !next.Equal(test.expected) {
+			t.Errorf("Next time of %q is %s, expected %s", test.schedule, next, test.expected)
+		}
+	}
+
+	for _, invalid := range []string{"", "-1h", "0 7 * *", "60 * * * *", "* * * 0 *", "*/0 * * * *", "5-1 * * * *", "0 0 31 2 *"} {
+		if _, err := parseSchedule(invalid); err == nil {
+			t.Errorf("Invalid schedule %q accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package digest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule tells when a digest is to be sent
+type schedule interface {
+	// next returns the first time the digest is due after given time
+	next(after time.Time) time.Time
+}
+
+// every is a schedule sending a digest an interval after its first message
+type every time.Duration
+
+func (e every) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cron is a schedule in crontab format: minute, hour, day of month, month
+// and day of week
+type cron struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday tell if the field was "*", if both day fields
+	// are restricted a day matching either of them matches as in crontab
+	anyDay, anyWeekday bool
+}
+
+// descriptors are shorthands of common crontab schedules
+var descriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// parseSchedule parses interval (e.g. 6h) or crontab like schedule
+//
+// Crontab schedules have five fields: minute, hour, day of month, month and
+// day of week, each a '*', number, range (1-5) or list of them (1,15) with
+// optional step (*/15). Descriptors @hourly, @daily, @weekly and @monthly
+// are accepted too.
+//
+// Parameters:
+//
+// - spec (string): schedule
+//
+// Returns:
+//
+// - s (schedule): parsed schedule
+// - err (error): error if the schedule is invalid
+func parseSchedule(spec string) (s schedule, err error) {
+	spec = strings.TrimSpace(spec)
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("interval %s is not positive", spec)
+		}
+		return every(interval), nil
+	}
+	if expanded, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q is neither an interval nor has 5 crontab fields", spec)
+	}
+
+	c := &cron{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	ranges := []struct {
+		name     string
+		bits     *uint64
+		min, max int
+	}{
+		{"minute", &c.minutes, 0, 59},
+		{"hour", &c.hours, 0, 23},
+		{"day of month", &c.days, 1, 31},
+		{"month", &c.months, 1, 12},
+		{"day of week", &c.weekdays, 0, 7},
+	}
+	for i, r := range ranges {
+		if *r.bits, err = parseField(fields[i], r.min, r.max); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.name, err)
+		}
+	}
+	// both 0 and 7 are Sunday
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never matches", spec)
+	}
+	return c, nil
+}
+
+// parseField returns bit set of values listed in a crontab field
+func parseField(field string, min int, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		switch i := strings.IndexByte(part, '-'); {
+		case part == "*":
+		case i >= 0:
+			if low, err = strconv.Atoi(part[:i]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+			if high, err = strconv.Atoi(part[i+1:]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			if low, err = strconv.Atoi(part); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			if step == 1 {
+				high = low
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first minute after given time matching the schedule or
+// zero time if there is none within next five years
+func (c *cron) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches tells if day of month and day of week fields match the day
+func (c *cron) dayMatches(t time.Time) bool {
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
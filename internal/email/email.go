@@ -0,0 +1,317 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"smtp2communicator/internal/common"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxDepth limits nesting of multipart entities
+const maxDepth = 20
+
+// Email is a parsed email with all texts decoded to valid UTF-8
+type Email struct {
+	// Header has all headers with RFC 2047 encoded words decoded
+	Header      mail.Header
+	Date        time.Time
+	From        []*mail.Address
+	To          []*mail.Address
+	Cc          []*mail.Address
+	Subject     string
+	TextBody    string
+	HTMLBody    string
+	Attachments []common.Attachment
+}
+
+// wordDecoder decodes RFC 2047 encoded words in any charset known to x/text
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Parse reads and decodes an email
+//
+// Content-Transfer-Encoding (base64, quoted-printable) of all parts is
+// undone, text parts are converted from their charset to UTF-8 and encoded
+// words in headers are decoded. Text without declared charset that isn't
+// valid UTF-8 is taken as Windows-1252, the most common charset of legacy
+// systems sending such mail.
+//
+// Parameters:
+//
+// - r (io.Reader): the raw email
+//
+// Returns:
+//
+// - email (*Email): parsed email
+// - err (error): error if the email can't be read or parsed
+func Parse(r io.Reader) (email *Email, err error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	email = &Email{
+		Header:  make(mail.Header, len(msg.Header)),
+		Subject: DecodeHeader(msg.Header.Get("Subject")),
+		From:    parseAddressList(msg.Header.Get("From")),
+		To:      parseAddressList(msg.Header.Get("To")),
+		Cc:      parseAddressList(msg.Header.Get("Cc")),
+	}
+	for key, values := range msg.Header {
+		decoded := make([]string, 0, len(values))
+		for _, value := range values {
+			decoded = append(decoded, DecodeHeader(value))
+		}
+		email.Header[key] = decoded
+	}
+	if date, err := mail.ParseDate(msg.Header.Get("Date")); err == nil {
+		email.Date = date
+	}
+
+	if err = email.parsePart(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	email.TextBody = strings.TrimSuffix(email.TextBody, "\n")
+	email.HTMLBody = strings.TrimSuffix(email.HTMLBody, "\n")
+	return email, nil
+}
+
+// parsePart decodes a single MIME entity adding its content to the email
+func (email *Email) parsePart(header textproto.MIMEHeader, body io.Reader, depth int) (err error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// missing or broken Content-Type means plain text (RFC 2045)
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return fmt.Errorf("multipart nested too deep")
+		}
+		if len(params["boundary"]) == 0 {
+			return fmt.Errorf("%s without boundary", mediaType)
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// raw part as multipart reader would otherwise undo only
+			// quoted-printable and hide the header
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = email.parsePart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("can't decode %s part: %w", mediaType, err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := DecodeHeader(dispositionParams["filename"])
+	if len(filename) == 0 {
+		filename = DecodeHeader(params["name"])
+	}
+
+	if disposition != "attachment" && len(filename) == 0 {
+		switch mediaType {
+		case "text/plain":
+			email.TextBody = appendText(email.TextBody, ToUTF8(data, params["charset"]))
+			return nil
+		case "text/html":
+			email.HTMLBody = appendText(email.HTMLBody, ToUTF8(data, params["charset"]))
+			return nil
+		}
+	}
+
+	attachment := common.Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+	}
+	if cid := strings.Trim(header.Get("Content-Id"), "<> "); disposition != "attachment" && len(cid) != 0 {
+		attachment.Inline = true
+		if len(attachment.Filename) == 0 {
+			attachment.Filename = cid
+		}
+	}
+	if len(attachment.Filename) == 0 {
+		attachment.Filename = "attachment"
+		if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+			attachment.Filename += extensions[0]
+		}
+	}
+	email.Attachments = append(email.Attachments, attachment)
+	return nil
+}
+
+// appendText joins text parts of the email
+func appendText(body string, text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if len(body) == 0 {
+		return text
+	}
+	return strings.TrimSuffix(body, "\n") + "\n\n" + text
+}
+
+// transferDecoder undoes Content-Transfer-Encoding
+//
+// Unknown encodings are passed through as they are.
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// base64Cleaner drops characters which aren't part of base64 alphabet (e.g.
+// spaces or tabs at ends of lines) as base64 decoder skips only line breaks
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (n int, err error) {
+	for n == 0 && err == nil {
+		var read int
+		read, err = c.r.Read(p)
+		for _, b := range p[:read] {
+			if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/' || b == '=' {
+				p[n] = b
+				n++
+			}
+		}
+	}
+	return n, err
+}
+
+// charsetReader converts text in given charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+// ToUTF8 converts text in given charset to valid UTF-8
+//
+// Text in unknown charset, or without charset, which isn't valid UTF-8 is
+// converted from Windows-1252. Invalid sequences are replaced with U+FFFD.
+//
+// Parameters:
+//
+// - data ([]byte): text
+// - charset (string): charset of the text, may be empty
+//
+// Returns:
+//
+// - text (string): UTF-8 text
+func ToUTF8(data []byte, charset string) (text string) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	switch {
+	case utf8.Valid(data) && (charset == "" || charset == "utf-8" || charset == "utf8" || charset == "us-ascii"):
+		return string(data)
+	case charset == "utf-8" || charset == "utf8":
+		return strings.ToValidUTF8(string(data), "�")
+	case charset == "" || charset == "us-ascii":
+		// 8-bit text without proper charset, Windows-1252 is guessed below
+	default:
+		reader, err := charsetReader(charset, bytes.NewReader(data))
+		if err != nil {
+			if utf8.Valid(data) {
+				return string(data)
+			}
+			break
+		}
+		if decoded, err := io.ReadAll(reader); err == nil {
+			return strings.ToValidUTF8(string(decoded), "�")
+		}
+	}
+
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	return string(decoded)
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in header value
+//
+// Values which can't be decoded are returned with only invalid UTF-8 fixed.
+//
+// Parameters:
+//
+// - value (string): raw header value
+//
+// Returns:
+//
+// - decoded (string): decoded UTF-8 value
+func DecodeHeader(value string) (decoded string) {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	return ToUTF8([]byte(decoded), "")
+}
+
+// parseAddressList parses addresses decoding their names
+//
+// Header which is not a valid list of addresses gives nil.
+func parseAddressList(value string) (addresses []*mail.Address) {
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	addresses, err := parser.ParseList(value)
+	if err != nil {
+		return nil
+	}
+	for _, address := range addresses {
+		address.Name = ToUTF8([]byte(address.Name), "")
+	}
+	return addresses
+}
+
+// FormatAddress formats address for displaying
+//
+// Unlike mail.Address.String names are kept readable instead of being
+// encoded as RFC 2047 words if they have non-ASCII characters.
+//
+// Parameters:
+//
+// - address (*mail.Address): address
+//
+// Returns:
+//
+// - formatted (string): e.g. "Name" <user@example.com>
+func FormatAddress(address *mail.Address) (formatted string) {
+	for _, r := range address.Name {
+		if r >= utf8.RuneSelf {
+			name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(address.Name)
+			return fmt.Sprintf("\"%s\" <%s>", name, address.Address)
+		}
+	}
+	return address.String()
+}
@@ -0,0 +1,222 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+// crlf converts test email to wire format
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func TestParseCharsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		from    string
+		subject string
+		body    string
+	}{
+		{
+			name: "quoted-printable ISO-8859-2",
+			raw: "From: =?ISO-8859-2?Q?Pawe=B3_Kowalski?= <pawel@example.com>\n" +
+				"Subject: =?ISO-8859-2?Q?Za=BF=F3=B3=E6_g=EA=B6l=B1_ja=BC=F1?=\n" +
+				"Content-Type: text/plain; charset=ISO-8859-2\n" +
+				"Content-Transfer-Encoding: quoted-printable\n\n" +
+				"Za=BF=F3=B3=E6 g=EA=B6l=B1 ja=BC=F1 w bardzo d=B3ugiej linii, kt=F3ra jest=\n" +
+				" z=B3amana.\n",
+			from:    `"Paweł Kowalski" <pawel@example.com>`,
+			subject: "Zażółć gęślą jaźń",
+			body:    "Zażółć gęślą jaźń w bardzo długiej linii, która jest złamana.",
+		},
+		{
+			name: "base64 Windows-1252",
+			raw: "From: =?windows-1252?B?Suly9G1l?= <jerome@example.com>\n" +
+				"Subject: =?windows-1252?Q?Caf=E9_=80_5?=\n" +
+				"Content-Type: text/plain; charset=\"windows-1252\"\n" +
+				"Content-Transfer-Encoding: base64\n\n" +
+				"Q2Fm6SCAIDUgLSDTbGUh\n",
+			from:    `"Jérôme" <jerome@example.com>`,
+			subject: "Café € 5",
+			body:    "Café € 5 - Óle!",
+		},
+		{
+			name: "KOI8-R",
+			raw: "From: root@example.com\n" +
+				"Subject: =?KOI8-R?B?8NLJ18XU?=\n" +
+				"Content-Type: text/plain; charset=KOI8-R\n" +
+				"Content-Transfer-Encoding: 8bit\n\n" +
+				"\xf0\xd2\xc9\xd7\xc5\xd4\n",
+			from:    "<root@example.com>",
+			subject: "Привет",
+			body:    "Привет",
+		},
+		{
+			name: "undeclared 8-bit",
+			raw: "From: root@example.com\n" +
+				"Subject: Caf\xe9\n\n" +
+				"na\xefve\n",
+			from:    "<root@example.com>",
+			subject: "Café",
+			body:    "naïve",
+		},
+		{
+			name: "invalid UTF-8 and unknown charset",
+			raw: "From: root@example.com\n" +
+				"Subject: =?x-unknown?Q?abc?=\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				"ok \xff\n",
+			from:    "<root@example.com>",
+			subject: "=?x-unknown?Q?abc?=",
+			body:    "ok �",
+		},
+	}
+
+	for _, test := range tests {
+		email, err := Parse(strings.NewReader(crlf(test.raw)))
+		if err != nil {
+			t.Errorf("%s: can't parse: %v", test.name, err)
+			continue
+		}
+		if len(email.From) != 1 || FormatAddress(email.From[0]) != test.from {
+			t.Errorf("%s: expected from %q, got %v", test.name, test.from, email.From)
+		}
+		if email.Subject != test.subject || email.Header.Get("Subject") != test.subject {
+			t.Errorf("%s: expected subject %q, got %q", test.name, test.subject, email.Subject)
+		}
+		if email.TextBody != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.name, test.body, email.TextBody)
+		}
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	raw := `From: cron@example.com
+To: =?utf-8?Q?J=C3=BCrgen?= <juergen@example.com>
+Subject: report
+Date: Mon, 2 Jan 2006 15:04:05 -0700
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Gr=FC=DFe
+--inner
+Content-Type: multipart/related; boundary="related"
+
+--related
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+R3LDvMOfZTwvcD4=
+--related
+Content-Type: image/png
+Content-Transfer-Encoding: base64
+Content-ID: <logo@example.com>
+
+iVBORw0KGgo=
+--related--
+--inner--
+--outer
+Content-Type: text/csv; name="=?utf-8?Q?Ergebnis_=C3=BCbersicht.csv?="
+Content-Disposition: attachment
+Content-Transfer-Encoding: base64
+
+YSxiCjEsMgo=
+--outer--
+`
+	email, err := Parse(strings.NewReader(crlf(raw)))
+	if err != nil {
+		t.Fatalf("Can't parse: %v", err)
+	}
+
+	if email.TextBody != "Grüße" {
+		t.Errorf("Unexpected text body: %q", email.TextBody)
+	}
+	if email.HTMLBody != "<p>Grüße</p>" {
+		t.Errorf("Unexpected HTML body: %q", email.HTMLBody)
+	}
+	if len(email.To) != 1 || FormatAddress(email.To[0]) != `"Jürgen" <juergen@example.com>` {
+		t.Errorf("Unexpected recipients: %v", email.To)
+	}
+	if email.Date.Year() != 2006 {
+		t.Errorf("Unexpected date: %v", email.Date)
+	}
+
+	if len(email.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %d", len(email.Attachments))
+	}
+	inline, attachment := email.Attachments[0], email.Attachments[1]
+	if !inline.Inline || inline.Filename != "logo@example.com" || inline.ContentType != "image/png" || string(inline.Data) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("Unexpected inline file: %+v", inline)
+	}
+	if attachment.Inline || attachment.Filename != "Ergebnis übersicht.csv" || attachment.ContentType != "text/csv" || string(attachment.Data) != "a,b\n1,2\n" {
+		t.Errorf("Unexpected attachment: %+v", attachment)
+	}
+}
+
+func TestParseAttachments(t *testing.T) {
+	raw := `From: cron@example.com
+To: user@example.com
+Subject: report
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="XXX"
+
+--XXX
+Content-Type: text/plain; charset=utf-8
+
+see attached
+--XXX
+Content-Type: text/csv; name="report.csv"
+Content-Disposition: attachment; filename="report.csv"
+Content-Transfer-Encoding: base64
+
+YSxiCjEsMgo=
+--XXX
+Content-Type: text/plain
+Content-Disposition: attachment; filename="notes.txt"
+
+not the body
+--XXX
+Content-Type: application/pdf
+Content-Disposition: attachment
+Content-Transfer-Encoding: base64
+
+JVBERg==
+--XXX--
+`
+	email, err := Parse(strings.NewReader(crlf(raw)))
+	if err != nil {
+		t.Fatalf("Can't parse email: %v", err)
+	}
+
+	if email.TextBody != "see attached" {
+		t.Errorf("Unexpected text body: %q", email.TextBody)
+	}
+	expected := []struct {
+		filename    string
+		contentType string
+		data        string
+	}{
+		{"report.csv", "text/csv", "a,b\n1,2\n"},
+		{"notes.txt", "text/plain", "not the body"},
+		{"attachment.pdf", "application/pdf", "%PDF"},
+	}
+	if len(email.Attachments) != len(expected) {
+		t.Fatalf("Expected %d attachments, got %+v", len(expected), email.Attachments)
+	}
+	for i, attachment := range email.Attachments {
+		if attachment.Filename != expected[i].filename || attachment.ContentType != expected[i].contentType || attachment.Inline {
+			t.Errorf("Unexpected attachment %d: %+v", i, attachment)
+		}
+		if string(attachment.Data) != expected[i].data {
+			t.Errorf("Unexpected data of %s: %q", attachment.Filename, attachment.Data)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText converts HTML email body to readable plain text
+//
+// Paragraphs, headings and other blocks are separated with empty lines, list
+// items are prefixed with "- " or their number, table rows are put on their
+// own lines with cells separated by " | ", links are followed by their
+// address in brackets and images are replaced by their alternative text.
+// Scripts, styles and other invisible content are dropped.
+//
+// Parameters:
+//
+// - body (string): HTML document or fragment
+//
+// Returns:
+//
+// - text (string): plain text
+func HTMLToText(body string) (text string) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		// html.Parse only fails on reader errors, keep the body as it is
+		return body
+	}
+
+	w := &textWriter{}
+	w.walk(doc)
+
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// textWriter collects text of HTML nodes collapsing whitespace the way a
+// browser would
+type textWriter struct {
+	b strings.Builder
+	// newlines is number of line breaks to write before next text
+	newlines int
+	// space tells if a space is to be written before next text
+	space bool
+	// lineStart tells if nothing but a prefix was written on current line
+	lineStart bool
+	// pre is depth of <pre> elements, whitespace is kept inside them
+	pre int
+	// lists has number of the last item of each open list, -1 if unordered
+	lists []int
+	// cells has number of cells written in each open table row
+	cells []int
+}
+
+// block requests line breaks before next text
+func (w *textWriter) block(newlines int) {
+	if newlines > w.newlines {
+		w.newlines = newlines
+	}
+	w.space = false
+}
+
+// flush writes pending line breaks or space
+func (w *textWriter) flush() {
+	switch {
+	case w.newlines > 0:
+		if w.b.Len() > 0 {
+			w.b.WriteString(strings.Repeat("\n", w.newlines))
+			w.lineStart = true
+		}
+		w.newlines = 0
+	case w.space && !w.lineStart:
+		w.b.WriteByte(' ')
+	}
+	w.space = false
+}
+
+// raw writes string as it is
+func (w *textWriter) raw(s string) {
+	w.flush()
+	w.b.WriteString(s)
+	w.lineStart = strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\n")
+}
+
+// text writes text collapsing whitespace unless inside <pre>
+func (w *textWriter) text(s string) {
+	if w.pre > 0 {
+		w.raw(s)
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if len(s) > 0 {
+			w.space = true
+		}
+		return
+	}
+	if strings.TrimLeft(s, " \t\r\n\f") != s {
+		w.space = true
+	}
+	for i, word := range words {
+		if i > 0 {
+			w.space = true
+		}
+		w.flush()
+		w.b.WriteString(word)
+		w.lineStart = false
+	}
+	if strings.TrimRight(s, " \t\r\n\f") != s {
+		w.space = true
+	}
+}
+
+// walk writes text of the node and all its children
+func (w *textWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	case html.DocumentNode:
+		w.children(n)
+		return
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Noscript, atom.Template:
+		return
+
+	case atom.Br:
+		w.flush()
+		w.b.WriteByte('\n')
+		w.lineStart = true
+
+	case atom.Hr:
+		w.block(1)
+		w.raw("----")
+		w.block(1)
+
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); len(alt) > 0 {
+			w.text("[" + alt + "]")
+		}
+
+	case atom.A:
+		w.children(n)
+		href := strings.TrimSpace(attr(n, "href"))
+		label := strings.TrimSpace(textContent(n))
+		if len(href) > 0 && !strings.HasPrefix(href, "#") && !strings.HasPrefix(strings.ToLower(href), "javascript:") &&
+			href != label && href != "mailto:"+label {
+			w.text(" (" + href + ")")
+		}
+
+	case atom.Pre:
+		w.block(2)
+		w.pre++
+		w.children(n)
+		w.pre--
+		w.block(2)
+
+	case atom.Ul, atom.Ol:
+		number := -1
+		if n.DataAtom == atom.Ol {
+			number = 0
+		}
+		if len(w.lists) == 0 {
+			w.block(2)
+		} else {
+			w.block(1)
+		}
+		w.lists = append(w.lists, number)
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		if len(w.lists) == 0 {
+			w.block(2)
+		} else {
+			w.block(1)
+		}
+
+	case atom.Li:
+		w.block(1)
+		prefix := "- "
+		if depth := len(w.lists); depth > 0 {
+			if w.lists[depth-1] >= 0 {
+				w.lists[depth-1]++
+				prefix = fmt.Sprintf("%d. ", w.lists[depth-1])
+			}
+			prefix = strings.Repeat("  ", depth-1) + prefix
+		}
+		w.raw(prefix)
+		w.children(n)
+		w.block(1)
+
+	case atom.Tr:
+		w.block(1)
+		w.cells = append(w.cells, 0)
+		w.children(n)
+		w.cells = w.cells[:len(w.cells)-1]
+		w.block(1)
+
+	case atom.Td, atom.Th:
+		if depth := len(w.cells); depth > 0 {
+			if w.cells[depth-1] > 0 {
+				w.space = false
+				w.raw(" | ")
+			}
+			w.cells[depth-1]++
+		}
+		w.children(n)
+
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Blockquote:
+		w.block(2)
+		w.children(n)
+		w.block(2)
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Nav, atom.Aside,
+		atom.Dl, atom.Dt, atom.Dd, atom.Caption, atom.Address, atom.Figure, atom.Figcaption:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+
+	default:
+		w.children(n)
+	}
+}
+
+// children writes text of all children of the node
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+// attr returns value of the node's attribute or empty string
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns all text inside the node
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
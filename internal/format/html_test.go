@@ -0,0 +1,50 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		text string
+	}{
+		{
+			name: "paragraphs",
+			html: "<html><head><title>x</title><style>p {}</style></head><body><h1>Alert</h1><p>Disk   is\n almost <b>full</b>.</p><p>Line<br>break</p><script>alert(1)</script></body></html>",
+			text: "Alert\n\nDisk is almost full.\n\nLine\nbreak",
+		},
+		{
+			name: "links and images",
+			html: `<p>See <a href="https://example.com/job/1">build log</a>, <a href="https://example.com">https://example.com</a> or <a href="#top">top</a> <img src="x.png" alt="logo"></p>`,
+			text: "See build log (https://example.com/job/1), https://example.com or top [logo]",
+		},
+		{
+			name: "lists",
+			html: "<p>Failed:</p><ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul><p>end</p>",
+			text: "Failed:\n\n- one\n- two\n  1. a\n  2. b\n\nend",
+		},
+		{
+			name: "table",
+			html: "<table><tr><th>Host</th><th>State</th></tr><tr><td>web1</td><td>DOWN</td></tr></table>",
+			text: "Host | State\nweb1 | DOWN",
+		},
+		{
+			name: "pre and entities",
+			html: "<div>a &amp; b &lt;c&gt;</div><pre>  x = 1\n  y = 2</pre>",
+			text: "a & b <c>\n\n  x = 1\n  y = 2",
+		},
+		{
+			name: "fragment",
+			html: "just <i>text</i>",
+			text: "just text",
+		},
+	}
+
+	for _, test := range tests {
+		if text := HTMLToText(test.html); text != test.text {
+			t.Errorf("%s: expected %q, got %q", test.name, test.text, text)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package format
+
+import (
+	"net/textproto"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"smtp2communicator/internal/common"
+)
+
+// Template is user defined message template
+//
+// Templates are Go text/template strings executed with common.Message as
+// data, so all its fields (.Time, .From, .To, .Subject, .Body, .Headers) are
+// available together with helper functions defined in funcs.
+type Template struct {
+	tmpl *template.Template
+}
+
+// funcs are helper functions available in templates
+var funcs = template.FuncMap{
+	"truncate":     Truncate,
+	"date":         date,
+	"regexReplace": regexReplace,
+	"header":       header,
+	"firstLine":    firstLine,
+	"oneLine":      OneLine,
+	"upper":        strings.ToUpper,
+	"lower":        strings.ToLower,
+	"trim":         strings.TrimSpace,
+	"default":      defaultValue,
+}
+
+// NewTemplate parses a template
+//
+// Parameters:
+//
+// - name (string): name of the template used in error messages
+// - text (string): the template
+//
+// Returns:
+//
+// - t (*Template): parsed template
+// - err (error): error if any or nil
+func NewTemplate(name, text string) (t *Template, err error) {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Render executes template with the message
+func (t *Template) Render(msg common.Message) (text string, err error) {
+	buf := strings.Builder{}
+	if err = t.tmpl.Execute(&buf, msg); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Truncate shortens s to at most n characters, "…" is appended if shortened
+//
+// It's the truncate template function and is used by channels to fit
+// message fields into limits of their services.
+func Truncate(n int, s string) string {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
+
+// date formats time using Go layout (e.g. "2006-01-02 15:04"), empty layout
+// means RFC 3339
+func date(layout string, t time.Time) string {
+	if len(layout) == 0 {
+		layout = time.RFC3339
+	}
+	return t.Format(layout)
+}
+
+// regexReplace replaces all matches of regular expression in s, replacement
+// can refer to groups as $1
+func regexReplace(pattern, replacement, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+// header returns value of a header, name is case insensitive
+func header(name string, headers map[string]string) string {
+	if value, ok := headers[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// firstLine returns first non empty line of s
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			return line
+		}
+	}
+	return ""
+}
+
+// OneLine collapses all white space, new lines included, to single spaces
+func OneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// defaultValue returns value or, if it's empty, the default
+func defaultValue(def, value string) string {
+	if len(strings.TrimSpace(value)) == 0 {
+		return def
+	}
+	return value
+}
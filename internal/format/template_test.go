@@ -0,0 +1,65 @@
+package format
+
+import (
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestTemplateRender(t *testing.T) {
+	msg := common.Message{
+		Time:    time.Date(2023, 11, 19, 15, 34, 50, 0, time.UTC),
+		Headers: map[string]string{"X-Cron-Env": "<SHELL=/bin/sh>"},
+		From:    "root (Cron Daemon)",
+		To:      "user",
+		Subject: "Cron <user@desktop> /usr/local/bin/backup.sh",
+		Body:    "\n  backup of /home failed\n  disk full\n",
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{
+			template: `[{{ date "15:04" .Time }}] {{ regexReplace "^Cron <[^>]*> " "" .Subject }}: {{ firstLine .Body }}`,
+			expected: "[15:34] /usr/local/bin/backup.sh: backup of /home failed",
+		},
+		{
+			template: `{{ .Subject | truncate 10 }} {{ oneLine .Body }}`,
+			expected: "Cron <use… backup of /home failed disk full",
+		},
+		{
+			template: `{{ header "x-cron-env" .Headers }}|{{ header "X-Missing" .Headers | default "n/a" }}|{{ upper .To }}`,
+			expected: "<SHELL=/bin/sh>|n/a|USER",
+		},
+	}
+
+	for _, test := range tests {
+		tmpl, err := NewTemplate("test", test.template)
+		if err != nil {
+			t.Fatalf("Can't parse template '%s': %v", test.template, err)
+		}
+		result, err := tmpl.Render(msg)
+		if err != nil {
+			t.Fatalf("Can't render template '%s': %v", test.template, err)
+		}
+		if result != test.expected {
+			t.Fatalf("Rendered template is not matching expected one: '%s' != '%s'", result, test.expected)
+		}
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	if _, err := NewTemplate("test", "{{ .Subject "); err == nil {
+		t.Fatalf("Expected error for invalid template")
+	}
+
+	tmpl, err := NewTemplate("test", `{{ regexReplace "(" "" .Subject }}`)
+	if err != nil {
+		t.Fatalf("Can't parse template: %v", err)
+	}
+	if _, err = tmpl.Render(common.Message{}); err == nil {
+		t.Fatalf("Expected error for invalid regular expression")
+	}
+}
@@ -0,0 +1,253 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+const (
+	// StatusOK is status of a working component or of a probe with all
+	// components working
+	StatusOK = "ok"
+	// StatusFail is status of a failed component or of a probe with any
+	// component failed
+	StatusFail = "fail"
+	// StatusUnverified is status of a channel which was initialised but
+	// can't check its credentials, it doesn't make the service not ready
+	StatusUnverified = "unverified"
+
+	// DefaultMaxQueue is queue length above which the service isn't ready
+	DefaultMaxQueue = 100
+
+	// probeTimeout limits time taken to check a listener accepts connections
+	probeTimeout = 2 * time.Second
+)
+
+// Component is status of a single component
+type Component struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is answer to a probe, status is ok unless any component failed
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// channel is result of channel initialisation and validation at startup
+type channel struct {
+	verified bool
+	err      error
+}
+
+// listener is an address an SMTP listener accepts connections on
+type listener struct {
+	name        string
+	address     string
+	implicitTLS bool
+}
+
+// Checker answers liveness and readiness probes
+//
+// Liveness (/healthz) checks that the process is alive and its listeners
+// accept connections. Readiness (/readyz) checks that the configuration was
+// loaded, enabled channels were initialised and their credentials validated
+// at startup and the queue of messages waiting for delivery is short enough.
+type Checker struct {
+	mu            sync.RWMutex
+	configuration string
+	listeners     []listener
+	channels      map[string]channel
+	queue         func() int
+	maxQueue      int
+}
+
+// New creates a checker of the service running with given configuration
+//
+// Parameters:
+//
+// - configuration (string): path of loaded configuration file
+//
+// Returns:
+//
+// - c (*Checker): checker
+func New(configuration string) (c *Checker) {
+	return &Checker{
+		configuration: configuration,
+		channels:      map[string]channel{},
+	}
+}
+
+// Listener adds an SMTP listener checked by liveness probe
+//
+// Parameters:
+//
+// - name (string): name of the listener, e.g. smtp
+// - address (string): host:port the listener accepts connections on
+// - implicitTLS (bool): true if connections are TLS from the very beginning
+//
+// Returns:
+//
+// - n/a
+func (c *Checker) Listener(name, address string, implicitTLS bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listeners = append(c.listeners, listener{name: name, address: address, implicitTLS: implicitTLS})
+}
+
+// Channel records result of channel initialisation and validation of its
+// credentials at startup
+//
+// Parameters:
+//
+// - name (string): name of the channel
+// - verified (bool): true if the channel validated its credentials with its service
+// - err (error): error of initialisation or validation, nil if there was none
+//
+// Returns:
+//
+// - n/a
+func (c *Checker) Channel(name string, verified bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.channels[name] = channel{verified: verified, err: err}
+}
+
+// Queue sets function returning number of messages waiting for delivery and
+// the number above which the service isn't ready, DefaultMaxQueue if not
+// positive
+func (c *Checker) Queue(depth func() int, maxQueue int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if maxQueue <= 0 {
+		maxQueue = DefaultMaxQueue
+	}
+	c.queue, c.maxQueue = depth, maxQueue
+}
+
+// Liveness checks that all listeners accept connections
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.mu.RLock()
+	listeners := append([]listener(nil), c.listeners...)
+	c.mu.RUnlock()
+
+	components := map[string]Component{}
+	for _, l := range listeners {
+		if err := probe(ctx, l); err != nil {
+			components["listener:"+l.name] = Component{Status: StatusFail, Detail: err.Error()}
+		} else {
+			components["listener:"+l.name] = Component{Status: StatusOK, Detail: "accepting on " + l.address}
+		}
+	}
+	return report(components)
+}
+
+// Readiness checks configuration, channels and queue
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	components := map[string]Component{
+		"configuration": {Status: StatusOK, Detail: c.configuration},
+	}
+	for name, ch := range c.channels {
+		switch {
+		case ch.err != nil:
+			components["channel:"+name] = Component{Status: StatusFail, Detail: ch.err.Error()}
+		case ch.verified:
+			components["channel:"+name] = Component{Status: StatusOK, Detail: "credentials valid"}
+		default:
+			components["channel:"+name] = Component{Status: StatusUnverified, Detail: "credentials can't be checked"}
+		}
+	}
+	if c.queue != nil {
+		depth := c.queue()
+		component := Component{Status: StatusOK, Detail: fmt.Sprintf("%d of at most %d messages waiting", depth, c.maxQueue)}
+		if depth > c.maxQueue {
+			component.Status = StatusFail
+		}
+		components["queue"] = component
+	}
+	return report(components)
+}
+
+// HealthzHandler returns HTTP handler answering liveness probe
+func (c *Checker) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, c.Liveness(r.Context()))
+	})
+}
+
+// ReadyzHandler returns HTTP handler answering readiness probe
+func (c *Checker) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, c.Readiness(r.Context()))
+	})
+}
+
+// probe checks that a listener accepts connections and greets clients
+//
+// The session is ended with QUIT so that the probe doesn't show up as
+// a failed session in logs.
+func probe(ctx context.Context, l listener) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	if l.implicitTLS {
+		// only the listener is checked, not its certificate
+		dialer := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+		conn, err = dialer.DialContext(ctx, "tcp", l.address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", l.address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	text := textproto.NewConn(conn)
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return fmt.Errorf("unexpected greeting: %w", err)
+	}
+	if err = text.PrintfLine("QUIT"); err != nil {
+		return err
+	}
+	_, _, err = text.ReadResponse(221)
+	return err
+}
+
+// report returns report of components, failed if any of them failed
+func report(components map[string]Component) Report {
+	r := Report{Status: StatusOK, Components: components}
+	for _, component := range components {
+		if component.Status == StatusFail {
+			r.Status = StatusFail
+		}
+	}
+	return r
+}
+
+// write sends report as JSON, with 503 status code if it failed
+func write(w http.ResponseWriter, r Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,94 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// smtpStub accepts connections greeting clients and answering QUIT
+func smtpStub(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 test ready\r\n"))
+			if line, _ := bufio.NewReader(conn).ReadString('\n'); line == "QUIT\r\n" {
+				conn.Write([]byte("221 bye\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestLiveness(t *testing.T) {
+	listener := smtpStub(t)
+	c := New("/etc/smtp2communicator.yaml")
+	c.Listener("smtp", listener.Addr().String(), false)
+
+	r := c.Liveness(context.Background())
+	if r.Status != StatusOK || r.Components["listener:smtp"].Status != StatusOK {
+		t.Fatalf("Expected accepting listener, got %+v", r)
+	}
+
+	listener.Close()
+	r = c.Liveness(context.Background())
+	if r.Status != StatusFail || r.Components["listener:smtp"].Status != StatusFail {
+		t.Fatalf("Expected failed listener, got %+v", r)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	depth := 3
+	c := New("/etc/smtp2communicator.yaml")
+	c.Channel("telegram", true, nil)
+	c.Channel("file", false, nil)
+	c.Queue(func() int { return depth }, 5)
+
+	server := httptest.NewServer(c.ReadyzHandler())
+	defer server.Close()
+
+	get := func() (int, Report) {
+		resp, err := server.Client().Get(server.URL)
+		if err != nil {
+			t.Fatalf("Can't get readiness: %v", err)
+		}
+		defer resp.Body.Close()
+		var r Report
+		if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("Can't decode readiness: %v", err)
+		}
+		return resp.StatusCode, r
+	}
+
+	if code, r := get(); code != http.StatusOK || r.Status != StatusOK || len(r.Components) != 4 {
+		t.Fatalf("Expected ready, got %d %+v", code, r)
+	}
+
+	depth = 6
+	if code, r := get(); code != http.StatusServiceUnavailable || r.Components["queue"].Status != StatusFail {
+		t.Fatalf("Expected long queue, got %d %+v", code, r)
+	}
+
+	depth = 0
+	c.Channel("slack", false, errors.New("botKey not set"))
+	code, r := get()
+	if code != http.StatusServiceUnavailable || r.Components["channel:slack"] != (Component{Status: StatusFail, Detail: "botKey not set"}) {
+		t.Fatalf("Expected failed channel, got %d %+v", code, r)
+	}
+	if r.Components["channel:telegram"].Status != StatusOK || r.Components["channel:file"].Status != StatusUnverified || r.Components["configuration"].Status != StatusOK {
+		t.Fatalf("Expected other components ok, got %+v", r)
+	}
+}
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Path is where the API accepts messages
+	Path = "/api/v1/messages"
+
+	defaultMaxBodySize = 1 << 20
+	defaultTimeout     = time.Minute
+
+	// acceptTimeout is how long to wait for the dispatcher to accept
+	// a message
+	acceptTimeout = 5 * time.Minute
+
+	// Headers the severity and tags of a message are passed in so that
+	// routes and templates can use them
+	SeverityHeader = "X-Severity"
+	TagsHeader     = "X-Tags"
+)
+
+// severities are accepted values of severity, as in syslog
+var severities = map[string]bool{
+	"debug": true, "info": true, "notice": true, "warning": true,
+	"error": true, "critical": true, "alert": true, "emergency": true,
+}
+
+// request is a message posted to the API
+type request struct {
+	Subject  string   `json:"subject"`
+	Body     string   `json:"body"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Severity string   `json:"severity"`
+	Tags     []string `json:"tags"`
+	// Channels, if set, are the channels to send the message to instead of
+	// those chosen by routes
+	Channels []string `json:"channels"`
+	// Wait asks to respond only once the message has been delivered, or
+	// its first delivery attempt failed
+	Wait bool `json:"wait"`
+}
+
+// response is the result of posting a message
+type response struct {
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Delivery *c.Delivery `json:"delivery,omitempty"`
+}
+
+// Statuses of a posted message
+const (
+	statusAccepted   = "accepted"
+	statusDelivered  = "delivered"
+	statusFailed     = "failed"
+	statusPending    = "pending"
+	statusRejected   = "rejected"
+	statusQueued     = "queued"
+	statusDigest     = "digest"
+	statusSuppressed = "suppressed"
+	statusDropped    = "dropped"
+)
+
+// handler accepts messages posted as JSON and passes them to the dispatcher
+type handler struct {
+	log         *zap.SugaredLogger
+	tokens      [][]byte
+	maxBodySize int64
+	timeout     time.Duration
+	channels    map[string]bool
+	msgChan     chan<- c.Message
+}
+
+// Handler returns HTTP handler of the API accepting messages
+//
+// Every request must carry one of configured tokens in the Authorization
+// header as a bearer token. A message is accepted once the dispatcher has
+// accepted it (stored it in spool if there is one), if the request asks to
+// wait then the response tells the outcome of delivery to every channel.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - conf (c.APIConfig): API configuration
+// - channels ([]string): names of enabled channels messages can target
+// - msgChan (chan<- c.Message): channel to pass received messages for sending
+//
+// Returns:
+//
+// - h (http.Handler): handler
+// - err (error): error if the API is misconfigured
+func Handler(ctx context.Context, conf c.APIConfig, channels []string, msgChan chan<- c.Message) (h http.Handler, err error) {
+	if len(conf.Tokens) == 0 {
+		return nil, errors.New("no API tokens set")
+	}
+
+	api := &handler{
+		log:         logger.LoggerFromContext(ctx),
+		maxBodySize: conf.MaxBodySize,
+		timeout:     conf.Timeout,
+		channels:    make(map[string]bool, len(channels)),
+		msgChan:     msgChan,
+	}
+	for i, token := range conf.Tokens {
+		if len(token) == 0 {
+			return nil, fmt.Errorf("API token %d is empty", i+1)
+		}
+		api.tokens = append(api.tokens, []byte(token))
+	}
+	if api.maxBodySize <= 0 {
+		api.maxBodySize = defaultMaxBodySize
+	}
+	if api.timeout <= 0 {
+		api.timeout = defaultTimeout
+	}
+	for _, channel := range channels {
+		api.channels[channel] = true
+	}
+	return api, nil
+}
+
+// ServeHTTP handles a single posted message
+func (api *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(w, http.StatusMethodNotAllowed, response{Status: statusRejected, Error: "use POST"})
+		return
+	}
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="smtp2communicator"`)
+		reply(w, http.StatusUnauthorized, response{Status: statusRejected, Error: "invalid or missing bearer token"})
+		return
+	}
+
+	var req request
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, api.maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reply(w, http.StatusRequestEntityTooLarge, response{Status: statusRejected, Error: fmt.Sprintf("request larger than %d bytes", tooLarge.Limit)})
+			return
+		}
+		reply(w, http.StatusBadRequest, response{Status: statusRejected, Error: fmt.Sprintf("invalid JSON: %v", err)})
+		return
+	}
+
+	msg, err := api.message(req)
+	if err != nil {
+		reply(w, http.StatusBadRequest, response{Status: statusRejected, Error: err.Error()})
+		return
+	}
+
+	accepted := make(chan error, 1)
+	msg.Accepted = accepted
+	var delivered chan c.Delivery
+	if req.Wait {
+		delivered = make(chan c.Delivery, 1)
+		msg.Delivered = delivered
+	}
+
+	select {
+	case api.msgChan <- msg:
+		metrics.Received(metrics.InputAPI)
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case err := <-accepted:
+		if err != nil {
+			reply(w, http.StatusServiceUnavailable, response{Status: statusRejected, Error: "message not accepted, try again later"})
+			return
+		}
+	case <-time.After(acceptTimeout):
+		api.log.Errorf("Message not accepted by dispatcher within %s", acceptTimeout)
+		reply(w, http.StatusServiceUnavailable, response{Status: statusRejected, Error: "message not accepted, try again later"})
+		return
+	}
+
+	if !req.Wait {
+		reply(w, http.StatusAccepted, response{Status: statusAccepted})
+		return
+	}
+
+	select {
+	case delivery := <-delivered:
+		code, status := outcome(delivery)
+		reply(w, code, response{Status: status, Delivery: &delivery})
+	case <-time.After(api.timeout):
+		reply(w, http.StatusAccepted, response{Status: statusPending, Error: fmt.Sprintf("not delivered within %s", api.timeout)})
+	case <-r.Context().Done():
+	}
+}
+
+// outcome returns status code and status of the response telling how the
+// first delivery attempt of a message went
+//
+// A failure to any channel takes precedence, then delivery deferred to
+// a channel, the message is delivered only once every channel is done with
+// it. Messages not sent to any channel are reported by the reason, being
+// collected into a digest, suppressed as a repeat or dropped.
+//
+// Parameters:
+//
+// - delivery (c.Delivery): outcome of the first delivery attempt
+//
+// Returns:
+//
+// - code (int): HTTP status code
+// - status (string): status of the response
+func outcome(delivery c.Delivery) (code int, status string) {
+	states := map[string]bool{}
+	for _, channel := range delivery.Channels {
+		states[channel.State] = true
+	}
+
+	switch {
+	case states[c.DeliveryFailed]:
+		return http.StatusBadGateway, statusFailed
+	case states[c.DeliveryDeferred]:
+		return http.StatusAccepted, statusQueued
+	case states[c.DeliveryDelivered]:
+		return http.StatusOK, statusDelivered
+	case len(delivery.Digests) != 0:
+		return http.StatusAccepted, statusDigest
+	case delivery.Suppressed:
+		return http.StatusOK, statusSuppressed
+	default:
+		return http.StatusOK, statusDropped
+	}
+}
+
+// authorized tells if the request carries one of the tokens
+func (api *handler) authorized(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+
+	found := 0
+	for _, expected := range api.tokens {
+		found |= subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), expected)
+	}
+	return found == 1
+}
+
+// message validates posted message and converts it into c.Message
+func (api *handler) message(req request) (msg c.Message, err error) {
+	if len(strings.TrimSpace(req.Subject)) == 0 && len(strings.TrimSpace(req.Body)) == 0 {
+		return msg, errors.New("subject or body is required")
+	}
+	for _, channel := range req.Channels {
+		if !api.channels[channel] {
+			return msg, fmt.Errorf("unknown or disabled channel %q", channel)
+		}
+	}
+
+	msg = c.Message{
+		Time:     time.Now(),
+		Headers:  map[string]string{},
+		Subject:  req.Subject,
+		Body:     req.Body,
+		Channels: req.Channels,
+	}
+
+	if msg.From, err = address(req.From); err != nil {
+		return msg, fmt.Errorf("invalid from address: %w", err)
+	}
+	if msg.To, err = address(req.To); err != nil {
+		return msg, fmt.Errorf("invalid to address: %w", err)
+	}
+
+	if len(req.Severity) != 0 {
+		severity := strings.ToLower(req.Severity)
+		if !severities[severity] {
+			return msg, fmt.Errorf("unknown severity %q", req.Severity)
+		}
+		msg.Headers[SeverityHeader] = severity
+	}
+	if len(req.Tags) != 0 {
+		msg.Headers[TagsHeader] = strings.Join(req.Tags, ", ")
+	}
+	return msg, nil
+}
+
+// address returns e-mail address formatted the way SMTP input does it,
+// empty address is left empty
+func address(value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+	parsed, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
+
+// reply sends response as JSON
+func reply(w http.ResponseWriter, code int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
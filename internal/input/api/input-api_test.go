@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	c "smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+// dispatcherStub accepts every message and reports its delivery, failed to
+// channels listed in failing
+func dispatcherStub(msgChan <-chan c.Message, received chan<- c.Message, failing map[string]bool) {
+	for msg := range msgChan {
+		msg.Accepted <- nil
+		if msg.Delivered != nil {
+			delivery := c.Delivery{}
+			for _, channel := range msg.Channels {
+				if failing[channel] {
+					delivery.Record(channel, c.ChannelDelivery{State: c.DeliveryFailed, Error: "no network"})
+				} else {
+					delivery.Record(channel, c.ChannelDelivery{State: c.DeliveryDelivered})
+				}
+			}
+			msg.Delivered <- delivery
+		}
+		msg.Accepted, msg.Delivered = nil, nil
+		received <- msg
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	ctx := logger.ContextWithLogger(context.Background(), l.Sugar())
+
+	msgChan := make(chan c.Message)
+	defer close(msgChan)
+	received := make(chan c.Message, 10)
+	go dispatcherStub(msgChan, received, map[string]bool{"slack": true})
+
+	conf := c.APIConfig{Tokens: []string{"first", "second"}, MaxBodySize: 512}
+	h, err := Handler(ctx, conf, []string{"telegram", "slack"}, msgChan)
+	if err != nil {
+		t.Fatalf("Can't create handler: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	post := func(token, body string) (int, response) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		if len(token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Can't post: %v", err)
+		}
+		defer resp.Body.Close()
+		var r response
+		if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("Can't decode response: %v", err)
+		}
+		return resp.StatusCode, r
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		code  int
+	}{
+		{"no token", "", `{"subject": "hello"}`, http.StatusUnauthorized},
+		{"invalid token", "third", `{"subject": "hello"}`, http.StatusUnauthorized},
+		{"invalid JSON", "first", `{"subject": `, http.StatusBadRequest},
+		{"unknown field", "first", `{"subject": "hello", "priority": 1}`, http.StatusBadRequest},
+		{"too large", "first", `{"body": "` + strings.Repeat("x", 512) + `"}`, http.StatusRequestEntityTooLarge},
+		{"empty", "first", `{"from": "ci@example.com"}`, http.StatusBadRequest},
+		{"unknown channel", "first", `{"subject": "hello", "channels": ["whatsapp"]}`, http.StatusBadRequest},
+		{"unknown severity", "first", `{"subject": "hello", "severity": "meh"}`, http.StatusBadRequest},
+		{"invalid address", "first", `{"subject": "hello", "from": "ci@"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if code, r := post(test.token, test.body); code != test.code || r.Status != statusRejected {
+			t.Errorf("%s: expected %d, got %d %+v", test.name, test.code, code, r)
+		}
+	}
+	if len(received) != 0 {
+		t.Fatalf("Rejected messages passed to dispatcher")
+	}
+
+	code, r := post("second", `{"subject": "Deployed", "body": "v1.2.3", "from": "CI <ci@example.com>", "severity": "Info", "tags": ["deploy", "prod"]}`)
+	if code != http.StatusAccepted || r.Status != statusAccepted || r.Delivery != nil {
+		t.Fatalf("Expected accepted message, got %d %+v", code, r)
+	}
+	msg := <-received
+	if msg.Subject != "Deployed" || msg.Body != "v1.2.3" || msg.From != `"CI" <ci@example.com>` || len(msg.Channels) != 0 {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	if msg.Headers[SeverityHeader] != "info" || msg.Headers[TagsHeader] != "deploy, prod" {
+		t.Fatalf("Unexpected headers: %v", msg.Headers)
+	}
+
+	code, r = post("first", `{"subject": "Deployed", "channels": ["telegram"], "wait": true}`)
+	if code != http.StatusOK || r.Status != statusDelivered || r.Delivery.Channels["telegram"].State != c.DeliveryDelivered {
+		t.Fatalf("Expected delivered message, got %d %+v", code, r)
+	}
+	<-received
+
+	code, r = post("first", `{"subject": "Deployed", "channels": ["telegram", "slack"], "wait": true}`)
+	if code != http.StatusBadGateway || r.Status != statusFailed || r.Delivery.Channels["slack"].Error != "no network" {
+		t.Fatalf("Expected failed delivery, got %d %+v", code, r)
+	}
+	<-received
+}
+
+func TestOutcome(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		delivery c.Delivery
+		code     int
+		status   string
+	}{
+		{"delivered", c.Delivery{Channels: map[string]c.ChannelDelivery{"telegram": {State: c.DeliveryDelivered}, "slack": {State: c.DeliveryDropped}}}, http.StatusOK, statusDelivered},
+		{"failed", c.Delivery{Channels: map[string]c.ChannelDelivery{"telegram": {State: c.DeliveryFailed}, "slack": {State: c.DeliveryDeferred, Until: &until}}}, http.StatusBadGateway, statusFailed},
+		{"deferred", c.Delivery{Channels: map[string]c.ChannelDelivery{"telegram": {State: c.DeliveryDelivered}, "slack": {State: c.DeliveryDeferred, Until: &until}}}, http.StatusAccepted, statusQueued},
+		{"digest", c.Delivery{Digests: []string{"daily"}}, http.StatusAccepted, statusDigest},
+		{"digest and delivered", c.Delivery{Digests: []string{"daily"}, Channels: map[string]c.ChannelDelivery{"telegram": {State: c.DeliveryDelivered}}}, http.StatusOK, statusDelivered},
+		{"suppressed", c.Delivery{Suppressed: true}, http.StatusOK, statusSuppressed},
+		{"dropped", c.Delivery{Channels: map[string]c.ChannelDelivery{"telegram": {State: c.DeliveryDropped}}}, http.StatusOK, statusDropped},
+	}
+	for _, test := range tests {
+		if code, status := outcome(test.delivery); code != test.code || status != test.status {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.status, code, status)
+		}
+	}
+}
+
+func TestHandlerNotAccepted(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	ctx := logger.ContextWithLogger(context.Background(), l.Sugar())
+
+	msgChan := make(chan c.Message, 1)
+	h, _ := Handler(ctx, c.APIConfig{Tokens: []string{"token"}}, nil, msgChan)
+	go func() {
+		msg := <-msgChan
+		msg.Accepted <- errors.New("spool full")
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(`{"body": "hello"}`))
+	req.Header.Set("Authorization", "bearer token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := Handler(ctx, c.APIConfig{}, nil, msgChan); err == nil {
+		t.Fatalf("Handler without tokens created")
+	}
+}
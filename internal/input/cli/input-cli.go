@@ -0,0 +1,218 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/routing"
+	"smtp2communicator/pkg/logger"
+)
+
+// Command is the first argument switching the tool to the send mode
+const Command = "send"
+
+// SendOptions are flags of the send mode
+type SendOptions struct {
+	Subject string
+	Body    string
+	// File to read the body from, "-" for stdin
+	File string
+	// Channels and channels of Route are what the message is sent to,
+	// routes are applied if neither is set
+	Channels []string
+	Route    string
+}
+
+// list is a flag that may be given several times, each time with comma
+// separated values
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// ParseSend parses arguments of the send mode, those following "send"
+//
+// Parameters:
+//
+// - args ([]string): arguments following "send"
+// - output (io.Writer): where to print usage and errors
+//
+// Returns:
+//
+// - opts (SendOptions): parsed options
+// - err (error): error if any, flag.ErrHelp if help was asked for
+func ParseSend(args []string, output io.Writer) (opts SendOptions, err error) {
+	flags := flag.NewFlagSet(Command, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintf(output, "Usage: %s [-configuration file] %s -s subject [-m text | -f file] [-channel name,...] [-route name]\n\n", os.Args[0], Command)
+		fmt.Fprintln(output, "Sends text given on command line, the body is read from stdin with -f -.")
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&opts.Subject, "subject", "", "subject of the message")
+	flags.StringVar(&opts.Subject, "s", "", "subject of the message")
+	flags.StringVar(&opts.Body, "message", "", "body of the message")
+	flags.StringVar(&opts.Body, "m", "", "body of the message")
+	flags.StringVar(&opts.File, "file", "", "file to read body of the message from, - for stdin")
+	flags.StringVar(&opts.File, "f", "", "file to read body of the message from, - for stdin")
+	flags.Var((*list)(&opts.Channels), "channel", "channels to send the message to instead of those chosen by routes, comma separated")
+	flags.StringVar(&opts.Route, "route", "", "route to send the message to channels of instead of those chosen by routes")
+
+	if err = flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if flags.NArg() != 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if len(opts.Body) != 0 && len(opts.File) != 0 {
+		return opts, errors.New("body can be given either with -m or -f, not both")
+	}
+	if len(opts.Subject) == 0 && len(opts.Body) == 0 && len(opts.File) == 0 {
+		return opts, errors.New("subject or body is required")
+	}
+	return opts, nil
+}
+
+// ProcessSend sends a message given on command line
+//
+// The message is passed straight to the dispatcher, without composing and
+// parsing an email, and this function waits for the first attempt to
+// deliver it. Its sender is the current user at this host, the way
+// sendmail would set it.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - opts (SendOptions): options of the send mode
+// - input (io.Reader): where to read the body from if File is "-", normally os.Stdin
+// - channels ([]string): names of enabled channels
+// - router (*routing.Router): router to look up the route in
+// - msgChan (chan<- c.Message): channel to pass the message to, it's closed afterwards
+// - wg (sync.WaitGroup): wait group the dispatcher is done with once the message is sent
+//
+// Returns:
+//
+// - err (error): error if the message wasn't accepted or delivery to any channel failed
+func ProcessSend(ctx context.Context, opts SendOptions, input io.Reader, channels []string, router *routing.Router, msgChan chan<- c.Message, wg *sync.WaitGroup) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	msg, err := message(opts, input, channels, router)
+	if err != nil {
+		close(msgChan)
+		wg.Wait()
+		return err
+	}
+
+	accepted := make(chan error, 1)
+	delivered := make(chan c.Delivery, 1)
+	msg.Accepted, msg.Delivered = accepted, delivered
+	msgChan <- msg
+	close(msgChan)
+	metrics.Received(metrics.InputCLI)
+	wg.Wait()
+
+	if err = <-accepted; err != nil {
+		return fmt.Errorf("message not accepted: %w", err)
+	}
+
+	delivery := <-delivered
+	for _, name := range delivery.Digests {
+		log.Infof("Message collected into digest %s", name)
+	}
+	if delivery.Suppressed {
+		log.Info("Message repeated, suppressed")
+	}
+	names := make([]string, 0, len(delivery.Channels))
+	for name := range delivery.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := delivery.Channels[name]
+		switch d.State {
+		case c.DeliveryFailed:
+			log.Errorf("Message not delivered via %s: %s", name, d.Error)
+		case c.DeliveryDeferred:
+			log.Infof("Message to %s deferred until %s", name, d.Until.Format(time.RFC1123Z))
+		default:
+			log.Infof("Message %s via %s", d.State, name)
+		}
+	}
+	if delivery.Failed() {
+		return errors.New("delivery failed")
+	}
+	return nil
+}
+
+// message builds the message from options
+func message(opts SendOptions, input io.Reader, channels []string, router *routing.Router) (msg c.Message, err error) {
+	msg = c.Message{
+		Time:    time.Now(),
+		Headers: map[string]string{},
+		From:    c.LocalSender(),
+		Subject: opts.Subject,
+		Body:    opts.Body,
+	}
+
+	switch opts.File {
+	case "":
+	case "-":
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return msg, fmt.Errorf("can't read body from stdin: %w", err)
+		}
+		msg.Body = string(data)
+	default:
+		data, err := os.ReadFile(opts.File)
+		if err != nil {
+			return msg, fmt.Errorf("can't read body: %w", err)
+		}
+		msg.Body = string(data)
+	}
+	if len(strings.TrimSpace(msg.Subject)) == 0 && len(strings.TrimSpace(msg.Body)) == 0 {
+		return msg, errors.New("message has neither subject nor body")
+	}
+
+	enabled := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		enabled[channel] = true
+	}
+	for _, channel := range opts.Channels {
+		if !enabled[channel] {
+			return msg, fmt.Errorf("unknown or disabled channel '%s'", channel)
+		}
+		msg.Channels = append(msg.Channels, channel)
+	}
+	if len(opts.Route) != 0 {
+		routeChannels, ok := router.RouteChannels(opts.Route)
+		if !ok {
+			return msg, fmt.Errorf("unknown route '%s'", opts.Route)
+		}
+		if len(routeChannels) == 0 {
+			return msg, fmt.Errorf("route '%s' has no enabled channels", opts.Route)
+		}
+		msg.Channels = append(msg.Channels, routeChannels...)
+	}
+	return msg, nil
+}
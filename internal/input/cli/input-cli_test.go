@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/routing"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestParseSend(t *testing.T) {
+	opts, err := ParseSend([]string{"-s", "disk full", "-m", "sda1 at 99%", "-channel", "telegram,slack", "-channel", "file", "-route", "ops"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Can't parse: %v", err)
+	}
+	expected := SendOptions{Subject: "disk full", Body: "sda1 at 99%", Channels: []string{"telegram", "slack", "file"}, Route: "ops"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, opts)
+	}
+
+	if _, err := ParseSend([]string{"-h"}, io.Discard); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("Expected help, got %v", err)
+	}
+	for _, invalid := range [][]string{
+		{},
+		{"-channel", "telegram"},
+		{"-m", "body", "-f", "-"},
+		{"-s", "subject", "body"},
+		{"-x"},
+	} {
+		if _, err := ParseSend(invalid, io.Discard); err == nil {
+			t.Errorf("Invalid arguments %v accepted", invalid)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	channels := []string{"file", "slack", "telegram"}
+	router, err := routing.New(ctx, []c.Route{{Name: "ops", Channels: []string{"slack", "telegram"}}}, nil, channels)
+	if err != nil {
+		t.Fatalf("Can't create router: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "body.txt")
+	os.WriteFile(path, []byte("from file\n"), 0o600)
+
+	tests := []struct {
+		name     string
+		opts     SendOptions
+		body     string
+		channels []string
+	}{
+		{"inline", SendOptions{Subject: "subject", Body: "inline"}, "inline", nil},
+		{"file", SendOptions{File: path}, "from file\n", nil},
+		{"stdin", SendOptions{File: "-"}, "from stdin\n", nil},
+		{"channels", SendOptions{Subject: "subject", Channels: []string{"file"}}, "", []string{"file"}},
+		{"route", SendOptions{Subject: "subject", Route: "ops"}, "", []string{"slack", "telegram"}},
+	}
+	for _, test := range tests {
+		msg, err := message(test.opts, strings.NewReader("from stdin\n"), channels, router)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if msg.Body != test.body || !reflect.DeepEqual(msg.Channels, test.channels) || len(msg.From) == 0 {
+			t.Errorf("%s: unexpected message %+v", test.name, msg)
+		}
+	}
+
+	for _, invalid := range []SendOptions{
+		{File: filepath.Join(t.TempDir(), "missing")},
+		{File: "-"},
+		{Subject: "subject", Channels: []string{"whatsapp"}},
+		{Subject: "subject", Route: "unknown"},
+	} {
+		if _, err := message(invalid, strings.NewReader(" \n"), channels, router); err == nil {
+			t.Errorf("Invalid options %+v accepted", invalid)
+		}
+	}
+}
+
+func TestProcessSend(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	router, _ := routing.New(ctx, nil, nil, []string{"file", "slack"})
+
+	for _, failing := range []bool{false, true} {
+		msgChan := make(chan c.Message, 1)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgChan {
+				msg.Accepted <- nil
+				delivery := c.Delivery{}
+				delivery.Record("file", c.ChannelDelivery{State: c.DeliveryDelivered})
+				if failing {
+					delivery.Record("slack", c.ChannelDelivery{State: c.DeliveryFailed, Error: "no network"})
+				}
+				msg.Delivered <- delivery
+			}
+		}()
+
+		err := ProcessSend(ctx, SendOptions{Subject: "subject"}, nil, []string{"file", "slack"}, router, msgChan, &wg)
+		if failing != (err != nil) {
+			t.Errorf("Expected failure %t, got %v", failing, err)
+		}
+	}
+}
@@ -2,54 +2,70 @@ package stdin
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"net/mail"
 	"strings"
 	"time"
 
 	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/email"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
 
-	"github.com/DusanKasan/parsemail"
 	"go.uber.org/zap"
 )
 
 // readStdin reads message from standard input
 //
 // This function reads a message received on stdin into c.Message structs and
-// sends it to dispacher via msgChan channel.
+// sends it to dispacher via msgChan channel. Sendmail options, if the tool
+// runs as sendmail, tell where the message ends and where its sender and
+// recipients come from.
 //
 // Parameters:
 //
 // - log (*zap.SugaredLogger): logger
 // - input (io.Reader): where to read from the input (usually os.Stdin)
-// - msgProcessed (chan<- bool): exit status indicating if we did any work here
+// - opts (SendmailOptions): sendmail options the message was submitted with
+// - msgProcessed (chan<- error): nil if the message was passed on, *ExitError telling why not otherwise
 // - msgChan (chan<- c.Message): channel to send a message to
 //
 // Returns:
 //
-// - argName (argType): [description]
-// - err (error): error if any or nil
-func readStdin(log *zap.SugaredLogger, input io.Reader, msgProcessed chan<- bool, msgChan chan<- c.Message) {
+// - n/a
+func readStdin(log *zap.SugaredLogger, input io.Reader, opts SendmailOptions, msgProcessed chan<- error, msgChan chan<- c.Message) {
 	scanner := bufio.NewScanner(input)
 
 	body := []string{}
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		if opts.StopAtDot && line == "." {
+			break
+		}
 		body = append(body, line)
 	}
 
 	bodyText := strings.Join(body, "\n")
 
-	parsedMsg, err := parsemail.Parse(strings.NewReader(bodyText))
+	parsedMsg, err := email.Parse(strings.NewReader(bodyText))
 	if err != nil {
 		log.Errorf("Can't parse a mesage: %v", err)
+		msgProcessed <- &ExitError{Code: ExitDataErr, Err: fmt.Errorf("can't parse the message: %w", err)}
 		return
 	}
 
+	// HTML only emails are converted to plain text
+	textBody := parsedMsg.TextBody
+	if len(textBody) == 0 && len(parsedMsg.HTMLBody) != 0 {
+		textBody = format.HTMLToText(parsedMsg.HTMLBody)
+	}
+
 	// send info that there was no message in the body hence not sending anything and return
-	if len(parsedMsg.TextBody) == 0 {
-		msgProcessed <- false
+	if len(textBody) == 0 && len(parsedMsg.Attachments) == 0 {
+		msgProcessed <- &ExitError{Code: ExitDataErr, Err: errors.New("message has neither body nor attachments")}
 		return
 	}
 
@@ -62,19 +78,32 @@ func readStdin(log *zap.SugaredLogger, input io.Reader, msgProcessed chan<- bool
 	}
 
 	newMessage := c.Message{
-		Time: msgTime,
+		Time:    msgTime,
+		Headers: c.HeadersFromMail(parsedMsg.Header),
+	}
+	newMessage.From = getEmailAddr(parsedMsg.From, parsedMsg.Header.Get("From"))
+	if len(newMessage.From) == 0 {
+		newMessage.From = sender(opts)
+	}
+	newMessage.To = recipients(parsedMsg, opts)
+	// sendmail needs someone to deliver to, even if channels don't use it
+	if opts.Mode == ModeDeliver && len(newMessage.To) == 0 && !(opts.HeaderRecipients && len(parsedMsg.Header.Get("Bcc")) != 0) {
+		msgProcessed <- &ExitError{Code: ExitUsage, Err: errors.New("no recipients given")}
+		return
 	}
-	newMessage.From = getEmailAddr(parsedMsg.From, parsedMsg.Header["From"][0])
-	newMessage.To = getEmailAddr(parsedMsg.To, parsedMsg.Header["To"][0])
+	// blind copy recipients are not to be seen by others
+	delete(newMessage.Headers, "Bcc")
 	newMessage.Subject = parsedMsg.Subject
-	newMessage.Body = parsedMsg.TextBody
+	newMessage.Body = textBody
+	newMessage.Attachments = parsedMsg.Attachments
 
 	// send message to dispatcher
 	msgChan <- newMessage
 	close(msgChan)
+	metrics.Received(metrics.InputStdin)
 
 	// indicate we've done work
-	msgProcessed <- true
+	msgProcessed <- nil
 	close(msgProcessed)
 }
 
@@ -83,7 +112,7 @@ func readStdin(log *zap.SugaredLogger, input io.Reader, msgProcessed chan<- bool
 // This function is returning email address as it was specified in the source email
 // but it will look for it first in From attribute and if not present then it will be
 // read from headers. This is addressing issue where for example Cron can set sender and
-// recipient to be invalid email addresses and in such case the parsemail module
+// recipient to be invalid email addresses and in such case the email parser
 // used here is not going to set it in From attribute but raw value is still present in headers.
 //
 // Parameters:
@@ -103,9 +132,51 @@ func getEmailAddr(parsedEmailList []*mail.Address, unParsedEmail string) (fmtdFi
 }
 
 func mailToString(emailList []*mail.Address) (fmtdField string) {
+	addresses := make([]string, 0, len(emailList))
 	for _, value := range emailList {
-		fmtdField = value.String() + ", "
+		addresses = append(addresses, email.FormatAddress(value))
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// sender returns sender of a message without From header, as given by -f
+// and -F sendmail options or the current user
+func sender(opts SendmailOptions) string {
+	address := opts.Sender
+	if len(address) == 0 {
+		address = c.LocalSender()
+	}
+	return email.FormatAddress(&mail.Address{Name: opts.FullName, Address: address})
+}
+
+// recipients returns recipients of a message
+//
+// With -t recipients are taken from To and Cc headers, otherwise these given
+// as arguments are used. If there are none the To header is used. Blind copy
+// recipients are never shown.
+func recipients(parsedMsg *email.Email, opts SendmailOptions) string {
+	var to []string
+	if opts.HeaderRecipients {
+		to = append(to, getEmailAddr(parsedMsg.To, parsedMsg.Header.Get("To")))
+		to = append(to, getEmailAddr(parsedMsg.Cc, parsedMsg.Header.Get("Cc")))
+	} else {
+		for _, recipient := range opts.Recipients {
+			// local recipients like 'root' are kept as they are
+			if address, err := mail.ParseAddress(recipient); err == nil {
+				recipient = email.FormatAddress(address)
+			}
+			to = append(to, recipient)
+		}
+	}
+
+	nonEmpty := to[:0]
+	for _, recipient := range to {
+		if len(recipient) != 0 {
+			nonEmpty = append(nonEmpty, recipient)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return getEmailAddr(parsedMsg.To, parsedMsg.Header.Get("To"))
 	}
-	fmtdField = fmtdField[:len(fmtdField)-2]
-	return fmtdField
+	return strings.Join(nonEmpty, ", ")
 }
@@ -0,0 +1,140 @@
+package stdin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Modes sendmail can be run in (-b)
+const (
+	// ModeDeliver reads a message from stdin and delivers it (-bm)
+	ModeDeliver = "m"
+	// ModeAliases rebuilds aliases database (-bi, newaliases), there's
+	// nothing to do for this tool
+	ModeAliases = "i"
+)
+
+// Exit statuses of sendmail, as in sysexits.h
+const (
+	// ExitUsage is exit status of a command used incorrectly, e.g. with no
+	// recipients (EX_USAGE)
+	ExitUsage = 64
+	// ExitDataErr is exit status of invalid input, e.g. a message which
+	// can't be parsed (EX_DATAERR)
+	ExitDataErr = 65
+)
+
+// ExitError is an error sendmail exits with Code on
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// withArgument are sendmail options taking an argument, either attached
+// (-fsender) or as the next argument (-f sender)
+const withArgument = "BCFLNORVXfhopr"
+
+// SendmailOptions are options of the sendmail command line a message is
+// submitted with on stdin
+//
+// The zero value reads stdin until it's closed and takes recipients and
+// sender from headers, the way messages piped to this tool are read.
+type SendmailOptions struct {
+	// Mode is what sendmail is asked to do, ModeDeliver by default
+	Mode string
+	// Recipients are envelope recipients given as arguments
+	Recipients []string
+	// HeaderRecipients takes recipients from To and Cc headers (-t) instead
+	// of arguments, Bcc recipients are not shown
+	HeaderRecipients bool
+	// Sender is envelope sender (-f, -r), used if the message has no From
+	// header
+	Sender string
+	// FullName is full name of the sender (-F), used if the message has no
+	// From header
+	FullName string
+	// StopAtDot ends the message at a line with a single dot, unless -i or
+	// -oi is given
+	StopAtDot bool
+}
+
+// ParseSendmail parses sendmail command line arguments
+//
+// Options of sendmail which make no sense for this tool (e.g. -oem,
+// -B8BITMIME or -v) and unknown options are accepted and ignored so that
+// any program calling sendmail can submit its messages. Recipients
+// separated by commas are split.
+//
+// Parameters:
+//
+// - args ([]string): arguments, without the program name
+//
+// Returns:
+//
+// - opts (SendmailOptions): parsed options
+// - err (error): error if sendmail is asked for a mode this tool doesn't support
+func ParseSendmail(args []string) (opts SendmailOptions, err error) {
+	opts.Mode = ModeDeliver
+	opts.StopAtDot = true
+
+	var recipients []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			recipients = append(recipients, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			recipients = append(recipients, arg)
+			continue
+		}
+
+		option, value := arg[1], arg[2:]
+		if strings.IndexByte(withArgument, option) >= 0 && len(value) == 0 && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		switch option {
+		case 'b':
+			switch value {
+			case ModeDeliver, ModeAliases:
+				opts.Mode = value
+			default:
+				return opts, fmt.Errorf("unsupported mode -b%s, only -bm is supported", value)
+			}
+		case 't':
+			opts.HeaderRecipients = true
+		case 'i':
+			opts.StopAtDot = false
+		case 'o':
+			// -oi is the old form of -i, other options are ignored
+			if value == "i" {
+				opts.StopAtDot = false
+			}
+		case 'f', 'r':
+			if value != "<>" {
+				opts.Sender = value
+			}
+		case 'F':
+			opts.FullName = value
+		}
+	}
+
+	for _, recipient := range recipients {
+		for _, address := range strings.Split(recipient, ",") {
+			if address = strings.TrimSpace(address); len(address) != 0 {
+				opts.Recipients = append(opts.Recipients, address)
+			}
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,56 @@
+package stdin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSendmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected SendmailOptions
+	}{
+		{
+			"cron",
+			[]string{"-FCronDaemon", "-i", "-B8BITMIME", "-oem", "auser"},
+			SendmailOptions{Mode: ModeDeliver, Recipients: []string{"auser"}, FullName: "CronDaemon"},
+		},
+		{
+			"headers",
+			[]string{"-oi", "-t", "-f", "logwatch@example.com", "-F", "Log Watch"},
+			SendmailOptions{Mode: ModeDeliver, HeaderRecipients: true, Sender: "logwatch@example.com", FullName: "Log Watch"},
+		},
+		{
+			"recipients",
+			[]string{"-bm", "-r", "<>", "-v", "-N", "never", "a@example.com, b@example.com", "--", "-c@example.com"},
+			SendmailOptions{Mode: ModeDeliver, Recipients: []string{"a@example.com", "b@example.com", "-c@example.com"}, StopAtDot: true},
+		},
+		{
+			"attached",
+			[]string{"-fphp@example.com", "-Xlog", "-Ac", "-q1h", "-Owhatever=1", "root"},
+			SendmailOptions{Mode: ModeDeliver, Recipients: []string{"root"}, Sender: "php@example.com", StopAtDot: true},
+		},
+		{
+			"aliases",
+			[]string{"-bi"},
+			SendmailOptions{Mode: ModeAliases, StopAtDot: true},
+		},
+	}
+	for _, test := range tests {
+		opts, err := ParseSendmail(test.args)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, opts)
+		}
+	}
+
+	for _, mode := range []string{"-bs", "-bp", "-bd", "-bv"} {
+		if _, err := ParseSendmail([]string{mode}); err == nil {
+			t.Errorf("Unsupported mode %s accepted", mode)
+		}
+	}
+}
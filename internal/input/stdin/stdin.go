@@ -24,33 +24,69 @@ import (
 // - input (io.Reader): source of input message to read from, normally os.Stdin
 // - msgChan (chan message): channel to pass received messages to
 // - wg (sync.WaitGroup): channel to pass received messages to
-// - stdinTimeout (int): seconds to wait for input on stdin
+// - stdinTimeout (int): seconds to wait for input on stdin, 0 to wait until it's closed
+// - opts (SendmailOptions): sendmail options if run as sendmail
 //
 // Returns:
 //
 // - exit (bool): true if stdin message was processed and we should exit
-func ProcessStdin(ctx context.Context, input io.Reader, msgChan chan<- c.Message, wg *sync.WaitGroup, stdinTimeout int) (exit bool) {
+func ProcessStdin(ctx context.Context, input io.Reader, msgChan chan<- c.Message, wg *sync.WaitGroup, stdinTimeout int, opts SendmailOptions) (exit bool) {
 	log := logger.LoggerFromContext(ctx)
 
 	// listen for a message on stdin first
 	// if input present then prccess it and exit
 	// or timeout and proceed to TCP listening
 	log.Info("Stdin enabled")
-	msgProcessed := make(chan bool, 1)
-	go readStdin(log, input, msgProcessed, msgChan)
+	msgProcessed := make(chan error, 1)
+	go readStdin(log, input, opts, msgProcessed, msgChan)
+
+	// nil channel never times out
+	var timeout <-chan time.Time
+	if stdinTimeout > 0 {
+		timeout = time.After(time.Duration(stdinTimeout) * time.Second)
+	}
 
 	select {
-	case stdinResult := <-msgProcessed:
+	case err := <-msgProcessed:
 		log.Info("Stdin processing completed")
-		if stdinResult {
+		if err == nil {
 			wg.Wait()
 			log.Info("Message processed, exiting")
 			return true
 		} else {
-			log.Info("No message processed")
+			log.Infof("No message processed: %v", err)
 		}
-	case <-time.After(time.Duration(stdinTimeout) * time.Second):
+	case <-timeout:
 		log.Infof("Stdin timed out after %ds", stdinTimeout)
 	}
 	return
 }
+
+// ProcessSendmail handles a message submitted to this tool run as sendmail
+//
+// The message is read until the end of input (or a line with a single dot)
+// and this function waits for it to be dispatched.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - input (io.Reader): source of input message to read from, normally os.Stdin
+// - msgChan (chan message): channel to pass received message to
+// - wg (sync.WaitGroup): wait group the dispatcher is done with once the message is sent
+// - opts (SendmailOptions): sendmail options the message was submitted with
+//
+// Returns:
+//
+// - err (error): *ExitError telling exit status of sendmail if no message was passed on
+func ProcessSendmail(ctx context.Context, input io.Reader, msgChan chan<- c.Message, wg *sync.WaitGroup, opts SendmailOptions) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	msgProcessed := make(chan error, 1)
+	go readStdin(log, input, opts, msgProcessed, msgChan)
+	if err = <-msgProcessed; err != nil {
+		return err
+	}
+	wg.Wait()
+	log.Info("Message processed, exiting")
+	return nil
+}
@@ -2,6 +2,7 @@ package stdin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -53,7 +54,7 @@ tmpfs 31G 0 31G 0% /run/qem`,
 	wg.Add(1)
 
 	// start the function to to be tested
-	go ProcessStdin(ctx, data, msgChan, &wg, 1)
+	go ProcessStdin(ctx, data, msgChan, &wg, 1, SendmailOptions{})
 
 	// allow some time to process
 	time.Sleep(100 * time.Millisecond)
@@ -80,3 +81,114 @@ tmpfs 31G 0 31G 0% /run/qem`,
 		}
 	}
 }
+
+func TestReadStdinHTML(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+
+	message := "From: monitoring@example.com\n" +
+		"To: user@example.com\n" +
+		"Subject: Host down\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: text/html; charset=UTF-8\n\n" +
+		"<html><body><p>Host <b>web1</b> is DOWN</p><ul><li>ping failed</li></ul></body></html>"
+
+	msgChan := make(chan common.Message, 1)
+	msgProcessed := make(chan error, 1)
+	readStdin(l.Sugar(), strings.NewReader(message), SendmailOptions{}, msgProcessed, msgChan)
+
+	if err := <-msgProcessed; err != nil {
+		t.Fatalf("HTML only message was not processed: %v", err)
+	}
+	msg := <-msgChan
+	if expected := "Host web1 is DOWN\n\n- ping failed"; msg.Body != expected {
+		t.Fatalf("Received BODY is not matching expected one: '%s' != '%s'", expected, msg.Body)
+	}
+}
+
+func TestReadStdinSendmail(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+
+	message := "To: ops@example.com\n" +
+		"Cc: Dev Team <dev@example.com>\n" +
+		"Bcc: secret@example.com\n" +
+		"Subject: Logwatch\n\n" +
+		"all fine\n" +
+		".\n" +
+		"not part of the message\n"
+
+	tests := []struct {
+		name string
+		opts SendmailOptions
+		from string
+		to   string
+		body string
+	}{
+		{
+			"headers",
+			SendmailOptions{HeaderRecipients: true, Sender: "logwatch@example.com", FullName: "Log Watch", StopAtDot: true},
+			`"Log Watch" <logwatch@example.com>`,
+			`<ops@example.com>, "Dev Team" <dev@example.com>`,
+			"all fine",
+		},
+		{
+			"arguments",
+			SendmailOptions{Recipients: []string{"root", "admin@example.com"}, Sender: "php@example.com"},
+			"<php@example.com>",
+			"root, <admin@example.com>",
+			"all fine\n.\nnot part of the message",
+		},
+	}
+	for _, test := range tests {
+		msgChan := make(chan common.Message, 1)
+		msgProcessed := make(chan error, 1)
+		readStdin(l.Sugar(), strings.NewReader(message), test.opts, msgProcessed, msgChan)
+
+		if err := <-msgProcessed; err != nil {
+			t.Fatalf("%s: message was not processed: %v", test.name, err)
+		}
+		msg := <-msgChan
+		if msg.From != test.from || msg.To != test.to || msg.Body != test.body {
+			t.Errorf("%s: unexpected message from '%s' to '%s': '%s'", test.name, msg.From, msg.To, msg.Body)
+		}
+		if _, ok := msg.Headers["Bcc"]; ok {
+			t.Errorf("%s: Bcc header not removed", test.name)
+		}
+	}
+}
+
+func TestProcessSendmail(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	deliver := SendmailOptions{Mode: ModeDeliver}
+	tests := []struct {
+		name    string
+		message string
+		opts    SendmailOptions
+		code    int
+	}{
+		{"delivered", "To: ops@example.com\nSubject: Logwatch\n\nall fine\n", deliver, 0},
+		{"recipient argument", "Subject: Logwatch\n\nall fine\n", SendmailOptions{Mode: ModeDeliver, Recipients: []string{"root"}}, 0},
+		{"blind copy", "Bcc: ops@example.com\nSubject: Logwatch\n\nall fine\n", SendmailOptions{Mode: ModeDeliver, HeaderRecipients: true}, 0},
+		{"no recipients", "Subject: Logwatch\n\nall fine\n", deliver, ExitUsage},
+		{"blind copy without -t", "Bcc: ops@example.com\nSubject: Logwatch\n\nall fine\n", deliver, ExitUsage},
+		{"no body", "To: ops@example.com\nSubject: Logwatch\n\n", deliver, ExitDataErr},
+		{"not a message", "", deliver, ExitDataErr},
+	}
+	for _, test := range tests {
+		msgChan := make(chan common.Message, 1)
+		wg := sync.WaitGroup{}
+		err := ProcessSendmail(ctx, strings.NewReader(test.message), msgChan, &wg, test.opts)
+
+		var exitErr *ExitError
+		switch {
+		case test.code == 0 && err != nil:
+			t.Errorf("%s: message not processed: %v", test.name, err)
+		case test.code == 0 && len(msgChan) != 1:
+			t.Errorf("%s: message not passed on", test.name)
+		case test.code != 0 && (!errors.As(err, &exitErr) || exitErr.Code != test.code):
+			t.Errorf("%s: expected exit status %d, got %v", test.name, test.code, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"smtp2communicator/internal/common"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// dummyHash is compared against for unknown users so that response time
+	// doesn't reveal which users exist
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Authenticator verifies SMTP AUTH credentials
+type Authenticator struct {
+	users         map[string][]byte
+	required      bool
+	allowInsecure bool
+}
+
+// LoadAuthenticator creates authenticator from credentials file
+//
+// This function reads credentials file, each line of which is
+// 'user:bcrypt_hash' (as generated by 'htpasswd -nB user'). Empty lines and
+// lines starting with '#' are ignored.
+//
+// Parameters:
+//
+// - conf (common.AuthConfig): auth section of the configuration
+//
+// Returns:
+//
+// - auth (*Authenticator): authenticator or nil if auth is disabled
+// - err (error): error if any or nil
+func LoadAuthenticator(conf common.AuthConfig) (auth *Authenticator, err error) {
+	if len(conf.CredentialsFile) == 0 {
+		if conf.Required {
+			return nil, errors.New("auth required but credentialsFile not set")
+		}
+		return nil, nil
+	}
+
+	file, err := os.Open(conf.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	auth = &Authenticator{
+		users:         map[string][]byte{},
+		required:      conf.Required,
+		allowInsecure: conf.AllowInsecure,
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, found := strings.Cut(line, ":")
+		if !found || len(user) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected 'user:hash'", conf.CredentialsFile, lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid bcrypt hash: %w", conf.CredentialsFile, lineNo, err)
+		}
+		auth.users[user] = []byte(hash)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
+
+// Verify returns true if password is valid for the user
+func (a *Authenticator) Verify(user, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
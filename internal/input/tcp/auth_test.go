@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smtp2communicator/internal/common"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testAuthenticator creates authenticator knowing user 'cron' with password 'secret'
+func testAuthenticator(t *testing.T, allowInsecure bool) *Authenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Can't hash password: %v", err)
+	}
+
+	credentialsFile := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(credentialsFile, []byte("# test users\n\ncron:"+string(hash)+"\n"), 0o600)
+
+	auth, err := LoadAuthenticator(common.AuthConfig{
+		CredentialsFile: credentialsFile,
+		Required:        true,
+		AllowInsecure:   allowInsecure,
+	})
+	if err != nil {
+		t.Fatalf("Can't load credentials: %v", err)
+	}
+	return auth
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	client, _, _ := startSession(t, nil, testAuthenticator(t, false))
+
+	if caps := expect(t, client, "EHLO client.example.com", 250); strings.Contains(caps, "AUTH") {
+		t.Fatalf("EHLO reply advertises AUTH without TLS: %s", caps)
+	}
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00cron\x00secret")), 538)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 530)
+}
+
+func TestAuthPlain(t *testing.T) {
+	client, _, _ := startSession(t, nil, testAuthenticator(t, true))
+
+	if caps := expect(t, client, "EHLO client.example.com", 250); !strings.Contains(caps, "AUTH PLAIN LOGIN") {
+		t.Fatalf("EHLO reply doesn't advertise AUTH: %s", caps)
+	}
+	expect(t, client, "MAIL FROM:<cron@example.com>", 530)
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00cron\x00wrong")), 535)
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00cron\x00secret")), 235)
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00cron\x00secret")), 503)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+}
+
+func TestAuthPlainAuthorizationIdentity(t *testing.T) {
+	client, _, _ := startSession(t, nil, testAuthenticator(t, true))
+
+	expect(t, client, "EHLO client.example.com", 250)
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("admin\x00cron\x00secret")), 535)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 530)
+	expect(t, client, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("cron\x00cron\x00secret")), 235)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+}
+
+func TestAuthLogin(t *testing.T) {
+	client, _, _ := startSession(t, nil, testAuthenticator(t, true))
+
+	expect(t, client, "EHLO client.example.com", 250)
+
+	expect(t, client, "AUTH LOGIN", 334)
+	expect(t, client, "*", 501)
+
+	if challenge := expect(t, client, "AUTH LOGIN", 334); challenge != base64.StdEncoding.EncodeToString([]byte("Username:")) {
+		t.Fatalf("Unexpected LOGIN challenge: %s", challenge)
+	}
+	expect(t, client, base64.StdEncoding.EncodeToString([]byte("cron")), 334)
+	expect(t, client, base64.StdEncoding.EncodeToString([]byte("secret")), 235)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+}
+
+func TestLoadAuthenticatorInvalid(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(credentialsFile, []byte("cron:plaintext\n"), 0o600)
+
+	if _, err := LoadAuthenticator(common.AuthConfig{CredentialsFile: credentialsFile}); err == nil {
+		t.Fatalf("Expected error for password that is not bcrypt hash")
+	}
+	if _, err := LoadAuthenticator(common.AuthConfig{Required: true}); err == nil {
+		t.Fatalf("Expected error for required auth without credentials")
+	}
+}
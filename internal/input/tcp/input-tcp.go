@@ -2,23 +2,91 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/mail"
+	"strconv"
 	"strings"
 	"time"
 
 	c "smtp2communicator/internal/common"
-	"smtp2communicator/pkg/utils"
+	"smtp2communicator/internal/email"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
 
-	"github.com/DusanKasan/parsemail"
 	"go.uber.org/zap"
 )
 
+const (
+	// acceptTimeout is how long to wait for the dispatcher to accept a message
+	acceptTimeout = 5 * time.Minute
+	// dataTimeout is how long to wait for the next line of message data
+	dataTimeout = 10 * time.Minute
+	// maxLineLength is maximum length of command line including CRLF, lines
+	// of message data are limited only by maxMessageSize
+	maxLineLength = 1000
+	// maxMessageSize is maximum accepted size of a message, advertised as SIZE
+	maxMessageSize = 25 * 1024 * 1024
+	// maxRecipients is maximum number of recipients of a single message
+	maxRecipients = 100
+	// maxErrors is number of failed commands after which the session is closed
+	maxErrors = 10
+)
+
+// commandTimeout is how long to wait for a command (RFC 5321 4.5.3.2.7), TLS
+// handshake or a reply to be sent, variable so that tests can shorten it
+var commandTimeout = 5 * time.Minute
+
+// errLineTooLong is returned by readLine when line exceeds its limit
+var errLineTooLong = errors.New("line too long")
+
+// sessionState is a state of SMTP session
+type sessionState int
+
+const (
+	// stateConnected means greeting was sent and HELO/EHLO is expected
+	stateConnected sessionState = iota
+	// stateReady means client introduced itself and MAIL can start a transaction
+	stateReady
+	// stateMail means sender was given and RCPT is expected
+	stateMail
+	// stateRcpt means at least one recipient was given and DATA can follow
+	stateRcpt
+)
+
+// session is a single SMTP connection
+type session struct {
+	log      *zap.SugaredLogger
+	hostname string
+	conn     net.Conn
+	reader   *bufio.Reader
+	msgChan  chan<- c.Message
+
+	// tlsConfig is set if TLS is available, tls is true once it's active
+	tlsConfig *tls.Config
+	tls       bool
+
+	// auth is set if AUTH is available, user is set once client authenticated
+	auth *Authenticator
+	user string
+
+	state      sessionState
+	failures   int
+	helo       string
+	from       string
+	recipients []string
+}
+
 // handleConnection handles incoming TCP connection
 //
-// This function read a message frim the TCP connection received into c.Message
-// struct and sends it to dispacher via msgChan channel.
+// This function runs SMTP session (RFC 5321) on the connection. Every message
+// received is parsed into c.Message struct and sent to dispacher via msgChan
+// channel. A session can carry any number of messages.
 //
 // Parameters:
 //
@@ -26,104 +94,622 @@ import (
 // - hostname (string): hostname to use in welcome message
 // - conn (net.Conn): tcp connection to read from
 // - msgChan (chan<- c.Message): channel to send a message to
+// - tlsConfig (*tls.Config): TLS configuration or nil if TLS is not available
+// - implicitTLS (bool): true if conn is already TLS connection
+// - auth (*Authenticator): authenticator or nil if AUTH is not available
 //
 // Returns:
 //
 // - n/a
-func handleConnection(log *zap.SugaredLogger, hostname string, conn net.Conn, msgChan chan<- c.Message) {
-	defer conn.Close()
-
-	newMessage := c.Message{}
+func handleConnection(log *zap.SugaredLogger, hostname string, conn net.Conn, msgChan chan<- c.Message, tlsConfig *tls.Config, implicitTLS bool, auth *Authenticator) {
+	s := &session{
+		log:       log.With("remote", conn.RemoteAddr().String()),
+		hostname:  hostname,
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		msgChan:   msgChan,
+		tlsConfig: tlsConfig,
+		tls:       implicitTLS,
+		auth:      auth,
+	}
+	// connection is replaced by TLS one on STARTTLS
+	defer func() { s.conn.Close() }()
 
-	connectionMessage := fmt.Sprintf("220 %s\n", hostname)
-	conn.Write([]byte(connectionMessage))
+	// TLS listener leaves the handshake to the first write, a client which
+	// never sends ClientHello would block the greeting forever
+	if implicitTLS {
+		tlsConn := conn.(*tls.Conn)
+		tlsConn.SetDeadline(time.Now().Add(commandTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			s.log.Warnf("TLS handshake failed: %v", err)
+			metrics.SessionError(metrics.SessionTLS)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
 
-	// Use a bufio.Reader to read lines from the connection
-	reader := bufio.NewReader(conn)
+	s.serve()
+}
 
-	newBody := []string{}
+// serve reads commands and replies to them until the session ends
+func (s *session) serve() {
+	s.reply(220, fmt.Sprintf("%s ESMTP smtp2communicator ready", s.hostname))
 
-	// read headers
 	for {
-		line, err := reader.ReadString('\n')
+		s.conn.SetReadDeadline(time.Now().Add(commandTimeout))
+		line, err := s.readLine(maxLineLength)
+		if errors.Is(err, errLineTooLong) {
+			s.fail(500, "Line too long")
+			continue
+		}
 		if err != nil {
-			log.Warnf("Can't read data")
+			if err != io.EOF {
+				s.log.Warnf("Can't read command: %v", err)
+				metrics.SessionError(metrics.SessionRead)
+			}
+			return
 		}
 
-		if utils.MatchString("start", line, "ehlo") {
-			conn.Write([]byte("250 OK welcome\n"))
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		arg = strings.TrimSpace(arg)
+
+		switch verb {
+		case "HELO":
+			s.handleHelo(arg, false)
+		case "EHLO":
+			s.handleHelo(arg, true)
+		case "AUTH":
+			if !s.handleAuth(arg) {
+				return
+			}
+		case "MAIL":
+			s.handleMail(arg)
+		case "RCPT":
+			s.handleRcpt(arg)
+		case "DATA":
+			s.handleData(arg)
+		case "STARTTLS":
+			if !s.handleStartTLS(arg) {
+				return
+			}
+		case "RSET":
+			if len(arg) != 0 {
+				s.fail(501, "Syntax: RSET")
+				continue
+			}
+			s.reset()
+			s.reply(250, "OK")
+		case "NOOP":
+			s.reply(250, "OK")
+		case "VRFY":
+			if len(arg) == 0 {
+				s.fail(501, "Syntax: VRFY <address>")
+				continue
+			}
+			s.reply(252, "Cannot VRFY user, but will accept message and attempt delivery")
+		case "EXPN":
+			s.reply(502, "Command not implemented")
+		case "HELP":
+			s.reply(214, "Commands: HELO EHLO STARTTLS AUTH MAIL RCPT DATA RSET NOOP VRFY HELP QUIT")
+		case "QUIT":
+			s.reply(221, fmt.Sprintf("%s closing connection", s.hostname))
+			return
+		default:
+			s.fail(500, "Command not recognized")
 		}
-		if utils.MatchString("start", line, "helo") {
-			conn.Write([]byte("250 OK welcome\n"))
+
+		if s.failures >= maxErrors {
+			s.reply(421, fmt.Sprintf("%s too many errors, closing connection", s.hostname))
+			metrics.SessionError(metrics.SessionTooManyErrors)
+			return
 		}
+	}
+}
 
-		if utils.MatchString("start", line, "mail from") {
-			if result, err := utils.KvExtractor(line); err == nil {
-				newMessage.From = result[1]
+// handleHelo handles HELO and EHLO commands
+func (s *session) handleHelo(arg string, extended bool) {
+	if len(arg) == 0 {
+		s.fail(501, "Syntax: HELO/EHLO <domain>")
+		return
+	}
 
-				newBody = append(newBody, fmt.Sprintf("From: %s\n", result[1]))
+	s.helo = arg
+	s.reset()
+	s.state = stateReady
 
-				conn.Write([]byte("250 OK (mail from)\n"))
-			}
+	if !extended {
+		s.reply(250, fmt.Sprintf("%s Hello %s", s.hostname, arg))
+		return
+	}
+
+	capabilities := []string{
+		fmt.Sprintf("%s Hello %s", s.hostname, arg),
+		"PIPELINING",
+		"8BITMIME",
+		"SMTPUTF8",
+		fmt.Sprintf("SIZE %d", maxMessageSize),
+	}
+	if s.tlsConfig != nil && !s.tls {
+		capabilities = append(capabilities, "STARTTLS")
+	}
+	if s.authOffered() {
+		capabilities = append(capabilities, "AUTH PLAIN LOGIN")
+	}
+	capabilities = append(capabilities, "HELP")
+
+	s.reply(250, capabilities...)
+}
+
+// handleStartTLS handles STARTTLS command (RFC 3207)
+//
+// Returns false if the session can't continue.
+func (s *session) handleStartTLS(arg string) bool {
+	switch {
+	case s.tlsConfig == nil:
+		s.fail(502, "Command not implemented")
+		return true
+	case s.tls:
+		s.fail(503, "TLS already active")
+		return true
+	case len(arg) != 0:
+		s.fail(501, "Syntax: STARTTLS")
+		return true
+	case s.state == stateConnected:
+		s.fail(503, "Send EHLO first")
+		return true
+	case s.state != stateReady:
+		s.fail(503, "STARTTLS not allowed during mail transaction")
+		return true
+	}
+
+	s.reply(220, "Ready to start TLS")
+
+	tlsConn := tls.Server(s.conn, s.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.log.Warnf("TLS handshake failed: %v", err)
+		metrics.SessionError(metrics.SessionTLS)
+		return false
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	// anything sent before the handshake is discarded (RFC 3207 4.2), the
+	// session starts from scratch and client has to introduce itself again
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.tls = true
+	s.helo = ""
+	s.user = ""
+	s.reset()
+	s.state = stateConnected
+	return true
+}
+
+// authOffered returns true if AUTH can be used in the current session
+func (s *session) authOffered() bool {
+	return s.auth != nil && (s.tls || s.auth.allowInsecure)
+}
+
+// handleAuth handles AUTH command (RFC 4954) with PLAIN and LOGIN mechanisms
+//
+// Returns false if the session can't continue.
+func (s *session) handleAuth(arg string) bool {
+	switch {
+	case s.auth == nil:
+		s.fail(502, "Command not implemented")
+		return true
+	case !s.authOffered():
+		s.fail(538, "Encryption required for requested authentication mechanism")
+		return true
+	case s.state == stateConnected:
+		s.fail(503, "Send EHLO first")
+		return true
+	case len(s.user) != 0:
+		s.fail(503, "Already authenticated")
+		return true
+	case s.state != stateReady:
+		s.fail(503, "AUTH not allowed during mail transaction")
+		return true
+	}
+
+	mechanism, initialResponse, _ := strings.Cut(arg, " ")
+
+	var user, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		response, ok, err := s.authResponse(initialResponse, "")
+		if err != nil {
+			return false
+		}
+		if !ok {
+			return true
 		}
+		// authorization identity, authentication identity and password
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			s.fail(501, "Invalid PLAIN response")
+			return true
+		}
+		// users can act only as themselves (RFC 4616 2)
+		if len(parts[0]) != 0 && parts[0] != parts[1] {
+			s.log.Warnf("User '%s' not allowed to act as '%s'", parts[1], parts[0])
+			metrics.SessionError(metrics.SessionAuth)
+			s.fail(535, "Authentication credentials invalid")
+			return true
+		}
+		user, password = parts[1], parts[2]
+	case "LOGIN":
+		response, ok, err := s.authResponse(initialResponse, "Username:")
+		if err != nil {
+			return false
+		}
+		if !ok {
+			return true
+		}
+		user = response
+		if response, ok, err = s.authResponse("", "Password:"); err != nil {
+			return false
+		}
+		if !ok {
+			return true
+		}
+		password = response
+	default:
+		s.fail(504, "Unrecognized authentication mechanism")
+		return true
+	}
 
-		if utils.MatchString("start", line, "rcpt to") {
-			if result, err := utils.KvExtractor(line); err == nil {
-				newMessage.To = result[1]
+	if !s.auth.Verify(user, password) {
+		s.log.Warnf("Authentication failed for user '%s'", user)
+		metrics.SessionError(metrics.SessionAuth)
+		s.fail(535, "Authentication credentials invalid")
+		return true
+	}
 
-				newBody = append(newBody, fmt.Sprintf("To: %s\n", result[1]))
+	s.user = user
+	s.log = s.log.With("user", user)
+	s.reply(235, "Authentication successful")
+	return true
+}
 
-				conn.Write([]byte("250 OK (rcpt to)\n"))
-			}
+// authResponse returns decoded client response to AUTH challenge
+//
+// If initial response was given with AUTH command it's used, otherwise the
+// challenge is sent and response read. Returns ok false if authentication
+// was cancelled or response is invalid (reply is already sent then) and
+// error if the response couldn't be read.
+func (s *session) authResponse(initialResponse, challenge string) (response string, ok bool, err error) {
+	encoded := initialResponse
+	if len(encoded) == 0 {
+		s.reply(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+		encoded, err = s.readLine(maxLineLength)
+		if err != nil {
+			s.log.Warnf("Can't read AUTH response: %v", err)
+			return "", false, err
 		}
+	}
 
-		if utils.MatchString("exact", line, "data") {
-			conn.Write([]byte("354 OK (data)\n"))
-			break
+	if encoded == "*" {
+		s.fail(501, "Authentication cancelled")
+		return "", false, nil
+	}
+	// '=' is empty initial response
+	if encoded == "=" {
+		return "", true, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		s.fail(501, "Invalid base64 response")
+		return "", false, nil
+	}
+	return string(decoded), true, nil
+}
+
+// handleMail handles MAIL command starting a new transaction
+func (s *session) handleMail(arg string) {
+	switch {
+	case s.state == stateConnected:
+		s.fail(503, "Send HELO/EHLO first")
+		return
+	case s.state != stateReady:
+		s.fail(503, "Nested MAIL command")
+		return
+	}
+
+	if s.auth != nil && s.auth.required && len(s.user) == 0 {
+		s.fail(530, "Authentication required")
+		return
+	}
+
+	address, params, err := parsePath(arg, "FROM:")
+	if err != nil {
+		s.fail(501, "Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				s.fail(501, "Invalid SIZE parameter")
+				return
+			}
+			if size > maxMessageSize {
+				s.fail(552, "Message size exceeds fixed maximum message size")
+				return
+			}
+		case "BODY", "SMTPUTF8", "AUTH":
+		default:
+			s.fail(555, fmt.Sprintf("MAIL parameter %s not recognized", key))
+			return
 		}
 	}
 
-	// here we read actual message
+	s.from = address
+	s.state = stateMail
+	s.reply(250, "OK")
+}
+
+// handleRcpt handles RCPT command adding a recipient to the transaction
+func (s *session) handleRcpt(arg string) {
+	if s.state != stateMail && s.state != stateRcpt {
+		s.fail(503, "Need MAIL before RCPT")
+		return
+	}
+
+	address, params, err := parsePath(arg, "TO:")
+	if err != nil || len(address) == 0 {
+		s.fail(501, "Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(params) != 0 {
+		s.fail(555, "RCPT parameters not recognized")
+		return
+	}
+	if len(s.recipients) >= maxRecipients {
+		s.fail(452, "Too many recipients")
+		return
+	}
+
+	s.recipients = append(s.recipients, address)
+	s.state = stateRcpt
+	s.reply(250, "OK")
+}
+
+// handleData handles DATA command reading and submitting the message
+func (s *session) handleData(arg string) {
+	if len(arg) != 0 {
+		s.fail(501, "Syntax: DATA")
+		return
+	}
+	switch s.state {
+	case stateRcpt:
+	case stateMail:
+		s.fail(503, "Need RCPT before DATA")
+		return
+	default:
+		s.fail(503, "Need MAIL before DATA")
+		return
+	}
+
+	s.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	data, err := s.readData()
+	// transaction is over whatever the result
+	defer s.reset()
+
+	switch {
+	case errors.Is(err, errMessageTooBig):
+		s.reply(552, "Message size exceeds fixed maximum message size")
+		return
+	case err != nil:
+		s.log.Warnf("Can't read message data: %v", err)
+		metrics.SessionError(metrics.SessionRead)
+		return
+	}
+
+	code, text := submitMessage(s.log, s.from, s.recipients, data, s.msgChan)
+	s.reply(code, text)
+}
+
+// errMessageTooBig is returned by readData when message exceeds maxMessageSize
+var errMessageTooBig = errors.New("message too big")
+
+// readData reads message data until a line with a single dot
+//
+// Leading dot of lines starting with a dot is removed (RFC 5321 4.5.2).
+// Text lines longer than RFC 5321 allows are accepted, many mailers don't
+// wrap them. If the message is too big the rest of the data is still read
+// so that the session can continue.
+func (s *session) readData() (data []byte, err error) {
+	buf := bytes.Buffer{}
+	var dataErr error
+
 	for {
-		line, err := reader.ReadString('\n')
+		s.conn.SetReadDeadline(time.Now().Add(dataTimeout))
+		line, err := s.readLine(maxMessageSize)
+		if errors.Is(err, errLineTooLong) {
+			dataErr = errMessageTooBig
+			continue
+		}
 		if err != nil {
-			log.Error("Can't read from stdin")
+			return nil, err
 		}
 
-		// a single '.' on it's own means end of message
-		if utils.MatchString("exact", line, ".") {
-			conn.Write([]byte("250 OK body\n"))
+		if line == "." {
+			break
+		}
+		if dataErr != nil {
 			continue
+		}
 
+		line = strings.TrimPrefix(line, ".")
+		if buf.Len()+len(line)+1 > maxMessageSize {
+			dataErr = errMessageTooBig
+			continue
 		}
+		// line endings are normalised to LF as used by the stdin input
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	return buf.Bytes(), nil
+}
 
+// readLine reads a single line without trailing CRLF (or bare LF)
+//
+// Lines longer than limit, including CRLF, are consumed and errLineTooLong
+// returned.
+func (s *session) readLine(limit int) (line string, err error) {
+	buf := []byte{}
+	tooLong := false
+	for {
+		chunk, isPrefix, err := s.reader.ReadLine()
 		if err != nil {
-			if err == io.EOF {
-				break // Connection closed by the client
-			}
-			log.Errorf("Error reading data: %v", err)
-			return
+			return "", err
 		}
-
-		if utils.MatchString("exact", line, "quit") {
-			conn.Write([]byte("221 OK quit\n"))
+		// the limit includes CRLF which ReadLine strips
+		if len(buf)+len(chunk) > limit-2 {
+			tooLong = true
+		} else {
+			buf = append(buf, chunk...)
+		}
+		if !isPrefix {
 			break
 		}
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(buf), nil
+}
+
+// reset aborts current transaction
+func (s *session) reset() {
+	s.from = ""
+	s.recipients = nil
+	if s.state != stateConnected {
+		s.state = stateReady
+	}
+}
+
+// reply sends a reply, multiple lines are sent as multiline reply
+func (s *session) reply(code int, lines ...string) {
+	buf := strings.Builder{}
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(&buf, "%d%s%s\r\n", code, separator, line)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+	if _, err := s.conn.Write([]byte(buf.String())); err != nil {
+		s.log.Debugf("Can't send reply: %v", err)
+	}
+}
+
+// fail sends error reply and counts it
+func (s *session) fail(code int, text string) {
+	s.failures++
+	metrics.SessionError(metrics.SessionCommand)
+	s.reply(code, text)
+}
 
-		newBody = append(newBody, line)
+// envelopeAddress formats envelope address the way header addresses are
+//
+// Local addresses like 'root' are kept as they are and the empty reverse
+// path of bounces ('MAIL FROM:<>') gives empty address, there's no sender to
+// show.
+func envelopeAddress(address string) string {
+	if len(address) == 0 {
+		return ""
+	}
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return email.FormatAddress(parsed)
 	}
+	return address
+}
 
-	msgString := strings.Join(newBody, "")
-	msgStringLen := len(msgString)
-	msgString = msgString[:msgStringLen-2] // remove trailing \r\n
-	parsedMsg, err := parsemail.Parse(strings.NewReader(msgString))
+// parsePath parses MAIL/RCPT argument into address and parameters
+//
+// Both 'FROM:<address> PARAM=value' and relaxed forms used by some clients,
+// like 'FROM: <address>' or 'FROM: address', are accepted. Empty reverse
+// path '<>' gives empty address.
+func parsePath(arg, prefix string) (address string, params []string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, errors.New("missing " + prefix)
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if len(arg) == 0 {
+		return "", nil, errors.New("missing address")
+	}
+
+	if strings.HasPrefix(arg, "<") {
+		end := strings.Index(arg, ">")
+		if end < 0 {
+			return "", nil, errors.New("unterminated address")
+		}
+		address = arg[1:end]
+		arg = arg[end+1:]
+	} else {
+		address, arg, _ = strings.Cut(arg, " ")
+	}
+
+	// source route '@a,@b:user@c' is to be ignored (RFC 5321 4.1.2)
+	if strings.HasPrefix(address, "@") {
+		if _, after, found := strings.Cut(address, ":"); found {
+			address = after
+		}
+	}
+
+	return address, strings.Fields(arg), nil
+}
+
+// submitMessage parses received message and passes it to the dispatcher
+//
+// This function waits for the dispatcher to accept the message so that the
+// sender is told the message was received only once it's safely stored.
+// Envelope sender and recipients are used if the message lacks From or To
+// headers.
+//
+// Parameters:
+//
+// - log (*zap.SugaredLogger): logger
+// - from (string): envelope sender
+// - recipients ([]string): envelope recipients
+// - data ([]byte): raw message
+// - msgChan (chan<- c.Message): channel to send a message to
+//
+// Returns:
+//
+// - code (int): SMTP reply code to be sent to the client
+// - text (string): SMTP reply text
+func submitMessage(log *zap.SugaredLogger, from string, recipients []string, data []byte, msgChan chan<- c.Message) (code int, text string) {
+	parsedMsg, err := email.Parse(bytes.NewReader(data))
 	if err != nil {
-		log.Error(err)
-		return
+		log.Errorf("Can't parse a message: %v", err)
+		metrics.SessionError(metrics.SessionParse)
+		return 554, "Can't parse message"
 	}
 
-	if len(parsedMsg.TextBody) == 0 {
-		return
+	// HTML only emails are converted to plain text
+	body := parsedMsg.TextBody
+	if len(body) == 0 && len(parsedMsg.HTMLBody) != 0 {
+		body = format.HTMLToText(parsedMsg.HTMLBody)
+	}
+
+	if len(body) == 0 && len(parsedMsg.Attachments) == 0 {
+		log.Info("Message has neither body nor attachments, ignoring")
+		return 250, "OK"
 	}
 
 	// If Year is 0 or 1 int then we replace that date with current time
@@ -134,11 +720,50 @@ func handleConnection(log *zap.SugaredLogger, hostname string, conn net.Conn, ms
 		msgTime = parsedMsg.Date
 	}
 
-	newMessage.Time = msgTime
-	newMessage.From = parsedMsg.From[0].String()
-	newMessage.To = parsedMsg.To[0].String()
-	newMessage.Subject = parsedMsg.Subject
-	newMessage.Body = parsedMsg.TextBody
+	newMessage := c.Message{
+		Time:        msgTime,
+		Headers:     c.HeadersFromMail(parsedMsg.Header),
+		Subject:     parsedMsg.Subject,
+		Body:        body,
+		Attachments: parsedMsg.Attachments,
+	}
 
+	if len(parsedMsg.From) > 0 {
+		newMessage.From = email.FormatAddress(parsedMsg.From[0])
+	} else {
+		newMessage.From = envelopeAddress(from)
+	}
+
+	if len(parsedMsg.To) > 0 {
+		to := make([]string, 0, len(parsedMsg.To))
+		for _, recipient := range parsedMsg.To {
+			to = append(to, email.FormatAddress(recipient))
+		}
+		newMessage.To = strings.Join(to, ", ")
+	} else {
+		to := make([]string, 0, len(recipients))
+		for _, recipient := range recipients {
+			to = append(to, envelopeAddress(recipient))
+		}
+		newMessage.To = strings.Join(to, ", ")
+	}
+
+	accepted := make(chan error, 1)
+	newMessage.Accepted = accepted
 	msgChan <- newMessage
+	metrics.Received(metrics.InputTCP)
+
+	select {
+	case err := <-accepted:
+		if err != nil {
+			metrics.SessionError(metrics.SessionNotAccepted)
+			return 451, "Requested action aborted: local error in processing"
+		}
+	case <-time.After(acceptTimeout):
+		log.Errorf("Message not accepted by dispatcher within %s", acceptTimeout)
+		metrics.SessionError(metrics.SessionNotAccepted)
+		return 451, "Requested action aborted: local error in processing"
+	}
+
+	return 250, "OK message accepted for delivery"
 }
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"smtp2communicator/internal/common"
+
+	"go.uber.org/zap"
+)
+
+// startSession runs SMTP session over in-memory connection and returns its
+// client side; messages are accepted as soon as they arrive
+func startSession(t *testing.T, tlsConfig *tls.Config, auth *Authenticator) (client *textproto.Conn, clientConn net.Conn, msgChan chan common.Message) {
+	l, _ := zap.NewDevelopment()
+	server, clientConn := net.Pipe()
+
+	msgChan = make(chan common.Message, 10)
+	received := make(chan common.Message)
+	go func() {
+		for msg := range received {
+			msg.Accepted <- nil
+			msgChan <- msg
+		}
+	}()
+
+	go handleConnection(l.Sugar(), "test.example.com", server, received, tlsConfig, false, auth)
+
+	client = textproto.NewConn(clientConn)
+	t.Cleanup(func() { client.Close() })
+
+	expect(t, client, "", 220)
+	return client, clientConn, msgChan
+}
+
+// expect sends a command (if not empty) and checks reply code
+func expect(t *testing.T, client *textproto.Conn, command string, code int) (message string) {
+	t.Helper()
+	if len(command) != 0 {
+		if err := client.PrintfLine("%s", command); err != nil {
+			t.Fatalf("Can't send '%s': %v", command, err)
+		}
+	}
+	_, message, err := client.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("Unexpected reply to '%s': %v", command, err)
+	}
+	return message
+}
+
+func TestSessionCommandOrder(t *testing.T) {
+	client, _, _ := startSession(t, nil, nil)
+
+	expect(t, client, "MAIL FROM:<cron@example.com>", 503)
+	expect(t, client, "DATA", 503)
+	expect(t, client, "BOGUS", 500)
+	expect(t, client, "NOOP", 250)
+	expect(t, client, "VRFY user", 252)
+
+	caps := expect(t, client, "EHLO client.example.com", 250)
+	for _, capability := range []string{"PIPELINING", "8BITMIME", "SIZE"} {
+		if !strings.Contains(caps, capability) {
+			t.Fatalf("EHLO reply doesn't advertise %s: %s", capability, caps)
+		}
+	}
+
+	expect(t, client, "RCPT TO:<user@example.com>", 503)
+	expect(t, client, "MAIL FROM:<cron@example.com> SIZE=999999999999", 552)
+	expect(t, client, "MAIL FROM:<cron@example.com> SIZE=100", 250)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 503)
+	expect(t, client, "DATA", 503)
+	expect(t, client, "RSET", 250)
+	expect(t, client, "RCPT TO:<user@example.com>", 503)
+	expect(t, client, "QUIT", 221)
+}
+
+func TestSessionEnvelopeAddresses(t *testing.T) {
+	client, _, msgChan := startSession(t, nil, nil)
+
+	expect(t, client, "EHLO client.example.com", 250)
+	expect(t, client, "MAIL FROM:<>", 250)
+	expect(t, client, "RCPT TO:<root>", 250)
+	expect(t, client, "RCPT TO:<user@example.com>", 250)
+	expect(t, client, "DATA", 354)
+
+	w := client.DotWriter()
+	w.Write([]byte("Subject: Undelivered Mail Returned to Sender\n\nbody\n"))
+	w.Close()
+	expect(t, client, "", 250)
+
+	msg := <-msgChan
+	if len(msg.From) != 0 {
+		t.Fatalf("Received FROM is not empty for null sender: '%s'", msg.From)
+	}
+	if msg.To != "root, <user@example.com>" {
+		t.Fatalf("Received TO is not matching envelope: '%s'", msg.To)
+	}
+
+	expect(t, client, "QUIT", 221)
+}
+
+func TestSessionLongDataLine(t *testing.T) {
+	client, _, msgChan := startSession(t, nil, nil)
+
+	expect(t, client, "EHLO client.example.com", 250)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+	expect(t, client, "RCPT TO:<user@example.com>", 250)
+	expect(t, client, "DATA", 354)
+
+	long := strings.Repeat("x", 5000)
+	w := client.DotWriter()
+	w.Write([]byte("Subject: long line\n\n" + long + "\n"))
+	w.Close()
+	expect(t, client, "", 250)
+
+	if msg := <-msgChan; msg.Body != long {
+		t.Fatalf("Received BODY is not the long line, got %d bytes", len(msg.Body))
+	}
+
+	// commands are still limited
+	expect(t, client, "NOOP "+long, 500)
+	expect(t, client, "QUIT", 221)
+}
+
+func TestSessionToHeader(t *testing.T) {
+	client, _, msgChan := startSession(t, nil, nil)
+
+	expect(t, client, "EHLO client.example.com", 250)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+	expect(t, client, "RCPT TO:<ops@example.com>", 250)
+	expect(t, client, "DATA", 354)
+
+	w := client.DotWriter()
+	w.Write([]byte("To: ops@example.com, Dev Team <dev@example.com>, db@example.com\nSubject: report\n\nbody\n"))
+	w.Close()
+	expect(t, client, "", 250)
+
+	if msg := <-msgChan; msg.To != `<ops@example.com>, "Dev Team" <dev@example.com>, <db@example.com>` {
+		t.Fatalf("Received TO is not matching header: '%s'", msg.To)
+	}
+
+	expect(t, client, "QUIT", 221)
+}
+
+func TestSessionMultipleMessages(t *testing.T) {
+	client, _, msgChan := startSession(t, nil, nil)
+
+	expect(t, client, "EHLO client.example.com", 250)
+
+	for _, subject := range []string{"first", "second"} {
+		expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+		expect(t, client, "RCPT TO:<user@example.com>", 250)
+		expect(t, client, "RCPT TO:<other@example.com>", 250)
+		expect(t, client, "DATA", 354)
+
+		w := client.DotWriter()
+		w.Write([]byte("Subject: " + subject + "\n\n.leading dot\nbody\n"))
+		w.Close()
+		expect(t, client, "", 250)
+
+		msg := <-msgChan
+		if msg.Subject != subject {
+			t.Fatalf("Received SUBJECT is not matching expected one: '%s' != '%s'", msg.Subject, subject)
+		}
+		if msg.Body != ".leading dot\nbody" {
+			t.Fatalf("Received BODY is not dot-unstuffed: '%q'", msg.Body)
+		}
+		if msg.From != "<cron@example.com>" {
+			t.Fatalf("Received FROM is not matching envelope: '%s'", msg.From)
+		}
+		if msg.To != "<user@example.com>, <other@example.com>" {
+			t.Fatalf("Received TO is not matching envelope: '%s'", msg.To)
+		}
+	}
+
+	expect(t, client, "QUIT", 221)
+}
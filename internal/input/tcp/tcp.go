@@ -2,40 +2,40 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 
 	"smtp2communicator/internal/common"
 	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
 )
 
 // processTCP handles messages incoming via TCP
 //
 // This function starts TCP listener and handles incoming traffic by starting
-// a new goroutine for each connection.
+// a new goroutine for each connection. If tlsConfig is given then STARTTLS
+// is offered to clients.
 //
 // Parameters:
 //
 // - ctx (context.Context): context
 // - msgChan (chan message): channel to pass received messages for sending
+// - host (string): address to listen on
 // - port (int): port number to listen on
+// - tlsConfig (*tls.Config): TLS configuration for STARTTLS or nil
+// - auth (*Authenticator): authenticator for SMTP AUTH or nil
 //
 // Returns:
 //
 // - n/a
-func ProcessTCP(ctx context.Context, msgChan chan<- common.Message, host string, port int) {
+func ProcessTCP(ctx context.Context, msgChan chan<- common.Message, host string, port int, tlsConfig *tls.Config, auth *Authenticator) {
 	log := logger.LoggerFromContext(ctx)
 
-	// determine hostname to be used
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = "hostname-not-available"
-		log.Errorf("Error, can't get hostname, using fake one: %s", hostname)
-	}
-
 	// Start the SMTP server on the specified port
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
 	if err != nil {
 		log.Fatalf("Error starting SMTP server: %v", err)
 	}
@@ -43,6 +43,49 @@ func ProcessTCP(ctx context.Context, msgChan chan<- common.Message, host string,
 
 	log.Infof("SMTP stub listening on port %d\n", port)
 
+	serve(log, listener, msgChan, tlsConfig, false, auth)
+}
+
+// ProcessTLS handles messages incoming via implicit TLS (SMTPS)
+//
+// This function starts TLS listener, every connection is TLS from the very
+// beginning, and handles it the same way ProcessTCP does.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - msgChan (chan message): channel to pass received messages for sending
+// - host (string): address to listen on
+// - port (int): port number to listen on
+// - tlsConfig (*tls.Config): TLS configuration
+// - auth (*Authenticator): authenticator for SMTP AUTH or nil
+//
+// Returns:
+//
+// - n/a
+func ProcessTLS(ctx context.Context, msgChan chan<- common.Message, host string, port int, tlsConfig *tls.Config, auth *Authenticator) {
+	log := logger.LoggerFromContext(ctx)
+
+	listener, err := tls.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)), tlsConfig)
+	if err != nil {
+		log.Fatalf("Error starting SMTPS server: %v", err)
+	}
+	defer listener.Close()
+
+	log.Infof("SMTPS stub listening on port %d\n", port)
+
+	serve(log, listener, msgChan, tlsConfig, true, auth)
+}
+
+// serve accepts connections and handles each in its own goroutine
+func serve(log *zap.SugaredLogger, listener net.Listener, msgChan chan<- common.Message, tlsConfig *tls.Config, implicitTLS bool, auth *Authenticator) {
+	// determine hostname to be used
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "hostname-not-available"
+		log.Errorf("Error, can't get hostname, using fake one: %s", hostname)
+	}
+
 	for {
 		// Accept incoming connections
 		conn, err := listener.Accept()
@@ -52,6 +95,6 @@ func ProcessTCP(ctx context.Context, msgChan chan<- common.Message, host string,
 		}
 
 		// Handle each incoming connection in a separate goroutine
-		go handleConnection(log, hostname, conn, msgChan)
+		go handleConnection(log, hostname, conn, msgChan, tlsConfig, implicitTLS, auth)
 	}
 }
@@ -28,13 +28,13 @@ func TestProcessTCP(t *testing.T) {
 	host := "127.0.0.1"
 	testPort := 12345
 
-	go ProcessTCP(ctx, msgChan, host, testPort)
+	go ProcessTCP(ctx, msgChan, host, testPort, nil, nil)
 
 	// Allow some time for the server to start
 	time.Sleep(100 * time.Millisecond)
 
 	// Create a test TCP connection to the server
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, testPort))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(testPort)))
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
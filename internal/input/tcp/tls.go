@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"smtp2communicator/internal/common"
+)
+
+// LoadTLSConfig creates TLS configuration for the listener
+//
+// This function loads certificate and key from files specified in the
+// configuration and sets minimum accepted TLS version.
+//
+// Parameters:
+//
+// - conf (common.TLSConfig): TLS section of the configuration
+//
+// Returns:
+//
+// - tlsConfig (*tls.Config): TLS configuration or nil if TLS is disabled
+// - err (error): error if any or nil
+func LoadTLSConfig(conf common.TLSConfig) (tlsConfig *tls.Config, err error) {
+	if len(conf.CertFile) == 0 {
+		if conf.ImplicitPort != 0 {
+			return nil, errors.New("implicitPort requires certFile and keyFile")
+		}
+		return nil, nil
+	}
+	if len(conf.KeyFile) == 0 {
+		return nil, errors.New("keyFile not set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate: %w", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	switch conf.MinVersion {
+	case "", "1.2":
+	case "1.0":
+		minVersion = tls.VersionTLS10
+	case "1.1":
+		minVersion = tls.VersionTLS11
+	case "1.3":
+		minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unknown TLS minVersion '%s'", conf.MinVersion)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+// selfSignedCertificate generates certificate and key files for 127.0.0.1
+func selfSignedCertificate(t *testing.T) (conf common.TLSConfig, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"test.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Can't create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Can't marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	conf.CertFile = filepath.Join(dir, "cert.pem")
+	conf.KeyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(conf.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return conf, pool
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	conf, _ := selfSignedCertificate(t)
+
+	tlsConfig, err := LoadTLSConfig(common.TLSConfig{})
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("Expected TLS to be disabled, got %v, %v", tlsConfig, err)
+	}
+
+	conf.MinVersion = "1.3"
+	tlsConfig, err = LoadTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't load TLS configuration: %v", err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Unexpected minimum TLS version: %x", tlsConfig.MinVersion)
+	}
+
+	conf.MinVersion = "2.0"
+	if _, err = LoadTLSConfig(conf); err == nil {
+		t.Fatalf("Expected error for unknown TLS version")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	conf, pool := selfSignedCertificate(t)
+	tlsConfig, err := LoadTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't load TLS configuration: %v", err)
+	}
+
+	client, clientConn, msgChan := startSession(t, tlsConfig, nil)
+
+	expect(t, client, "STARTTLS", 503)
+	if caps := expect(t, client, "EHLO client.example.com", 250); !strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("EHLO reply doesn't advertise STARTTLS: %s", caps)
+	}
+	expect(t, client, "STARTTLS", 220)
+
+	tlsConn := tls.Client(clientConn, &tls.Config{RootCAs: pool, ServerName: "test.example.com"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	client = textproto.NewConn(tlsConn)
+
+	// session starts from scratch after STARTTLS
+	expect(t, client, "MAIL FROM:<cron@example.com>", 503)
+	if caps := expect(t, client, "EHLO client.example.com", 250); strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("EHLO reply advertises STARTTLS over TLS: %s", caps)
+	}
+	expect(t, client, "STARTTLS", 503)
+	expect(t, client, "MAIL FROM:<cron@example.com>", 250)
+	expect(t, client, "RCPT TO:<user@example.com>", 250)
+	expect(t, client, "DATA", 354)
+	w := client.DotWriter()
+	w.Write([]byte("Subject: over tls\n\nbody\n"))
+	w.Close()
+	expect(t, client, "", 250)
+	expect(t, client, "QUIT", 221)
+
+	if msg := <-msgChan; msg.Subject != "over tls" {
+		t.Fatalf("Received SUBJECT is not matching expected one: '%s' != 'over tls'", msg.Subject)
+	}
+}
+
+func TestProcessTLSHandshakeTimeout(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	timeout := commandTimeout
+	commandTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { commandTimeout = timeout })
+
+	conf, _ := selfSignedCertificate(t)
+	tlsConfig, err := LoadTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't load TLS configuration: %v", err)
+	}
+
+	host := "127.0.0.1"
+	testPort := 12347
+	go ProcessTLS(ctx, make(chan common.Message, 10), host, testPort, tlsConfig, nil)
+
+	// Allow some time for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	// client connects and never starts the handshake
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(testPort)))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection closed by server, got %d bytes, %v", n, err)
+	}
+}
+
+func TestProcessTLS(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf, pool := selfSignedCertificate(t)
+	tlsConfig, err := LoadTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't load TLS configuration: %v", err)
+	}
+
+	host := "127.0.0.1"
+	testPort := 12346
+	go ProcessTLS(ctx, make(chan common.Message, 10), host, testPort, tlsConfig, nil)
+
+	// Allow some time for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(testPort)), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	client := textproto.NewConn(conn)
+	defer client.Close()
+
+	expect(t, client, "", 220)
+	if caps := expect(t, client, "EHLO client.example.com", 250); strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("EHLO reply advertises STARTTLS over TLS: %s", caps)
+	}
+	expect(t, client, "QUIT", 221)
+}
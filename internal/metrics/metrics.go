@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "smtp2communicator"
+
+// Inputs messages are received from
+const (
+	InputStdin = "stdin"
+	InputTCP   = "tcp"
+	InputAPI   = "api"
+	InputCLI   = "cli"
+)
+
+// Kinds of SMTP session errors
+const (
+	// SessionCommand is a command rejected as invalid or out of order
+	SessionCommand = "command"
+	// SessionRead is a failure to read from the client, e.g. timeout
+	SessionRead = "read"
+	// SessionTLS is a failed TLS handshake
+	SessionTLS = "tls"
+	// SessionAuth is a failed authentication
+	SessionAuth = "auth"
+	// SessionParse is a message which couldn't be parsed
+	SessionParse = "parse"
+	// SessionNotAccepted is a message the dispatcher didn't accept
+	SessionNotAccepted = "not_accepted"
+	// SessionTooManyErrors is a session closed after too many errors
+	SessionTooManyErrors = "too_many_errors"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	received = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received by input.",
+	}, []string{"input"})
+
+	deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_total",
+		Help:      "Messages delivered by channel.",
+	}, []string{"channel"})
+
+	failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_failures_total",
+		Help:      "Failed delivery attempts by channel.",
+	}, []string{"channel"})
+
+	chunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chunks_sent_total",
+		Help:      "Parts of messages sent by channel, long messages are sent in several parts.",
+	}, []string{"channel"})
+
+	duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Time taken by delivery attempts by channel.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"channel"})
+
+	sessionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "smtp_session_errors_total",
+		Help:      "Errors in SMTP sessions by kind.",
+	}, []string{"kind"})
+)
+
+func init() {
+	registry.MustRegister(
+		received, deliveries, failures, chunks, duration, sessionErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns HTTP handler serving all metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Received counts a message received by an input
+func Received(input string) {
+	received.WithLabelValues(input).Inc()
+}
+
+// Delivered counts a successful delivery attempt and its duration
+func Delivered(channel string, took time.Duration) {
+	deliveries.WithLabelValues(channel).Inc()
+	duration.WithLabelValues(channel).Observe(took.Seconds())
+}
+
+// Failed counts a failed delivery attempt and its duration
+func Failed(channel string, took time.Duration) {
+	failures.WithLabelValues(channel).Inc()
+	duration.WithLabelValues(channel).Observe(took.Seconds())
+}
+
+// ChunkSent counts a part of a message sent by a channel
+func ChunkSent(channel string) {
+	chunks.WithLabelValues(channel).Inc()
+}
+
+// SessionError counts an error in SMTP session
+func SessionError(kind string) {
+	sessionErrors.WithLabelValues(kind).Inc()
+}
+
+// RegisterQueueDepth exposes number of messages waiting for delivery
+//
+// Parameters:
+//
+// - depth (func() int): function returning number of waiting messages
+//
+// Returns:
+//
+// - err (error): error if queue depth is already registered
+func RegisterQueueDepth(depth func() int) error {
+	return registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Messages waiting for delivery, received but not yet dispatched or kept in spool.",
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	Received(InputTCP)
+	Received(InputTCP)
+	Received(InputStdin)
+	Delivered("telegram", 300*time.Millisecond)
+	Failed("slack", 2*time.Second)
+	ChunkSent("telegram")
+	ChunkSent("telegram")
+	SessionError(SessionAuth)
+	if err := RegisterQueueDepth(func() int { return 7 }); err != nil {
+		t.Fatalf("Can't register queue depth: %v", err)
+	}
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Can't get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	body := string(data)
+
+	expected := []string{
+		`smtp2communicator_messages_received_total{input="tcp"} 2`,
+		`smtp2communicator_messages_received_total{input="stdin"} 1`,
+		`smtp2communicator_deliveries_total{channel="telegram"} 1`,
+		`smtp2communicator_delivery_failures_total{channel="slack"} 1`,
+		`smtp2communicator_chunks_sent_total{channel="telegram"} 2`,
+		`smtp2communicator_delivery_duration_seconds_bucket{channel="telegram",le="0.5"} 1`,
+		`smtp2communicator_delivery_duration_seconds_bucket{channel="slack",le="1"} 0`,
+		`smtp2communicator_delivery_duration_seconds_count{channel="slack"} 1`,
+		`smtp2communicator_smtp_session_errors_total{kind="auth"} 1`,
+		`smtp2communicator_queue_depth 7`,
+		`go_goroutines `,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metric %q not found", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("Metrics:\n%s", body)
+	}
+}
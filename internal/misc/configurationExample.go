@@ -2,43 +2,114 @@ package misc
 
 import (
 	"fmt"
+	"time"
 
 	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
 
 	"gopkg.in/yaml.v3"
 )
 
 // ConfigurationExample prints to stdout an example confiuration
+//
+// The 'channels' section contains example of every registered output channel.
 func ConfigurationExample() {
-	config := c.Configuration{
+	yConfig, err := yaml.Marshal(exampleConfiguration())
+	if err != nil {
+		fmt.Print("can't print example")
+	}
+
+	fmt.Println(string(yConfig))
+}
+
+// exampleConfiguration returns the example configuration
+func exampleConfiguration() (config c.Configuration) {
+	config = c.Configuration{
 		Host: "127.0.0.1",
 		Port: 25,
-		Channels: c.Channels{
-			File: c.FileChannel{
-				Enabled: true,
-				DirPath: "/path/to/files",
+		TLS: c.TLSConfig{
+			CertFile:     "/path/to/cert.pem",
+			KeyFile:      "/path/to/key.pem",
+			MinVersion:   "1.2",
+			ImplicitPort: 465,
+		},
+		Auth: c.AuthConfig{
+			CredentialsFile: "/etc/smtp2communicator.users",
+			Required:        true,
+		},
+		HTTP: c.HTTPConfig{
+			Listen:   "127.0.0.1:9465",
+			MaxQueue: 100,
+			API: c.APIConfig{
+				Tokens:      []string{"long-random-token"},
+				MaxBodySize: 1 << 20,
+				Timeout:     time.Minute,
 			},
-			Telegram: c.TelegramChannel{
-				Enabled: true,
-				UserId:  123456789,
-				BotKey:  "your_telegram_bot_api_key",
+		},
+		Spool: c.SpoolConfig{
+			DirPath:  "/var/spool/smtp2communicator",
+			RetryMin: 30 * time.Second,
+			RetryMax: time.Hour,
+			MaxAge:   5 * 24 * time.Hour,
+		},
+		Dedup: c.DedupConfig{
+			StatePath: "/var/lib/smtp2communicator/dedup.json",
+			Window:    time.Hour,
+			Fields:    []string{"subject", "body", "from"},
+		},
+		Digest: c.DigestConfig{
+			DirPath: "/var/spool/smtp2communicator/digests",
+		},
+		Channels: c.Channels{},
+		Routes: []c.Route{
+			{
+				Name:     "backups",
+				Match:    c.Match{From: "*@backup.example.com"},
+				Channels: []string{"file"},
+				Stop:     true,
 			},
-			Slack: c.SlackChannel{
-				Enabled: false,
+			{
+				Name:     "logwatch",
+				Match:    c.Match{Subject: "Logwatch for *"},
+				Channels: []string{"telegram"},
+				Digest:   &c.RouteDigest{Schedule: "0 7 * * *", Attach: true},
+				Stop:     true,
 			},
-			Teams: c.TeamsChannel{
-				Enabled: false,
+			{
+				Name:     "security",
+				Match:    c.Match{Subject: "re:(?i)intrusion|failed login"},
+				Channels: []string{"telegram", "slack"},
+				Urgent:   true,
+			},
+		},
+		DefaultRoute: []string{"telegram"},
+		QuietHours: []c.QuietHours{
+			{
+				Name:     "night",
+				Channels: []string{"telegram"},
+				From:     "22:00",
+				To:       "07:00",
+				TimeZone: "Europe/Warsaw",
+				Action:   "defer",
 			},
-			Whatsup: c.WhatsupChannel{
-				Enabled: false,
+			{
+				Name:     "weekend",
+				Channels: []string{"telegram"},
+				Days:     []string{"sat", "sun"},
+				From:     "00:00",
+				To:       "00:00",
+				Action:   "silent",
 			},
 		},
 	}
 
-	yConfig, err := yaml.Marshal(config)
-	if err != nil {
-		fmt.Print("can't print example")
+	for name, example := range output.Examples() {
+		node := yaml.Node{}
+		if err := node.Encode(example); err != nil {
+			fmt.Printf("can't print example of %s channel", name)
+			continue
+		}
+		config.Channels[name] = node
 	}
-
-	fmt.Println(string(yConfig))
+	return config
 }
@@ -0,0 +1,58 @@
+package misc
+
+import (
+	"context"
+	"testing"
+
+	c "smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
+	_ "smtp2communicator/internal/output/file"
+	_ "smtp2communicator/internal/output/slack"
+	_ "smtp2communicator/internal/output/teams"
+	_ "smtp2communicator/internal/output/telegram"
+	_ "smtp2communicator/internal/output/whatsapp"
+	"smtp2communicator/internal/quiet"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExampleQuietHours(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	data, err := yaml.Marshal(exampleConfiguration())
+	if err != nil {
+		t.Fatalf("Can't marshal example: %v", err)
+	}
+	var conf c.Configuration
+	if err = yaml.Unmarshal(data, &conf); err != nil {
+		t.Fatalf("Can't load example: %v", err)
+	}
+
+	// every channel of the example enabled
+	var channels []output.Channel
+	var names []string
+	for channelType, node := range conf.Channels {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "enabled" {
+				node.Content[i+1].Value = "true"
+			}
+		}
+		channel, err := output.New(channelType, channelType, &node)
+		if err != nil {
+			t.Fatalf("Can't create %s channel: %v", channelType, err)
+		}
+		channels = append(channels, channel)
+		names = append(names, channelType)
+	}
+	if len(channels) != 5 {
+		t.Fatalf("Expected example of 5 channels, got %d", len(channels))
+	}
+
+	if _, err = quiet.New(ctx, conf.QuietHours, names, output.SilentChannels(channels)); err != nil {
+		t.Fatalf("Quiet hours of the example rejected: %v", err)
+	}
+}
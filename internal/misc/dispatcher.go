@@ -2,41 +2,402 @@ package misc
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 
 	"smtp2communicator/internal/common"
-	"smtp2communicator/internal/output/file"
-	"smtp2communicator/internal/output/slack"
-	"smtp2communicator/internal/output/telegram"
+	"smtp2communicator/internal/dedup"
+	"smtp2communicator/internal/digest"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/internal/quiet"
+	"smtp2communicator/internal/routing"
+	"smtp2communicator/internal/spool"
 	"smtp2communicator/pkg/logger"
 )
 
 // dispatcher is a siple function that calls channels passing them received
 // message for sending to its destination
 //
+// Router decides which of the channels each message is sent to.
+//
+// If spool is given then every message is stored in it before being accepted
+// and deliveries that failed are retried until they succeed or the message
+// expires. Without spool every message is sent only once.
+//
+// If dedup is given then repeats of a message are suppressed and summarised
+// once their window closes.
+//
+// If digests are given then messages of routes with digest are collected
+// and sent combined when their digest is due, otherwise such messages are
+// sent right away.
+//
+// Quiet hours of a channel defer, silence or drop deliveries to it, unless
+// the message is urgent. Deferring needs spool, without it deferred messages
+// are delivered silently.
+//
+// Messages with channels set are sent to these channels only, routes and
+// digests are not applied to them. Inputs waiting for the outcome of
+// delivery are told it once the first attempt to deliver is over.
+//
 // Parameters:
 //
 // - ctx (context.Context): context
-// - dstChanConf (common.Channels): configuration for all channels as specified in configuration yaml
+// - channels ([]output.Channel): initialised channels to send messages to
+// - router (*routing.Router): router selecting channels for a message
+// - sp (*spool.Spool): spool to store messages in or nil
+// - dd (*dedup.Dedup): dedup suppressing repeated messages or nil
+// - dg (*digest.Digests): digests collecting messages of routes or nil
+// - qh (*quiet.QuietHours): quiet hours of channels or nil
 // - msgChan (<-chan message): message struct channel
 // - wg (sync.WaitGroup): channel to pass received messages to
 //
 // Returns:
 //
 // - n/a
-func Dispatcher(ctx context.Context, dstChanConf common.Channels, msgChan <-chan common.Message, wg *sync.WaitGroup) {
+func Dispatcher(ctx context.Context, channels []output.Channel, router *routing.Router, sp *spool.Spool, dd *dedup.Dedup, dg *digest.Digests, qh *quiet.QuietHours, msgChan <-chan common.Message, wg *sync.WaitGroup) {
 	log := logger.LoggerFromContext(ctx)
 
 	log.Info("dispatcher started")
-	for incomingMsg := range msgChan {
-		log.Debugf("got message with subject: %s", incomingMsg.Subject)
-		telegram.SendTelegramMsg(log, dstChanConf.Telegram, incomingMsg)
-		slack.SendSlackMsg(log, dstChanConf.Slack, incomingMsg)
-		file.SaveEmailToFile(log, dstChanConf.File, incomingMsg)
+
+	// retries are checked only if there is a spool, nil channel blocks forever
+	var retry <-chan time.Time
+	if sp != nil {
+		retryDue(ctx, channels, sp, qh)
+		ticker := time.NewTicker(sp.RetryInterval())
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+
+	// summaries of repeated messages are sent when their windows close, also
+	// those which closed while nothing was running
+	var summarise <-chan time.Time
+	if dd != nil {
+		sendSummaries(ctx, channels, sp, qh, dd)
+		ticker := time.NewTicker(dd.CheckInterval())
+		defer ticker.Stop()
+		summarise = ticker.C
+	}
+
+	// digests are checked also on start as they may have become due while
+	// nothing was running
+	var digests <-chan time.Time
+	if dg != nil {
+		sendDigests(ctx, channels, router, sp, qh, dg)
+		ticker := time.NewTicker(dg.CheckInterval())
+		defer ticker.Stop()
+		digests = ticker.C
+	}
+
+	for {
+		select {
+		case incomingMsg, ok := <-msgChan:
+			if !ok {
+				log.Debug("Channel with incoming messages closed")
+				closeChannels(ctx, channels)
+
+				// indicate we're done here so no need to wait any more;
+				// this will be executed only when msg channel is closed
+				wg.Done()
+				return
+			}
+			log.Debugf("got message with subject: %s", incomingMsg.Subject)
+			dispatch(ctx, channels, router, sp, dd, dg, qh, incomingMsg)
+		case <-retry:
+			retryDue(ctx, channels, sp, qh)
+		case <-summarise:
+			sendSummaries(ctx, channels, sp, qh, dd)
+		case <-digests:
+			sendDigests(ctx, channels, router, sp, qh, dg)
+		}
+	}
+}
+
+// dispatch routes a new message, collects it into digests and sends it to
+// its channels unless it's a repeat to be suppressed
+func dispatch(ctx context.Context, channels []output.Channel, router *routing.Router, sp *spool.Spool, dd *dedup.Dedup, dg *digest.Digests, qh *quiet.QuietHours, msg common.Message) {
+	log := logger.LoggerFromContext(ctx)
+
+	accepted, delivered := msg.Accepted, msg.Delivered
+	msg.Accepted, msg.Delivered = nil, nil
+	msg.Urgent = router.Urgent(msg)
+
+	result := &common.Delivery{}
+	defer reportDelivery(delivered, result)
+
+	names := msg.Channels
+	if len(names) == 0 {
+		names = router.Route(msg)
+		for _, name := range router.Digests(msg) {
+			if dg != nil {
+				err := dg.Add(name, msg, time.Now())
+				if err == nil {
+					log.Debugf("message '%s' collected into digest %s", msg.Subject, name)
+					result.Digests = append(result.Digests, name)
+					continue
+				}
+				log.Errorf("can't collect message into digest %s, sending it right away: %v", name, err)
+			}
+			names = append(names, router.DigestChannels(name)...)
+		}
+	}
+	msg.Channels = nil
+
+	channels = selectChannels(channels, names)
+	if len(channels) == 0 {
+		if len(result.Digests) == 0 {
+			log.Infof("no channel to send message '%s' to, dropping it", msg.Subject)
+		}
+		acknowledge(accepted, nil)
+		return
+	}
+
+	if dd != nil {
+		suppress, err := dd.Check(msg, channelNames(channels), time.Now())
+		if err != nil {
+			log.Errorf("can't check if message is repeated, sending it: %v", err)
+		} else if suppress {
+			log.Infof("message '%s' repeated, suppressing it", msg.Subject)
+			result.Suppressed = true
+			acknowledge(accepted, nil)
+			return
+		}
+	}
+
+	send(ctx, channels, sp, qh, msg, accepted, result)
+}
+
+// send stores a message in the spool and sends it to given channels
+//
+// The input waiting on accepted is told the result of storing the message.
+// Outcome of delivery to every channel is recorded in result unless it's
+// nil.
+func send(ctx context.Context, channels []output.Channel, sp *spool.Spool, qh *quiet.QuietHours, msg common.Message, accepted chan<- error, result *common.Delivery) {
+	log := logger.LoggerFromContext(ctx)
+
+	if sp == nil {
+		acknowledge(accepted, nil)
+		sendOnce(ctx, channels, qh, msg, result)
+		return
+	}
+
+	entry, err := sp.Add(msg, channelNames(channels))
+	if err != nil {
+		log.Errorf("can't store message in spool: %v", err)
+		if accepted != nil {
+			// sender has been told to try again later
+			acknowledge(accepted, err)
+			return
+		}
+		// nobody to tell about the failure, try our best
+		sendOnce(ctx, channels, qh, msg, result)
+		return
+	}
+	acknowledge(accepted, nil)
+
+	deliver(ctx, channels, sp, qh, entry, result)
+}
+
+// sendOnce sends a message to given channels without retrying failures
+//
+// As there is no spool to keep deferred messages in they are sent silently.
+func sendOnce(ctx context.Context, channels []output.Channel, qh *quiet.QuietHours, msg common.Message, result *common.Delivery) {
+	log := logger.LoggerFromContext(ctx)
+
+	for _, channel := range channels {
+		msg := msg
+		switch action, _ := qh.Check(channel.Name(), msg, time.Now()); action {
+		case quiet.Drop:
+			log.Infof("quiet hours of %s, dropping message '%s'", channel.Name(), msg.Subject)
+			result.Record(channel.Name(), common.ChannelDelivery{State: common.DeliveryDropped})
+			continue
+		case quiet.Defer, quiet.Silent:
+			msg.Silent = true
+		}
+
+		if err := sendVia(ctx, channel, msg); err != nil {
+			log.Errorf("can't send message via %s: %v", channel.Name(), err)
+			result.Record(channel.Name(), common.ChannelDelivery{State: common.DeliveryFailed, Error: err.Error()})
+			continue
+		}
+		result.Record(channel.Name(), common.ChannelDelivery{State: common.DeliveryDelivered})
+	}
+}
+
+// sendVia sends a message via a channel recording metrics of the delivery
+func sendVia(ctx context.Context, channel output.Channel, msg common.Message) (err error) {
+	start := time.Now()
+	if err = channel.Send(ctx, msg); err != nil {
+		metrics.Failed(channel.Name(), time.Since(start))
+		return err
+	}
+	metrics.Delivered(channel.Name(), time.Since(start))
+	return nil
+}
+
+// sendSummaries sends summaries of repeated messages whose windows closed
+func sendSummaries(ctx context.Context, channels []output.Channel, sp *spool.Spool, qh *quiet.QuietHours, dd *dedup.Dedup) {
+	log := logger.LoggerFromContext(ctx)
+
+	summaries, err := dd.Closed(time.Now())
+	if err != nil {
+		log.Errorf("can't read repeated messages: %v", err)
+		return
+	}
+	for _, summary := range summaries {
+		selected := selectChannels(channels, summary.Channels)
+		if len(selected) == 0 {
+			log.Infof("no channel to send summary '%s' to, dropping it", summary.Message.Subject)
+			continue
+		}
+		send(ctx, selected, sp, qh, summary.Message, nil, nil)
+	}
+}
+
+// sendDigests sends digests which are due
+func sendDigests(ctx context.Context, channels []output.Channel, router *routing.Router, sp *spool.Spool, qh *quiet.QuietHours, dg *digest.Digests) {
+	log := logger.LoggerFromContext(ctx)
+
+	batches, err := dg.Due(time.Now())
+	if err != nil {
+		log.Errorf("can't read digests: %v", err)
+	}
+	for _, batch := range batches {
+		selected := selectChannels(channels, router.DigestChannels(batch.Name))
+		if len(selected) == 0 {
+			log.Infof("no channel to send digest %s to, dropping it", batch.Name)
+			continue
+		}
+		log.Infof("sending digest %s", batch.Name)
+		send(ctx, selected, sp, qh, batch.Message, nil, nil)
+	}
+}
+
+// channelNames returns names of channels
+func channelNames(channels []output.Channel) []string {
+	names := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		names = append(names, channel.Name())
+	}
+	return names
+}
+
+// selectChannels returns channels with given names
+func selectChannels(channels []output.Channel, names []string) (selected []output.Channel) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, channel := range channels {
+		if wanted[channel.Name()] {
+			selected = append(selected, channel)
+		}
+	}
+	return
+}
+
+// retryDue attempts again all deliveries from spool that are due
+func retryDue(ctx context.Context, channels []output.Channel, sp *spool.Spool, qh *quiet.QuietHours) {
+	log := logger.LoggerFromContext(ctx)
+
+	entries, err := sp.Due(time.Now())
+	if err != nil {
+		log.Errorf("can't read spool: %v", err)
+		return
 	}
-	log.Debug("Channel with incoming messages closed")
+	for _, entry := range entries {
+		log.Debugf("retrying delivery of message %s", entry.Id)
+		deliver(ctx, channels, sp, qh, entry, nil)
+	}
+}
+
+// deliver sends spooled message to all channels it's due for and saves result
+//
+// Outcome of delivery to every channel is recorded in result unless it's nil.
+func deliver(ctx context.Context, channels []output.Channel, sp *spool.Spool, qh *quiet.QuietHours, entry *spool.Entry, result *common.Delivery) {
+	log := logger.LoggerFromContext(ctx)
+
+	byName := make(map[string]output.Channel, len(channels))
+	for _, channel := range channels {
+		byName[channel.Name()] = channel
+	}
+
+	now := time.Now()
+	for _, name := range entry.Pending(now) {
+		channel, ok := byName[name]
+		if !ok {
+			log.Warnf("channel %s is no longer enabled, dropping delivery of message %s", name, entry.Id)
+			sp.Delivered(entry, name)
+			continue
+		}
+
+		msg := entry.Message
+		switch action, until := qh.Check(name, msg, now); action {
+		case quiet.Drop:
+			log.Infof("quiet hours of %s, dropping message %s", name, entry.Id)
+			sp.Delivered(entry, name)
+			result.Record(name, common.ChannelDelivery{State: common.DeliveryDropped})
+			continue
+		case quiet.Defer:
+			log.Infof("quiet hours of %s, deferring message %s until %s", name, entry.Id, until.Format(time.RFC1123Z))
+			sp.Deferred(entry, name, until)
+			result.Record(name, common.ChannelDelivery{State: common.DeliveryDeferred, Until: &until})
+			continue
+		case quiet.Silent:
+			msg.Silent = true
+		}
+		msg.DeliveredTo = entry.Recipients(name)
 
-	// indicate we're done here so no need to wait any more;
-	// this will be executed only when msg channel is closed
-	wg.Done()
+		if err := sendVia(ctx, channel, msg); err != nil {
+			log.Errorf("can't send message %s via %s: %v", entry.Id, name, err)
+			var partial *output.RecipientsError
+			if errors.As(err, &partial) {
+				sp.Reached(entry, name, partial.Delivered)
+			}
+			sp.Failed(entry, name, err)
+			result.Record(name, common.ChannelDelivery{State: common.DeliveryFailed, Error: err.Error()})
+			continue
+		}
+		sp.Delivered(entry, name)
+		result.Record(name, common.ChannelDelivery{State: common.DeliveryDelivered})
+	}
+
+	if err := sp.Update(entry); err != nil {
+		if errors.Is(err, spool.ErrExpired) {
+			log.Errorf("message %s not delivered via %v: %v", entry.Id, entry.Undelivered(), err)
+			return
+		}
+		log.Errorf("can't update spool: %v", err)
+	}
+}
+
+// acknowledge passes result of accepting a message to its input if it waits for it
+func acknowledge(accepted chan<- error, err error) {
+	if accepted == nil {
+		return
+	}
+	accepted <- err
+	close(accepted)
+}
+
+// reportDelivery passes outcome of delivery of a message to its input if it
+// waits for it
+func reportDelivery(delivered chan<- common.Delivery, result *common.Delivery) {
+	if delivered == nil {
+		return
+	}
+	delivered <- *result
+	close(delivered)
+}
+
+// closeChannels releases resources held by channels
+func closeChannels(ctx context.Context, channels []output.Channel) {
+	log := logger.LoggerFromContext(ctx)
+
+	for _, channel := range channels {
+		if err := channel.Close(); err != nil {
+			log.Errorf("can't close %s channel: %v", channel.Name(), err)
+		}
+	}
 }
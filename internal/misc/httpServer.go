@@ -0,0 +1,56 @@
+package misc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+)
+
+// readHeaderTimeout limits time a client may take to send request headers
+const readHeaderTimeout = 10 * time.Second
+
+// HTTPServer starts HTTP listener serving given handler
+//
+// The listener is opened before returning so that errors like address
+// already in use are reported, requests are served in the background until
+// the context is done.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - conf (common.HTTPConfig): HTTP listener configuration
+// - handler (http.Handler): handler of all requests
+//
+// Returns:
+//
+// - err (error): error if any or nil
+func HTTPServer(ctx context.Context, conf common.HTTPConfig, handler http.Handler) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP listener stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Infof("HTTP listener started on %s", listener.Addr())
+	return nil
+}
@@ -0,0 +1,93 @@
+package output
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"smtp2communicator/internal/common"
+)
+
+// AttachmentsConfig is configuration of attachments forwarding shared by
+// channels able to upload files
+//
+// MaxSize limits size of a single attachment in bytes, 0 means the limit of
+// the channel. Skip is a list of glob patterns (e.g. "*.exe", "image/*")
+// matched case-insensitively against the file name and content type, matching
+// attachments are not sent. Inline files (e.g. images embedded in HTML body)
+// are sent only if Inline is set.
+type AttachmentsConfig struct {
+	Enabled bool
+	MaxSize int      `yaml:"maxSize,omitempty"`
+	Skip    []string `yaml:"skip,omitempty"`
+	Inline  bool     `yaml:"inline,omitempty"`
+}
+
+// Validate checks that the skip patterns are valid
+func (a AttachmentsConfig) Validate() error {
+	if a.MaxSize < 0 {
+		return fmt.Errorf("attachments maxSize can't be negative")
+	}
+	for _, pattern := range a.Skip {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid attachments skip pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Filter selects attachments to be sent
+//
+// Parameters:
+//
+// - attachments ([]common.Attachment): attachments of the message
+// - limit (int): maximum size of an attachment the channel accepts
+//
+// Returns:
+//
+// - send ([]common.Attachment): attachments to be sent
+// - skipped ([]string): descriptions of attachments not sent and why
+func (a AttachmentsConfig) Filter(attachments []common.Attachment, limit int) (send []common.Attachment, skipped []string) {
+	if !a.Enabled {
+		return nil, nil
+	}
+
+	maxSize := limit
+	if a.MaxSize > 0 && a.MaxSize < limit {
+		maxSize = a.MaxSize
+	}
+
+	for _, attachment := range attachments {
+		switch {
+		case attachment.Inline && !a.Inline:
+			continue
+		case a.skip(attachment):
+			skipped = append(skipped, fmt.Sprintf("%s (excluded)", attachment.Filename))
+		case len(attachment.Data) > maxSize:
+			skipped = append(skipped, fmt.Sprintf("%s (%d bytes, over %d bytes limit)", attachment.Filename, len(attachment.Data), maxSize))
+		default:
+			send = append(send, attachment)
+		}
+	}
+	return send, skipped
+}
+
+// skip tells if attachment matches any of the skip patterns
+func (a AttachmentsConfig) skip(attachment common.Attachment) bool {
+	filename := strings.ToLower(attachment.Filename)
+	contentType := strings.ToLower(attachment.ContentType)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+
+	for _, pattern := range a.Skip {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, filename); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+	return false
+}
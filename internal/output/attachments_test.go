@@ -0,0 +1,51 @@
+package output
+
+import (
+	"reflect"
+	"testing"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestAttachmentsFilter(t *testing.T) {
+	attachments := []common.Attachment{
+		{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n1,2\n")},
+		{Filename: "setup.EXE", ContentType: "application/octet-stream", Data: []byte("MZ")},
+		{Filename: "big.log", ContentType: "text/plain", Data: make([]byte, 100)},
+		{Filename: "logo", ContentType: "image/png", Inline: true, Data: []byte("png")},
+		{Filename: "photo.png", ContentType: "image/png; name=photo.png", Data: []byte("png")},
+	}
+
+	conf := AttachmentsConfig{Enabled: true, MaxSize: 50, Skip: []string{"*.exe", "image/*"}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Valid configuration rejected: %v", err)
+	}
+
+	send, skipped := conf.Filter(attachments, 1000)
+	names := []string{}
+	for _, attachment := range send {
+		names = append(names, attachment.Filename)
+	}
+	if !reflect.DeepEqual(names, []string{"report.csv"}) {
+		t.Errorf("Unexpected attachments to send: %v", names)
+	}
+	if len(skipped) != 3 {
+		t.Errorf("Expected 3 skipped attachments, got %v", skipped)
+	}
+
+	// channel limit applies when lower than configured one
+	conf = AttachmentsConfig{Enabled: true, MaxSize: 1000, Inline: true}
+	send, skipped = conf.Filter(attachments, 10)
+	if len(send) != 4 || len(skipped) != 1 {
+		t.Errorf("Expected 4 attachments to send and 1 skipped, got %d and %v", len(send), skipped)
+	}
+
+	send, skipped = AttachmentsConfig{}.Filter(attachments, 1000)
+	if send != nil || skipped != nil {
+		t.Errorf("Disabled attachments returned %v, %v", send, skipped)
+	}
+
+	if err := (AttachmentsConfig{Skip: []string{"[a-"}}).Validate(); err == nil {
+		t.Errorf("Invalid pattern accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -11,8 +12,61 @@ import (
 	"gopkg.in/yaml.v3"
 
 	i "smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
 )
 
+// Config is File specific configuration
+type Config struct {
+	Enabled bool
+	DirPath string `yaml:"dirPath"`
+}
+
+// File is the output channel saving messages to a directory
+type File struct {
+	name string
+	conf Config
+}
+
+func init() {
+	output.Register("file", New, Config{
+		Enabled: true,
+		DirPath: "/path/to/files",
+	})
+}
+
+// New creates File channel from its configuration
+func New(name string, conf *yaml.Node) (output.Channel, error) {
+	f := &File{name: name}
+	if err := conf.Decode(&f.conf); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Name returns name of the channel
+func (f *File) Name() string {
+	return f.name
+}
+
+// Init validates configuration and creates the target directory
+func (f *File) Init(ctx context.Context) error {
+	if len(f.conf.DirPath) == 0 {
+		return errors.New("dirPath not set")
+	}
+	return createDirectory(logger.LoggerFromContext(ctx), f.conf.DirPath)
+}
+
+// SendsSilently tells that silent messages are fine, files notify nobody
+func (f *File) SendsSilently() bool {
+	return true
+}
+
+// Close does nothing, there is nothing to release
+func (f *File) Close() error {
+	return nil
+}
+
 // createDirectory create a directory if it doesn't exist
 //
 // This function checks if a directory exists and creates it if not.
@@ -34,32 +88,27 @@ func createDirectory(log *zap.SugaredLogger, path string) error {
 	return nil
 }
 
-// saveEmailToFile saves email to YAML file
+// Send saves email to YAML file
 //
 // This function saves each email to separate file in YAML format.
 // This is fulfiling the File channel configuration
 //
 // Parameters:
 //
-// - conf (FileChannel): configuration specific to the File channel
+// - ctx (context.Context): context
 // - msg (message): struct representing received email
 //
 // Returns:
 // - err (error): error if any or nil
-func SaveEmailToFile(log *zap.SugaredLogger, conf i.FileChannel, msg i.Message) error {
-	if !conf.Enabled {
-		log.Debug("File channel disabled, returning")
-		return nil
-	}
-
-	createDirectory(log, conf.DirPath)
+func (f *File) Send(ctx context.Context, msg i.Message) error {
+	log := logger.LoggerFromContext(ctx)
 
 	// Create a unique filename based on the current timestamp
-	filename := fmt.Sprintf("%s/received_email_%d.yaml", conf.DirPath, time.Now().Unix())
+	filename := fmt.Sprintf("%s/received_email_%d.yaml", f.conf.DirPath, time.Now().Unix())
 
 	msgMarshalled, err := yaml.Marshal(msg)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if err := os.WriteFile(filename, msgMarshalled, 0o644); err != nil {
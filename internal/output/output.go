@@ -0,0 +1,333 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Channel is a single destination messages are delivered to
+//
+// Every output (Telegram, Slack, file, ...) implements this interface and
+// registers itself with Register so that it can be created from the
+// configuration file by the name of its section under 'channels'.
+type Channel interface {
+	// Name returns name of the channel as used in logs and configuration
+	Name() string
+	// Init validates configuration and prepares channel for sending
+	Init(ctx context.Context) error
+	// Send delivers a message to its destination
+	Send(ctx context.Context, msg common.Message) error
+	// Close releases any resources held by the channel
+	Close() error
+}
+
+// RecipientsError is returned by Send of channels delivering a message to
+// several recipients when it reached some of them only
+//
+// Recipients it was delivered to are remembered with the failed delivery
+// and passed in common.Message DeliveredTo when it's retried.
+type RecipientsError struct {
+	// Delivered are recipients the message was delivered to
+	Delivered []string
+	// Err is error of delivery to the other recipients
+	Err error
+}
+
+func (e *RecipientsError) Error() string {
+	return fmt.Sprintf("delivered to %s only: %v", strings.Join(e.Delivered, ", "), e.Err)
+}
+
+func (e *RecipientsError) Unwrap() error {
+	return e.Err
+}
+
+// SilentSender is implemented by channels able to deliver a message without
+// notification when its Silent is set, other channels ignore it
+type SilentSender interface {
+	// SendsSilently tells if the channel honours Silent
+	SendsSilently() bool
+}
+
+// Validator is implemented by channels able to check their credentials
+// against the service they deliver to, e.g. that a bot token is valid
+//
+// Init only checks the configuration, it doesn't need the service to be
+// reachable, so the check is done separately by Validate.
+type Validator interface {
+	// Validate checks the credentials with the service
+	Validate(ctx context.Context) error
+}
+
+// validateTimeout limits time taken to validate credentials of a channel
+const validateTimeout = 10 * time.Second
+
+// Factory creates a new, not yet initialised, channel from its configuration
+//
+// The name is the name of this particular instance of the channel type, it's
+// what the channel's Name must return.
+type Factory func(name string, conf *yaml.Node) (Channel, error)
+
+type definition struct {
+	factory Factory
+	example any
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]definition{}
+)
+
+// Register makes a channel type available under given name
+//
+// This function is meant to be called from init() of a package implementing
+// a channel. The name is the key used for the channel in the configuration
+// file 'channels' section. Registering the same name twice panics.
+//
+// Parameters:
+//
+// - name (string): name of the channel type, e.g. "telegram"
+// - factory (Factory): function creating the channel from its configuration
+// - example (any): example configuration printed by -configurationExample
+//
+// Returns:
+//
+// - n/a
+func Register(name string, factory Factory, example any) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("output: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("output: Register called twice for " + name)
+	}
+	registry[name] = definition{factory: factory, example: example}
+}
+
+// Registered returns sorted names of all registered channel types
+func Registered() (names []string) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Examples returns example configuration of all registered channel types
+//
+// Returns:
+//
+// - examples (map[string]any): example configuration keyed by channel type name
+func Examples() (examples map[string]any) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	examples = map[string]any{}
+	for name, def := range registry {
+		examples[name] = def.example
+	}
+	return
+}
+
+// New creates a channel of registered type from its configuration
+//
+// Parameters:
+//
+// - channelType (string): name of the channel type
+// - name (string): name of the channel instance
+// - conf (*yaml.Node): channel configuration as found in configuration file
+//
+// Returns:
+//
+// - channel (Channel): a new channel
+// - err (error): error if any or nil
+func New(channelType, name string, conf *yaml.Node) (channel Channel, err error) {
+	registryMu.RLock()
+	def, ok := registry[channelType]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown channel type '%s'", channelType)
+	}
+
+	return def.factory(name, conf)
+}
+
+// instance is configuration of a single channel instance
+type instance struct {
+	channelType string
+	name        string
+	node        *yaml.Node
+}
+
+// instances returns configuration of all channel instances of given type
+//
+// Channel type section is either a single channel configuration, in which
+// case the instance is named after the type, or a list of configurations
+// each having unique 'name'.
+func instances(channelType string, node *yaml.Node) (result []instance, err error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return []instance{{channelType: channelType, name: channelType, node: node}}, nil
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			named := struct {
+				Name string
+			}{}
+			if err = item.Decode(&named); err != nil {
+				return nil, err
+			}
+			if len(named.Name) == 0 {
+				return nil, fmt.Errorf("%s channel %d has no name", channelType, i+1)
+			}
+			result = append(result, instance{channelType: channelType, name: named.Name, node: item})
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("%s channels must be a single configuration or a list of them", channelType)
+}
+
+// FromConfiguration creates and initialises all enabled channels
+//
+// This function goes through the 'channels' section of the configuration,
+// skips all channels that are not enabled and creates and initialises the
+// rest. Channels that fail to initialise, or whose configuration can't be
+// read or reuses a name, are logged and left out so that one misconfigured
+// channel doesn't prevent delivery to the others.
+//
+// Every channel type can have several named instances, see instances. Names
+// must be unique across all channel types as they are used in routes.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - conf (common.Channels): channels section of the configuration
+//
+// Returns:
+//
+// - channels ([]Channel): initialised channels ready for sending
+// - failed (map[string]error): errors of enabled channels left out keyed by channel name
+func FromConfiguration(ctx context.Context, conf common.Channels) (channels []Channel, failed map[string]error) {
+	log := logger.LoggerFromContext(ctx)
+
+	failed = map[string]error{}
+
+	channelTypes := make([]string, 0, len(conf))
+	for channelType := range conf {
+		channelTypes = append(channelTypes, channelType)
+	}
+	sort.Strings(channelTypes)
+
+	seen := map[string]string{}
+	for _, channelType := range channelTypes {
+		node := conf[channelType]
+
+		configured, err := instances(channelType, &node)
+		if err != nil {
+			log.Errorf("can't read configuration of channel '%s': %v", channelType, err)
+			failed[channelType] = err
+			continue
+		}
+
+		for _, inst := range configured {
+			if otherType, dup := seen[inst.name]; dup {
+				log.Errorf("channel name '%s' of %s channel already used by %s channel, skipping", inst.name, channelType, otherType)
+				failed[inst.name] = fmt.Errorf("name already used by %s channel", otherType)
+				continue
+			}
+			seen[inst.name] = channelType
+
+			enabled := struct {
+				Enabled bool
+			}{}
+			if err := inst.node.Decode(&enabled); err != nil {
+				log.Errorf("can't read configuration of channel '%s': %v", inst.name, err)
+				failed[inst.name] = fmt.Errorf("invalid enabled field: %w", err)
+				continue
+			}
+			if !enabled.Enabled {
+				log.Debugf("%s channel disabled, skipping", inst.name)
+				continue
+			}
+
+			channel, err := New(channelType, inst.name, inst.node)
+			if err != nil {
+				log.Errorf("can't create channel '%s': %v", inst.name, err)
+				failed[inst.name] = err
+				continue
+			}
+
+			if err := channel.Init(ctx); err != nil {
+				log.Errorf("can't initialise channel '%s': %v", inst.name, err)
+				failed[inst.name] = err
+				continue
+			}
+
+			log.Debugf("%s channel initialised", inst.name)
+			channels = append(channels, channel)
+		}
+	}
+
+	return
+}
+
+// Validate checks credentials of channels implementing Validator
+//
+// Channels whose credentials are rejected, or whose service can't be
+// reached, are logged but kept so that their messages stay in spool until
+// the problem is fixed.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - channels ([]Channel): initialised channels
+//
+// Returns:
+//
+// - results (map[string]error): result of validation keyed by channel name, channels not implementing Validator are missing
+func Validate(ctx context.Context, channels []Channel) (results map[string]error) {
+	log := logger.LoggerFromContext(ctx)
+
+	results = map[string]error{}
+	for _, channel := range channels {
+		validator, ok := channel.(Validator)
+		if !ok {
+			continue
+		}
+
+		validateCtx, cancel := context.WithTimeout(ctx, validateTimeout)
+		err := validator.Validate(validateCtx)
+		cancel()
+		if err != nil {
+			log.Errorf("can't validate credentials of channel '%s': %v", channel.Name(), err)
+		} else {
+			log.Debugf("%s channel credentials valid", channel.Name())
+		}
+		results[channel.Name()] = err
+	}
+	return
+}
+
+// SilentChannels returns names of channels able to deliver messages
+// without notification, see SilentSender
+func SilentChannels(channels []Channel) (names []string) {
+	for _, channel := range channels {
+		if silent, ok := channel.(SilentSender); ok && silent.SendsSilently() {
+			names = append(names, channel.Name())
+		}
+	}
+	return
+}
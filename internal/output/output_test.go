@@ -0,0 +1,164 @@
+package output
+
+import (
+	"context"
+	"testing"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type testChannel struct {
+	name string
+	conf struct {
+		Enabled bool
+		Target  string
+	}
+	initialised bool
+}
+
+func (t *testChannel) Name() string { return t.name }
+
+func (t *testChannel) Init(ctx context.Context) error {
+	t.initialised = true
+	return nil
+}
+
+func (t *testChannel) Send(ctx context.Context, msg common.Message) error { return nil }
+
+func (t *testChannel) Close() error { return nil }
+
+func init() {
+	Register("test", func(name string, conf *yaml.Node) (Channel, error) {
+		t := &testChannel{name: name}
+		if err := conf.Decode(&t.conf); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}, nil)
+}
+
+func TestFromConfiguration(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf := common.Channels{}
+	err := yaml.Unmarshal([]byte(`
+test:
+  enabled: true
+  target: somewhere
+unknown:
+  enabled: true
+disabled:
+  enabled: false
+`), &conf)
+	if err != nil {
+		t.Fatalf("Can't unmarshal test configuration: %v", err)
+	}
+
+	channels, failed := FromConfiguration(ctx, conf)
+	if len(channels) != 1 {
+		t.Fatalf("Expected exactly 1 channel, got %d", len(channels))
+	}
+	if len(failed) != 1 || failed["unknown"] == nil {
+		t.Fatalf("Expected failure of unknown channel only, got %v", failed)
+	}
+
+	channel, ok := channels[0].(*testChannel)
+	if !ok {
+		t.Fatalf("Unexpected channel type: %T", channels[0])
+	}
+	if !channel.initialised {
+		t.Fatalf("Channel has not been initialised")
+	}
+	if channel.conf.Target != "somewhere" {
+		t.Fatalf("Channel configuration not decoded: '%s' != 'somewhere'", channel.conf.Target)
+	}
+}
+
+func TestFromConfigurationInvalidEnabled(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf := common.Channels{}
+	err := yaml.Unmarshal([]byte(`
+test:
+  - name: ops
+    enabled: maybe
+  - name: personal
+    enabled: true
+`), &conf)
+	if err != nil {
+		t.Fatalf("Can't unmarshal test configuration: %v", err)
+	}
+
+	channels, failed := FromConfiguration(ctx, conf)
+	if len(channels) != 1 || channels[0].Name() != "personal" {
+		t.Fatalf("Expected personal channel only, got %d channels", len(channels))
+	}
+	if len(failed) != 1 || failed["ops"] == nil {
+		t.Fatalf("Expected failure of ops channel only, got %v", failed)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Registering the same name twice didn't panic")
+		}
+	}()
+	Register("test", func(name string, conf *yaml.Node) (Channel, error) { return nil, nil }, nil)
+}
+
+func TestFromConfigurationInstances(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf := common.Channels{}
+	err := yaml.Unmarshal([]byte(`
+test:
+  - name: personal
+    enabled: true
+    target: me
+  - name: ops
+    enabled: true
+    target: ops group
+  - name: personal
+    enabled: true
+    target: duplicate
+  - enabled: true
+    target: no name
+`), &conf)
+	if err != nil {
+		t.Fatalf("Can't unmarshal test configuration: %v", err)
+	}
+
+	// configuration with an instance without name is invalid as a whole
+	if channels, failed := FromConfiguration(ctx, conf); len(channels) != 0 || failed["test"] == nil {
+		t.Fatalf("Expected no channels and failed test channels, got %d (%v)", len(channels), failed)
+	}
+
+	node := conf["test"]
+	node.Content = node.Content[:3]
+	conf["test"] = node
+
+	channels, failed := FromConfiguration(ctx, conf)
+	if len(channels) != 2 {
+		t.Fatalf("Expected 2 channels, got %d", len(channels))
+	}
+	if len(failed) != 1 || failed["personal"] == nil {
+		t.Fatalf("Expected failure of duplicate personal channel only, got %v", failed)
+	}
+	for i, expected := range []struct{ name, target string }{{"personal", "me"}, {"ops", "ops group"}} {
+		channel := channels[i].(*testChannel)
+		if channel.Name() != expected.name || channel.conf.Target != expected.target {
+			t.Fatalf("Unexpected channel %d: '%s' (%s)", i, channel.Name(), channel.conf.Target)
+		}
+	}
+}
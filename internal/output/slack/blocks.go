@@ -0,0 +1,98 @@
+package slack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+
+	"github.com/slack-go/slack"
+)
+
+// Layouts of messages sent without template
+const (
+	layoutBlocks = "blocks"
+	layoutText   = "text"
+)
+
+// Block Kit limits
+const (
+	// maxHeaderLength is the longest text of a header block
+	maxHeaderLength = 150
+	// maxFieldLength is the longest message field shown in context block
+	maxFieldLength = 500
+	// maxBlocks is the most blocks a message can have
+	maxBlocks = 50
+)
+
+// bodyLimit is the longest part of the body put into a single message
+var bodyLimit = common.Limit{Size: 3000, Unit: common.Runes}
+
+// mrkdwnEscaper escapes characters Slack treats as control characters
+var mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// headerBlocks returns header block with the subject and context block with
+// the other message fields
+func headerBlocks(msg common.Message) []slack.Block {
+	subject := strings.TrimSpace(msg.Subject)
+	if len(subject) == 0 {
+		subject = "(no subject)"
+	}
+
+	fields := []*slack.TextBlockObject{
+		slack.NewTextBlockObject(slack.MarkdownType, "*From:* "+mrkdwnEscaper.Replace(format.Truncate(maxFieldLength, msg.From)), false, false),
+		slack.NewTextBlockObject(slack.MarkdownType, "*To:* "+mrkdwnEscaper.Replace(format.Truncate(maxFieldLength, msg.To)), false, false),
+		slack.NewTextBlockObject(slack.MarkdownType, "*Time:* "+formatTime(msg.Time), false, false),
+	}
+	elements := make([]slack.MixedElement, 0, len(fields))
+	for _, field := range fields {
+		elements = append(elements, field)
+	}
+
+	return []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, format.Truncate(maxHeaderLength, subject), false, false)),
+		slack.NewContextBlock("", elements...),
+	}
+}
+
+// bodyBlock returns rich text block with the text preformatted
+func bodyBlock(text string) slack.Block {
+	return slack.NewRichTextBlock("", &slack.RichTextSection{
+		Type:     slack.RTEPreformatted,
+		Elements: []slack.RichTextSectionElement{slack.NewRichTextSectionTextElement(text, nil)},
+	})
+}
+
+// partBlocks returns blocks of a part of the body, its title as context and
+// its text in sections which Slack shows collapsed behind "See more" if
+// they are long
+func partBlocks(part common.Part) []slack.Block {
+	title := "*" + mrkdwnEscaper.Replace(format.Truncate(maxFieldLength, format.OneLine(part.Title))) + "*"
+	blocks := []slack.Block{noteBlock(title)}
+	for _, text := range common.Splitter(bodyLimit, part.Text) {
+		if len(strings.TrimSpace(text)) != 0 {
+			blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.PlainTextType, text, false, false), nil, nil))
+		}
+	}
+	return blocks
+}
+
+// noteBlock returns context block with a short note
+func noteBlock(text string) slack.Block {
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, text, false, false))
+}
+
+// fallbackText returns plain text shown in notifications
+func fallbackText(msg common.Message) string {
+	if len(msg.From) == 0 {
+		return msg.Subject
+	}
+	return fmt.Sprintf("%s (from %s)", msg.Subject, msg.From)
+}
+
+// formatTime formats time to be displayed in reader's time zone
+func formatTime(t time.Time) string {
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} {time_secs}|%s>", t.Unix(), t.Format(time.RFC1123Z))
+}
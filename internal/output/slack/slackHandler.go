@@ -1,54 +1,468 @@
 package slack
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
 
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 
 	"github.com/slack-go/slack"
 )
 
-// SendSlackMsg sends a message to Slack communicator
+// limit is the longest part of a message sent in one go, Slack advises to
+// keep messages under 4000 characters, room is left for "(n/m)" numbering
+// and code block
+var limit = common.Limit{Size: 4000 - 24, Unit: common.Runes}
+
+// maxFileSize is the largest file Slack accepts
+const maxFileSize = 1 << 30
+
+// Config is Slack specific configuration
 //
-// This function takes 2 arguments, 'conf' being Slack specific configuration
-// as defined in accompanying configuration file and the actual message to be sent 'msg'.
+// Layout is how messages are sent without template: "blocks" (default) uses
+// Block Kit with the subject as header, other fields as context and the body
+// preformatted, continued in a thread if it's long; "text" sends all message
+// fields in a code block. Template, if set, is Go text/template used to
+// render messages instead. Snippet makes bodies too long for a single Slack
+// message to be uploaded as one text file instead of being split. ApiUrl
+// allows to point the client to another Slack API endpoint (e.g. for
+// testing).
+type Config struct {
+	Enabled     bool
+	UserId      string                   `yaml:"userId"`
+	BotKey      string                   `yaml:"botKey"`
+	ApiUrl      string                   `yaml:"apiUrl,omitempty"`
+	Layout      string                   `yaml:"layout,omitempty"`
+	Template    string                   `yaml:"template,omitempty"`
+	Snippet     bool                     `yaml:"snippet,omitempty"`
+	Attachments output.AttachmentsConfig `yaml:"attachments,omitempty"`
+}
+
+// Slack is the Slack output channel
+type Slack struct {
+	name   string
+	conf   Config
+	client *slack.Client
+	tmpl   *format.Template
+
+	// channelId is the conversation files are shared to, for a user it's
+	// their direct message channel opened on first upload
+	channelId string
+}
+
+func init() {
+	output.Register("slack", New, Config{
+		Enabled: false,
+		UserId:  "a1b2c3d4e5",
+		BotKey:  "your_slack_app_api_key",
+		Layout:  layoutBlocks,
+		Snippet: true,
+		Attachments: output.AttachmentsConfig{
+			Enabled: true,
+			MaxSize: 20 << 20,
+		},
+	})
+}
+
+// New creates Slack channel from its configuration
+func New(name string, conf *yaml.Node) (output.Channel, error) {
+	s := &Slack{name: name}
+	if err := conf.Decode(&s.conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Name returns name of the channel
+func (s *Slack) Name() string {
+	return s.name
+}
+
+// Init validates configuration and creates the client
+func (s *Slack) Init(ctx context.Context) (err error) {
+	if len(s.conf.BotKey) == 0 {
+		return errors.New("botKey not set")
+	}
+	if len(s.conf.UserId) == 0 {
+		return errors.New("userId not set")
+	}
+	if len(s.conf.Template) != 0 {
+		if s.tmpl, err = format.NewTemplate(s.name, s.conf.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+
+	switch s.conf.Layout {
+	case "":
+		s.conf.Layout = layoutBlocks
+	case layoutBlocks, layoutText:
+	default:
+		return fmt.Errorf("unknown layout %q, use %s or %s", s.conf.Layout, layoutBlocks, layoutText)
+	}
+	if err = s.conf.Attachments.Validate(); err != nil {
+		return err
+	}
+
+	options := []slack.Option{}
+	if len(s.conf.ApiUrl) != 0 {
+		options = append(options, slack.OptionAPIURL(strings.TrimSuffix(s.conf.ApiUrl, "/")+"/"))
+	}
+	s.client = slack.New(s.conf.BotKey, options...)
+	return nil
+}
+
+// Validate checks the bot token with Slack (auth.test)
+func (s *Slack) Validate(ctx context.Context) error {
+	if _, err := s.client.AuthTestContext(ctx); err != nil {
+		return fmt.Errorf("invalid bot token: %w", err)
+	}
+	return nil
+}
+
+// Close does nothing, there is nothing to release
+func (s *Slack) Close() error {
+	return nil
+}
+
+// Send sends a message to Slack communicator
+//
+// This function formats the message, using Block Kit layout or as text,
+// and sends it to the configured user or conversation. Attachments, if
+// enabled, are uploaded as files afterwards.
 //
 // Parameters:
 //
-// - conf (TelegramChannel): Slack configuration struct
-// - msg (string): message to be sent
+// - ctx (context.Context): context
+// - newMessage (common.Message): message to be sent
 //
 // Returns:
 // - err (error): if any or nil
-func SendSlackMsg(log *zap.SugaredLogger, conf common.SlackChannel, newMessage common.Message) (err error) {
-	s := slack.New(conf.BotKey)
+func (s *Slack) Send(ctx context.Context, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
 
-	msgFmtd := formatMessage(log, newMessage)
-	chunkedMsgs := common.Splitter(4050, msgFmtd)
-	totalMsgs := len(chunkedMsgs)
-	msgCount := 1
-	for chunkId, chunk := range chunkedMsgs {
+	if s.tmpl == nil && s.conf.Layout == layoutBlocks {
+		err = s.sendBlocks(ctx, newMessage)
+	} else {
+		err = s.sendText(ctx, log, newMessage)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = s.sendAttachments(ctx, newMessage.Attachments); err != nil {
+		log.Errorf("Error sending Slack attachment: %v", err)
+		return err
+	}
+
+	log.Infof("Slack message sent")
+	return nil
+}
+
+// sendBlocks sends message using Block Kit layout
+//
+// The first message has the subject as header, other fields as context and
+// the beginning of the body. The rest of a long body is sent as replies in
+// thread of the first message or, with snippet enabled, uploaded there as a
+// text file.
+func (s *Slack) sendBlocks(ctx context.Context, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	if lead, ok := newMessage.Lead(); ok {
+		return s.sendParts(ctx, newMessage, strings.TrimRight(lead, "\n"))
+	}
+
+	parts := common.Splitter(bodyLimit, newMessage.Body)
+	blocks := headerBlocks(newMessage)
+	switch {
+	case len(parts) > 1 && s.conf.Snippet:
+		blocks = append(blocks, noteBlock("Message body is attached in the thread"))
+	case len(parts) > 1:
+		blocks = append(blocks, bodyBlock(parts[0]), noteBlock(fmt.Sprintf("Continued in the thread (1/%d)", len(parts))))
+	case len(strings.TrimSpace(parts[0])) != 0:
+		blocks = append(blocks, bodyBlock(parts[0]))
+	}
+
+	channelId, ts, err := s.post(ctx, s.conf.UserId, "", fallbackText(newMessage), blocks...)
+	if err != nil {
+		log.Errorf("Error sending Slack message: %v", err)
+		return err
+	}
+	if len(parts) == 1 {
+		return nil
+	}
+
+	if s.conf.Snippet {
+		err = s.upload(ctx, "message.txt", newMessage.Subject, []byte(newMessage.Body), ts)
+		if err != nil {
+			log.Errorf("Error uploading Slack snippet: %v", err)
+		}
+		return err
+	}
+	for partId, part := range parts[1:] {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		numbering := fmt.Sprintf("(%d/%d)", partId+2, len(parts))
+		_, _, err = s.post(ctx, channelId, ts, numbering, bodyBlock(part), noteBlock(numbering))
 		if err != nil {
+			log.Errorf("Error sending Slack message %d: %v", partId+1, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// sendParts sends message whose body ends with parts using Block Kit layout
+//
+// The body without parts follows the header as with sendBlocks and every
+// part is shown as its title followed by its text, collapsed if it's long.
+// Whatever doesn't fit into the first message, lead text or parts, is sent
+// as replies in its thread, a part too long for a message of its own is
+// continued in the next one.
+func (s *Slack) sendParts(ctx context.Context, newMessage common.Message, lead string) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	blocks := headerBlocks(newMessage)
+	channelId, ts := s.conf.UserId, ""
+	flush := func() error {
+		var err error
+		if len(ts) == 0 {
+			channelId, ts, err = s.post(ctx, channelId, "", fallbackText(newMessage), blocks...)
+		} else {
+			_, _, err = s.post(ctx, channelId, ts, newMessage.Subject, blocks...)
+		}
+		blocks = nil
+		return err
+	}
+	// add keeps blocks together in one message if they fit into it
+	add := func(more []slack.Block) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(blocks) != 0 && len(blocks)+len(more) > maxBlocks {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		for len(blocks)+len(more) > maxBlocks {
+			n := maxBlocks - len(blocks)
+			blocks = append(blocks, more[:n]...)
+			more = more[n:]
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		blocks = append(blocks, more...)
+		return nil
+	}
+
+	for _, text := range common.Splitter(bodyLimit, lead) {
+		if len(strings.TrimSpace(text)) == 0 {
+			continue
+		}
+		if err = add([]slack.Block{bodyBlock(text)}); err != nil {
+			log.Errorf("Error sending Slack message: %v", err)
+			return err
+		}
+	}
+	for _, part := range newMessage.Parts {
+		if err = add(partBlocks(part)); err != nil {
+			log.Errorf("Error sending Slack message: %v", err)
 			return err
 		}
-		chunk = fmt.Sprintf("(%d/%d)\n%s", msgCount, totalMsgs, chunk)
+	}
+	if err = flush(); err != nil {
+		log.Errorf("Error sending Slack message: %v", err)
+	}
+	return err
+}
 
-		chunk = markdownMessage(chunk)
+// post sends Block Kit message
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - channelId (string): user or conversation to send the message to
+// - threadTs (string): timestamp of the message to reply to or empty string
+// - fallback (string): text shown in notifications
+// - blocks (...slack.Block): content of the message
+//
+// Returns:
+//
+// - channelId (string): conversation the message was sent to
+// - ts (string): timestamp of the message
+// - err (error): if any or nil
+func (s *Slack) post(ctx context.Context, channelId string, threadTs string, fallback string, blocks ...slack.Block) (string, string, error) {
+	options := []slack.MsgOption{slack.MsgOptionText(fallback, true), slack.MsgOptionBlocks(blocks...)}
+	if len(threadTs) != 0 {
+		options = append(options, slack.MsgOptionTS(threadTs))
+	}
+	channelId, ts, _, err := s.client.SendMessageContext(ctx, channelId, options...)
+	if err == nil {
+		metrics.ChunkSent(s.name)
+	}
+	return channelId, ts, err
+}
 
-		_, _, _, err := s.SendMessage(conf.UserId, slack.MsgOptionText(chunk, true))
+// sendText sends message as text
+//
+// The message is split into chunks sent one by one. With snippet enabled a
+// message which doesn't fit into one chunk is uploaded as a text file
+// instead.
+func (s *Slack) sendText(ctx context.Context, log *zap.SugaredLogger, newMessage common.Message) (err error) {
+	msgFmtd, err := s.render(log, newMessage)
+	if err != nil {
+		return err
+	}
+
+	if s.conf.Snippet && limit.Unit.Length(msgFmtd) > limit.Size {
+		err = s.upload(ctx, "message.txt", newMessage.Subject, []byte(msgFmtd), "")
+		if err != nil {
+			log.Errorf("Error uploading Slack snippet: %v", err)
+		}
+		return err
+	}
+
+	for chunkId, chunk := range s.split(msgFmtd) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		_, _, _, err = s.client.SendMessageContext(ctx, s.conf.UserId, slack.MsgOptionText(chunk, true))
 		if err != nil {
 			log.Errorf("Error sending Slack message %d: %v", chunkId, err)
 			return err
 		}
-		msgCount++
+		metrics.ChunkSent(s.name)
 	}
+	return nil
+}
 
-	log.Infof("Slack message sent")
+// render formats message with template if configured or with all its fields
+func (s *Slack) render(log *zap.SugaredLogger, newMessage common.Message) (msgFmtd string, err error) {
+	if s.tmpl == nil {
+		return formatMessage(log, newMessage), nil
+	}
+
+	msgFmtd, err = s.tmpl.Render(newMessage)
+	if err != nil {
+		return "", fmt.Errorf("can't render template: %w", err)
+	}
+	return msgFmtd, nil
+}
+
+// split splits formatted message into parts ready to be sent
+//
+// Without template the message is sent as code blocks, each numbered. With
+// template the rendered text is sent as it is, so it can use Slack mrkdwn,
+// numbered only if it had to be split.
+func (s *Slack) split(msgFmtd string) (chunks []string) {
+	chunkedMsgs := common.Splitter(limit, msgFmtd)
+	for chunkId, chunk := range chunkedMsgs {
+		if s.tmpl == nil {
+			chunk = markdownMessage(fmt.Sprintf("(%d/%d)\n%s", chunkId+1, len(chunkedMsgs), chunk))
+		} else if len(chunkedMsgs) > 1 {
+			chunk = fmt.Sprintf("(%d/%d)\n%s", chunkId+1, len(chunkedMsgs), chunk)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// sendAttachments uploads attachments selected by configuration
+//
+// Attachments which were not sent are listed in a final message.
+func (s *Slack) sendAttachments(ctx context.Context, attachments []common.Attachment) (err error) {
+	send, skipped := s.conf.Attachments.Filter(attachments, maxFileSize)
+
+	for _, attachment := range send {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = s.upload(ctx, attachment.Filename, attachment.Filename, attachment.Data, ""); err != nil {
+			return fmt.Errorf("%s: %w", attachment.Filename, err)
+		}
+	}
+
+	if len(skipped) != 0 {
+		note := "Attachments not sent:\n" + strings.Join(skipped, "\n")
+		_, _, _, err = s.client.SendMessageContext(ctx, s.conf.UserId, slack.MsgOptionText(note, true))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// upload uploads a file and shares it to the configured conversation
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - filename (string): name of the file
+// - title (string): title displayed with the file
+// - data ([]byte): content of the file
+// - threadTs (string): timestamp of the message to share the file in thread of or empty string
+//
+// Returns:
+// - err (error): if any or nil
+func (s *Slack) upload(ctx context.Context, filename string, title string, data []byte, threadTs string) (err error) {
+	if len(data) == 0 {
+		return errors.New("file is empty")
+	}
+	if len(filename) == 0 {
+		filename = "attachment"
+	}
+
+	channelId, err := s.channel(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.UploadFileV2Context(ctx, slack.UploadFileV2Parameters{
+		Reader:          bytes.NewReader(data),
+		FileSize:        len(data),
+		Filename:        filename,
+		Title:           title,
+		Channel:         channelId,
+		ThreadTimestamp: threadTs,
+	})
+	return err
+}
+
+// channel returns ID of the conversation files are shared to
+//
+// Messages can be sent to a user ID directly but files can only be shared to
+// a conversation so for users their direct message channel is opened.
+func (s *Slack) channel(ctx context.Context) (channelId string, err error) {
+	if len(s.channelId) != 0 {
+		return s.channelId, nil
+	}
+	if !strings.HasPrefix(s.conf.UserId, "U") && !strings.HasPrefix(s.conf.UserId, "W") {
+		s.channelId = s.conf.UserId
+		return s.channelId, nil
+	}
+
+	conversation, _, _, err := s.client.OpenConversationContext(ctx, &slack.OpenConversationParameters{
+		Users: []string{s.conf.UserId},
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't open conversation with %s: %w", s.conf.UserId, err)
+	}
+	s.channelId = conversation.ID
+	return s.channelId, nil
+}
+
 // formatMessage formats message to Slack communicator
 //
 // This function parses the 'message' struct and formats a message that is to be sent to the Slack
@@ -0,0 +1,423 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+type apiCall struct {
+	method   string
+	channel  string
+	text     string
+	data     string
+	threadTs string
+	blocks   []map[string]any
+}
+
+// mockApi pretends to be Slack Web API recording all calls
+func mockApi(t *testing.T) (*httptest.Server, func() []apiCall) {
+	var mu sync.Mutex
+	calls := []apiCall{}
+	uploads := map[string]string{}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCall{method: strings.TrimPrefix(r.URL.Path, "/")}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Errorf("Can't read upload: %v", err)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			call.data = string(data)
+		} else if err := r.ParseForm(); err != nil {
+			t.Errorf("Can't parse request: %v", err)
+		}
+		call.channel = r.FormValue("channel") + r.FormValue("channel_id") + r.FormValue("users")
+		call.text = r.FormValue("text")
+		call.threadTs = r.FormValue("thread_ts")
+		if blocks := r.FormValue("blocks"); len(blocks) != 0 {
+			if err := json.Unmarshal([]byte(blocks), &call.blocks); err != nil {
+				t.Errorf("Can't decode blocks: %v", err)
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var response any
+		switch call.method {
+		case "auth.test":
+			if strings.HasSuffix(r.Header.Get("Authorization")+r.FormValue("token"), "invalid") {
+				response = map[string]any{"ok": false, "error": "invalid_auth"}
+			} else {
+				response = map[string]any{"ok": true, "user_id": "U42", "team_id": "T42"}
+			}
+		case "chat.postMessage":
+			response = map[string]any{"ok": true, "channel": call.channel, "ts": "1.1"}
+		case "conversations.open":
+			response = map[string]any{"ok": true, "channel": map[string]any{"id": "D42"}}
+		case "files.getUploadURLExternal":
+			id := "F" + r.FormValue("filename")
+			response = map[string]any{"ok": true, "upload_url": server.URL + "/upload/" + id, "file_id": id}
+		case "files.completeUploadExternal":
+			files := []map[string]string{}
+			json.Unmarshal([]byte(r.FormValue("files")), &files)
+			call.data = uploads[files[0]["id"]]
+			response = map[string]any{"ok": true, "files": files}
+		default:
+			if id, ok := strings.CutPrefix(call.method, "upload/"); ok {
+				uploads[id] = call.data
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			t.Errorf("Unexpected API call: %s", call.method)
+			response = map[string]any{"ok": false, "error": "unknown_method"}
+		}
+		calls = append(calls, call)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	return server, func() []apiCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func newTestSlack(t *testing.T, ctx context.Context, conf Config) *Slack {
+	s := &Slack{name: "slack", conf: conf}
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+	return s
+}
+
+func TestSendAttachments(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	s := newTestSlack(t, ctx, Config{
+		Enabled: true,
+		UserId:  "U123",
+		BotKey:  "xoxb-test",
+		ApiUrl:  server.URL,
+		Attachments: output.AttachmentsConfig{
+			Enabled: true,
+			MaxSize: 10,
+		},
+	})
+
+	testMsg := common.Message{
+		Time:    time.Now(),
+		From:    "cron@example.com",
+		To:      "user@example.com",
+		Subject: "report",
+		Body:    "see attached",
+		Attachments: []common.Attachment{
+			{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n1,2\n")},
+			{Filename: "huge.log", ContentType: "text/plain", Data: []byte(strings.Repeat("x", 11))},
+		},
+	}
+	if err := s.Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	expected := []apiCall{
+		{method: "chat.postMessage", channel: "U123"},
+		{method: "conversations.open", channel: "U123"},
+		{method: "files.getUploadURLExternal"},
+		{method: "files.completeUploadExternal", channel: "D42", data: "a,b\n1,2\n"},
+		{method: "chat.postMessage", channel: "U123"},
+	}
+	received := calls()
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d API calls, got %+v", len(expected), received)
+	}
+	for i, call := range received {
+		if call.method != expected[i].method || call.channel != expected[i].channel || call.data != expected[i].data {
+			t.Errorf("Call %d: expected %+v, got %+v", i, expected[i], call)
+		}
+	}
+	if !strings.Contains(received[4].text, "huge.log") {
+		t.Errorf("Skipped attachment not reported: %q", received[4].text)
+	}
+}
+
+func TestSendSnippet(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	conf := Config{
+		Enabled: true,
+		UserId:  "C123",
+		BotKey:  "xoxb-test",
+		ApiUrl:  server.URL,
+		Layout:  layoutText,
+		Snippet: true,
+	}
+	testMsg := common.Message{
+		Time:    time.Now(),
+		Subject: "long",
+		Body:    strings.Repeat("body body body\n", 1000),
+	}
+
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received := calls()
+	if len(received) != 2 || received[1].method != "files.completeUploadExternal" || received[1].channel != "C123" {
+		t.Fatalf("Expected snippet upload to C123, got %+v", received)
+	}
+	if !strings.Contains(received[1].data, testMsg.Body) {
+		t.Errorf("Snippet doesn't contain the body")
+	}
+
+	// short messages are sent as text even with snippet enabled
+	testMsg.Body = "short"
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if received = calls(); len(received) != 3 || received[2].method != "chat.postMessage" {
+		t.Fatalf("Expected text message, got %+v", received)
+	}
+
+	// without snippet long messages are split
+	conf.Snippet = false
+	testMsg.Body = strings.Repeat("body body body\n", 1000)
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if received = calls(); len(received) != 7 {
+		t.Fatalf("Expected 4 more text messages, got %+v", received[3:])
+	}
+}
+
+// blockTypes returns types of the blocks
+func blockTypes(blocks []map[string]any) (types []string) {
+	for _, block := range blocks {
+		types = append(types, block["type"].(string))
+	}
+	return types
+}
+
+func TestSendBlocks(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	conf := Config{
+		Enabled: true,
+		UserId:  "C123",
+		BotKey:  "xoxb-test",
+		ApiUrl:  server.URL,
+	}
+	testMsg := common.Message{
+		Time:    time.Now(),
+		From:    "Cron <cron@example.com>",
+		To:      "user@example.com",
+		Subject: "backup done",
+		Body:    "all good",
+	}
+
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received := calls()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 message, got %+v", received)
+	}
+	if types := strings.Join(blockTypes(received[0].blocks), ","); types != "header,context,rich_text" {
+		t.Fatalf("Unexpected blocks: %s", types)
+	}
+	header, _ := json.Marshal(received[0].blocks[0])
+	fields, _ := json.Marshal(received[0].blocks[1])
+	body, _ := json.Marshal(received[0].blocks[2])
+	if !strings.Contains(string(header), `"backup done"`) {
+		t.Errorf("Subject not in header: %s", header)
+	}
+	if !strings.Contains(string(fields), "Cron \\u0026lt;cron@example.com\\u0026gt;") {
+		t.Errorf("Sender not escaped in context: %s", fields)
+	}
+	if !strings.Contains(string(body), `"rich_text_preformatted"`) || !strings.Contains(string(body), `"all good"`) {
+		t.Errorf("Body not preformatted: %s", body)
+	}
+	if received[0].text != "backup done (from Cron &lt;cron@example.com&gt;)" {
+		t.Errorf("Unexpected fallback text: %q", received[0].text)
+	}
+
+	// long body continues in the thread
+	testMsg.Body = strings.Repeat("body body body\n", 500)
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received = calls()[1:]
+	if len(received) != 3 {
+		t.Fatalf("Expected message with 2 replies, got %+v", received)
+	}
+	if received[0].threadTs != "" || received[1].threadTs != "1.1" || received[2].threadTs != "1.1" {
+		t.Errorf("Replies not sent in thread: %+v", received)
+	}
+	if types := strings.Join(blockTypes(received[0].blocks), ","); types != "header,context,rich_text,context" {
+		t.Errorf("Unexpected blocks: %s", types)
+	}
+
+	// with snippet long body is uploaded to the thread
+	conf.Snippet = true
+	if err := newTestSlack(t, ctx, conf).Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received = calls()[4:]
+	if len(received) != 3 || received[2].method != "files.completeUploadExternal" || received[2].threadTs != "1.1" {
+		t.Fatalf("Expected body uploaded to the thread, got %+v", received)
+	}
+	if received[2].data != testMsg.Body {
+		t.Errorf("Uploaded body differs")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, _ := mockApi(t)
+	defer server.Close()
+
+	for _, test := range []struct {
+		botKey string
+		valid  bool
+	}{
+		{"xoxb-valid", true},
+		{"xoxb-invalid", false},
+	} {
+		s := newTestSlack(t, ctx, Config{Enabled: true, UserId: "U42", BotKey: test.botKey, ApiUrl: server.URL})
+		if err := s.Validate(ctx); test.valid != (err == nil) {
+			t.Errorf("%s: expected valid %t, got %v", test.botKey, test.valid, err)
+		}
+	}
+}
+
+func TestSendParts(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	parts := []common.Part{}
+	for i := 1; i <= 30; i++ {
+		parts = append(parts, common.Part{Title: fmt.Sprintf("%d. Backup <ok>", i), Text: "From: root\n\nbacked up 42 files"})
+	}
+	testMsg := common.Message{
+		Time:    time.Now(),
+		Subject: "Digest nightly: 30 messages",
+		Body:    "30 messages\n\n" + common.JoinParts(parts),
+		Parts:   parts,
+	}
+
+	s := newTestSlack(t, ctx, Config{Enabled: true, UserId: "C123", BotKey: "xoxb-test", ApiUrl: server.URL})
+	if err := s.Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received := calls()
+	if len(received) != 2 || received[0].threadTs != "" || received[1].threadTs != "1.1" {
+		t.Fatalf("Expected message with parts continued in thread, got %+v", received)
+	}
+	if len(received[0].blocks) > 50 || len(received[0].blocks)+len(received[1].blocks) != 3+2*len(parts) {
+		t.Fatalf("Unexpected number of blocks: %d and %d", len(received[0].blocks), len(received[1].blocks))
+	}
+	if types := strings.Join(blockTypes(received[0].blocks[:5]), ","); types != "header,context,rich_text,context,section" {
+		t.Errorf("Unexpected blocks: %s", types)
+	}
+	title, _ := json.Marshal(received[0].blocks[3])
+	text, _ := json.Marshal(received[0].blocks[4])
+	if !strings.Contains(string(title), `*1. Backup \u0026lt;ok\u0026gt;*`) || !strings.Contains(string(text), `"plain_text"`) || !strings.Contains(string(text), "backed up 42 files") {
+		t.Errorf("Unexpected part blocks: %s %s", title, text)
+	}
+	if lead, _ := json.Marshal(received[0].blocks[2]); strings.Contains(string(lead), "===") {
+		t.Errorf("Parts repeated in body: %s", lead)
+	}
+}
+
+func TestSendPartsOverflow(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	long := func(c string) string {
+		return strings.Repeat(strings.Repeat(c, 2999)+"\n", 60)
+	}
+	tests := []struct {
+		name string
+		lead string
+		part common.Part
+	}{
+		{"long lead", long("x"), common.Part{Title: "1. Short", Text: "yyy"}},
+		{"long part", "1 message", common.Part{Title: "1. Long", Text: long("y")}},
+	}
+	for _, test := range tests {
+		server, calls := mockApi(t)
+
+		parts := []common.Part{test.part}
+		testMsg := common.Message{
+			Time:    time.Now(),
+			Subject: "Digest nightly: 1 message",
+			Body:    test.lead + common.JoinParts(parts),
+			Parts:   parts,
+		}
+		s := newTestSlack(t, ctx, Config{Enabled: true, UserId: "C123", BotKey: "xoxb-test", ApiUrl: server.URL})
+		if err := s.sendParts(ctx, testMsg, test.lead); err != nil {
+			t.Fatalf("%s: send failed: %v", test.name, err)
+		}
+		server.Close()
+
+		received := calls()
+		total := 0
+		for i, call := range received {
+			if len(call.blocks) > 50 {
+				t.Errorf("%s: message %d has %d blocks", test.name, i, len(call.blocks))
+			}
+			if (i == 0) != (call.threadTs == "") {
+				t.Errorf("%s: message %d not in thread of the first one", test.name, i)
+			}
+			total += len(call.blocks)
+		}
+		expected := len(headerBlocks(testMsg)) + len(common.Splitter(bodyLimit, test.lead)) + len(partBlocks(test.part))
+		if len(received) < 2 || total != expected {
+			t.Fatalf("%s: expected %d blocks in several messages, got %d in %d messages", test.name, expected, total, len(received))
+		}
+		if last, _ := json.Marshal(received[len(received)-1].blocks); !strings.Contains(string(last), "yyy") {
+			t.Errorf("%s: end of the message not sent: %s", test.name, last)
+		}
+	}
+}
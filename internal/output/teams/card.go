@@ -0,0 +1,123 @@
+package teams
+
+import (
+	"fmt"
+
+	"smtp2communicator/internal/common"
+)
+
+// message is the envelope expected by Teams incoming webhooks and Workflows
+type message struct {
+	Type        string       `json:"type"`
+	Attachments []attachment `json:"attachments"`
+}
+
+type attachment struct {
+	ContentType string  `json:"contentType"`
+	ContentUrl  *string `json:"contentUrl"`
+	Content     card    `json:"content"`
+}
+
+type card struct {
+	Schema  string    `json:"$schema"`
+	Type    string    `json:"type"`
+	Version string    `json:"version"`
+	Body    []element `json:"body"`
+	MsTeams msTeams   `json:"msteams"`
+}
+
+type msTeams struct {
+	Width string `json:"width"`
+}
+
+type element struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Weight   string `json:"weight,omitempty"`
+	Size     string `json:"size,omitempty"`
+	FontType string `json:"fontType,omitempty"`
+	Wrap     bool   `json:"wrap,omitempty"`
+	Facts    []fact `json:"facts,omitempty"`
+}
+
+type fact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// adaptiveCard builds Adaptive Card carrying one chunk of the message
+//
+// Parameters:
+//
+// - msg (common.Message): message the chunk belongs to
+// - chunk (string): part of the message body
+// - chunkNo (int): number of this chunk starting from 1
+// - totalChunks (int): total number of chunks
+//
+// Returns:
+//
+// - payload (message): message ready to be marshalled to JSON
+func adaptiveCard(msg common.Message, chunk string, chunkNo, totalChunks int) (payload message) {
+	body := []element{
+		{
+			Type:   "TextBlock",
+			Text:   fmt.Sprintf("(%d/%d) %s", chunkNo, totalChunks, msg.Subject),
+			Weight: "Bolder",
+			Size:   "Medium",
+			Wrap:   true,
+		},
+		{
+			Type: "FactSet",
+			Facts: []fact{
+				{Title: "Time", Value: msg.Time.String()},
+				{Title: "From", Value: msg.From},
+				{Title: "To", Value: msg.To},
+			},
+		},
+		{
+			Type:     "TextBlock",
+			Text:     chunk,
+			FontType: "Monospace",
+			Wrap:     true,
+		},
+	}
+
+	return cardMessage(body)
+}
+
+// textCard builds Adaptive Card carrying text rendered with template
+//
+// Parameters:
+//
+// - text (string): part of the rendered text
+// - chunkNo (int): number of this part starting from 1
+// - totalChunks (int): total number of parts, numbering is shown only if more than one
+//
+// Returns:
+//
+// - payload (message): message ready to be marshalled to JSON
+func textCard(text string, chunkNo, totalChunks int) (payload message) {
+	if totalChunks > 1 {
+		text = fmt.Sprintf("(%d/%d)\n%s", chunkNo, totalChunks, text)
+	}
+	return cardMessage([]element{{Type: "TextBlock", Text: text, Wrap: true}})
+}
+
+// cardMessage wraps Adaptive Card with given body into webhook message
+func cardMessage(body []element) message {
+	return message{
+		Type: "message",
+		Attachments: []attachment{
+			{
+				ContentType: "application/vnd.microsoft.card.adaptive",
+				Content: card{
+					Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+					Type:    "AdaptiveCard",
+					Version: "1.4",
+					Body:    body,
+					MsTeams: msTeams{Width: "Full"},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package teams
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Teams accepts up to ~28KB per message including the card itself, keep the
+// body of a single card well below that
+var limit = common.Limit{Size: 20000, Unit: common.Bytes}
+
+// Config is Microsoft Teams specific configuration
+//
+// Template, if set, is Go text/template used to render messages instead of
+// the card with the subject, other message fields and the body.
+type Config struct {
+	Enabled    bool
+	WebhookUrl string `yaml:"webhookUrl"`
+	Template   string `yaml:"template,omitempty"`
+}
+
+// Teams is the Microsoft Teams output channel
+type Teams struct {
+	name   string
+	conf   Config
+	client *http.Client
+	tmpl   *format.Template
+}
+
+func init() {
+	output.Register("teams", New, Config{
+		Enabled:    false,
+		WebhookUrl: "https://your_incoming_webhook_or_workflow_url",
+	})
+}
+
+// New creates Teams channel from its configuration
+func New(name string, conf *yaml.Node) (output.Channel, error) {
+	t := &Teams{name: name}
+	if err := conf.Decode(&t.conf); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Name returns name of the channel
+func (t *Teams) Name() string {
+	return t.name
+}
+
+// Init validates configuration and creates HTTP client
+func (t *Teams) Init(ctx context.Context) (err error) {
+	if len(t.conf.WebhookUrl) == 0 {
+		return errors.New("webhookUrl not set")
+	}
+	if len(t.conf.Template) != 0 {
+		if t.tmpl, err = format.NewTemplate(t.name, t.conf.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+
+	t.client = &http.Client{Timeout: 30 * time.Second}
+	return nil
+}
+
+// Close does nothing, there is nothing to release
+func (t *Teams) Close() error {
+	return nil
+}
+
+// Send sends a message to Microsoft Teams
+//
+// This function splits the message body into chunks, wraps each of them in
+// an Adaptive Card and posts it to the configured webhook. With template the
+// rendered text is split and sent instead.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - newMessage (common.Message): message to be sent
+//
+// Returns:
+// - err (error): if any or nil
+func (t *Teams) Send(ctx context.Context, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	text := newMessage.Body
+	if t.tmpl != nil {
+		if text, err = t.tmpl.Render(newMessage); err != nil {
+			return fmt.Errorf("can't render template: %w", err)
+		}
+	}
+
+	chunkedMsgs := common.Splitter(limit, text)
+	totalMsgs := len(chunkedMsgs)
+	for chunkId, chunk := range chunkedMsgs {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		card := adaptiveCard(newMessage, chunk, chunkId+1, totalMsgs)
+		if t.tmpl != nil {
+			card = textCard(chunk, chunkId+1, totalMsgs)
+		}
+		payload, err := json.Marshal(card)
+		if err != nil {
+			return err
+		}
+
+		if err = t.post(ctx, payload); err != nil {
+			log.Errorf("Error sending Teams message %d: %v", chunkId, err)
+			return err
+		}
+	}
+
+	log.Infof("Teams message sent")
+	return nil
+}
+
+// post sends a single payload to the webhook
+func (t *Teams) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.conf.WebhookUrl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// incoming webhooks reply 200, Workflows reply 202
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status %s: %s", resp.Status, body)
+	}
+	metrics.ChunkSent(t.name)
+	return nil
+}
@@ -0,0 +1,131 @@
+package teams
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestSend(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	received := []message{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content type: %s", r.Header.Get("Content-Type"))
+		}
+		payload := message{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Can't decode payload: %v", err)
+		}
+		received = append(received, payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	teams := &Teams{conf: Config{Enabled: true, WebhookUrl: server.URL}}
+	if err := teams.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	testMsg := common.Message{
+		Time:    time.Now(),
+		From:    "cron@example.com",
+		To:      "user@example.com",
+		Subject: "hello test",
+		Body:    strings.Repeat("body body body\n", 2000),
+	}
+
+	if err := teams.Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 cards, got %d", len(received))
+	}
+
+	for i, payload := range received {
+		if len(payload.Attachments) != 1 {
+			t.Fatalf("Expected 1 attachment, got %d", len(payload.Attachments))
+		}
+		content := payload.Attachments[0].Content
+		if content.Type != "AdaptiveCard" {
+			t.Fatalf("Unexpected card type: %s", content.Type)
+		}
+		if !strings.Contains(content.Body[0].Text, testMsg.Subject) {
+			t.Fatalf("Card %d doesn't contain subject: '%s'", i, content.Body[0].Text)
+		}
+		if !strings.Contains(content.Body[2].Text, "body body body") {
+			t.Fatalf("Card %d doesn't contain body", i)
+		}
+	}
+}
+
+func TestSendError(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad payload", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	teams := &Teams{conf: Config{Enabled: true, WebhookUrl: server.URL}}
+	if err := teams.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	if err := teams.Send(ctx, common.Message{Body: "body"}); err == nil {
+		t.Fatalf("Expected error for rejected message")
+	}
+}
+
+func TestSendTemplate(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	received := []message{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := message{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Can't decode payload: %v", err)
+		}
+		received = append(received, payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	teams := &Teams{conf: Config{Enabled: true, WebhookUrl: server.URL, Template: `**{{ .Subject }}** {{ .Body | firstLine }}`}}
+	if err := teams.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+	if err := teams.Send(ctx, common.Message{Subject: "disk full", Body: "sda1 at 99%\nmore"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 card, got %d", len(received))
+	}
+	body := received[0].Attachments[0].Content.Body
+	if len(body) != 1 || body[0].Text != "**disk full** sda1 at 99%" {
+		t.Fatalf("Unexpected card body: %+v", body)
+	}
+
+	invalid := &Teams{conf: Config{Enabled: true, WebhookUrl: server.URL, Template: `{{ .Subject`}}
+	if err := invalid.Init(ctx); err == nil {
+		t.Fatalf("Invalid template accepted")
+	}
+}
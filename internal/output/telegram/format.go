@@ -0,0 +1,218 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+)
+
+// Parse modes of Telegram Bot API, plain text is sent without any
+const (
+	modeMarkdown = "MarkdownV2"
+	modeHTML     = "HTML"
+	modePlain    = ""
+)
+
+// maxHeaderLength is the longest value of a header field shown in a message
+const maxHeaderLength = 256
+
+// parseMode returns Bot API parse mode for the configured one
+//
+// Parameters:
+//
+// - name (string): configured parse mode, empty means MarkdownV2
+//
+// Returns:
+//
+// - mode (string): parse mode as Bot API expects it
+// - err (error): error if the parse mode is unknown
+func parseMode(name string) (mode string, err error) {
+	switch strings.ToLower(name) {
+	case "", "markdownv2", "markdown":
+		return modeMarkdown, nil
+	case "html":
+		return modeHTML, nil
+	case "plain", "none":
+		return modePlain, nil
+	default:
+		return "", fmt.Errorf("unknown parse mode %q, use MarkdownV2, HTML or plain", name)
+	}
+}
+
+// markdownEscaper escapes all characters reserved in MarkdownV2 text
+var markdownEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-",
+	"=", "\\=", "|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// markdownCodeEscaper escapes characters reserved inside MarkdownV2 pre and
+// code entities
+var markdownCodeEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+
+// escape escapes text so it's displayed as it is in given parse mode
+func escape(mode string, text string) string {
+	switch mode {
+	case modeMarkdown:
+		return markdownEscaper.Replace(text)
+	case modeHTML:
+		return html.EscapeString(text)
+	default:
+		return text
+	}
+}
+
+// bold formats text as bold, the text is escaped
+func bold(mode string, text string) string {
+	switch mode {
+	case modeMarkdown:
+		return "*" + escape(mode, text) + "*"
+	case modeHTML:
+		return "<b>" + escape(mode, text) + "</b>"
+	default:
+		return text
+	}
+}
+
+// pre formats text as preformatted block, the text is escaped
+func pre(mode string, text string) string {
+	switch mode {
+	case modeMarkdown:
+		return "```\n" + markdownCodeEscaper.Replace(text) + "\n```"
+	case modeHTML:
+		return "<pre>" + html.EscapeString(text) + "</pre>"
+	default:
+		return text
+	}
+}
+
+// expandable formats text as block quote shown collapsed until the reader
+// expands it, the text is escaped
+func expandable(mode string, text string) string {
+	switch mode {
+	case modeMarkdown:
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = ">" + escape(mode, line)
+		}
+		return "**" + strings.Join(lines, "\n") + "||"
+	case modeHTML:
+		return "<blockquote expandable>" + html.EscapeString(text) + "</blockquote>"
+	default:
+		return text
+	}
+}
+
+// formatHeader formats message fields with their names in bold
+//
+// Returns also the length of the text displayed so that the body can be
+// split to fit into the same message.
+func formatHeader(mode string, msg common.Message) (header string, length int) {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"Time:", msg.Time.String()},
+		{"From:", msg.From},
+		{"To:", msg.To},
+		{"Subject:", msg.Subject},
+	}
+
+	var b strings.Builder
+	for _, field := range fields {
+		value := format.Truncate(maxHeaderLength, field.value)
+		b.WriteString(bold(mode, field.name) + " " + escape(mode, value) + "\n")
+		length += limit.Unit.Length(field.name + " " + value + "\n")
+	}
+	return b.String(), length
+}
+
+// formatMessage formats message for Telegram
+//
+// Message fields are shown in bold and the body in preformatted block. The
+// body is split so that every part, together with "(n/m)" numbering and
+// fields in the first one, fits into a single Telegram message. Parts the
+// body ends with (see common.Message Lead) follow in expandable block
+// quotes, unless the message is plain text.
+//
+// Parameters:
+//
+// - mode (string): parse mode
+// - msg (common.Message): message to be formatted
+//
+// Returns:
+//
+// - chunks ([]string): formatted messages
+func formatMessage(mode string, msg common.Message) (chunks []string) {
+	header, headerLength := formatHeader(mode, msg)
+	bodyLimit := limit
+	bodyLimit.Size -= headerLength
+
+	body, collapse := msg.Lead()
+	if !collapse || mode == modePlain {
+		body, collapse = msg.Body, false
+	} else {
+		body = strings.TrimRight(body, "\n")
+	}
+
+	var texts []string
+	for partId, part := range common.Splitter(bodyLimit, body) {
+		text := ""
+		if partId == 0 {
+			text = header
+		}
+		if len(strings.TrimSpace(part)) != 0 {
+			text += pre(mode, part)
+		}
+		texts = append(texts, text)
+	}
+	if collapse {
+		texts = append(texts, formatParts(mode, msg.Parts)...)
+	}
+
+	for textId, text := range texts {
+		chunks = append(chunks, escape(mode, fmt.Sprintf("(%d/%d)\n", textId+1, len(texts)))+text)
+	}
+	return chunks
+}
+
+// formatParts formats parts of the body as expandable block quotes with
+// their titles in bold
+//
+// As many parts as fit are put into one message, a part too long for
+// a message of its own is split into several numbered ones.
+func formatParts(mode string, parts []common.Part) (texts []string) {
+	text, length := "", 0
+	add := func(title, quote string) {
+		quoteLength := limit.Unit.Length(title + "\n" + quote + "\n")
+		if length != 0 && length+quoteLength > limit.Size {
+			texts = append(texts, text)
+			text, length = "", 0
+		}
+		text += bold(mode, title) + "\n" + expandable(mode, quote) + "\n"
+		length += quoteLength
+	}
+
+	for _, part := range parts {
+		title := format.Truncate(maxHeaderLength, format.OneLine(part.Title))
+		quoteLimit := limit
+		quoteLimit.Size -= limit.Unit.Length(title + " (00/00)\n\n")
+
+		quotes := common.Splitter(quoteLimit, part.Text)
+		for quoteId, quote := range quotes {
+			if len(quotes) == 1 {
+				add(title, quote)
+			} else {
+				add(fmt.Sprintf("%s (%d/%d)", title, quoteId+1, len(quotes)), quote)
+			}
+		}
+	}
+	if length != 0 {
+		texts = append(texts, text)
+	}
+	return texts
+}
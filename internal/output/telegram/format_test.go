@@ -0,0 +1,129 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestFormatMessage(t *testing.T) {
+	msg := common.Message{
+		Time:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		From:    "cron_daemon <root@example.com>",
+		To:      "user@example.com",
+		Subject: "[backup] done!",
+		Body:    "`ls` C:\\temp\n<ok> & *done*",
+	}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{
+			mode: modeMarkdown,
+			expected: "\\(1/1\\)\n" +
+				"*Time:* 2024\\-03\\-01 12:00:00 \\+0000 UTC\n" +
+				"*From:* cron\\_daemon <root@example\\.com\\>\n" +
+				"*To:* user@example\\.com\n" +
+				"*Subject:* \\[backup\\] done\\!\n" +
+				"```\n\\`ls\\` C:\\\\temp\n<ok> & *done*\n```",
+		},
+		{
+			mode: modeHTML,
+			expected: "(1/1)\n" +
+				"<b>Time:</b> 2024-03-01 12:00:00 +0000 UTC\n" +
+				"<b>From:</b> cron_daemon &lt;root@example.com&gt;\n" +
+				"<b>To:</b> user@example.com\n" +
+				"<b>Subject:</b> [backup] done!\n" +
+				"<pre>`ls` C:\\temp\n&lt;ok&gt; &amp; *done*</pre>",
+		},
+		{
+			mode: modePlain,
+			expected: "(1/1)\n" +
+				"Time: 2024-03-01 12:00:00 +0000 UTC\n" +
+				"From: cron_daemon <root@example.com>\n" +
+				"To: user@example.com\n" +
+				"Subject: [backup] done!\n" +
+				"`ls` C:\\temp\n<ok> & *done*",
+		},
+	}
+
+	for _, test := range tests {
+		chunks := formatMessage(test.mode, msg)
+		if len(chunks) != 1 || chunks[0] != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.mode, test.expected, chunks)
+		}
+	}
+}
+
+func TestFormatMessageSplit(t *testing.T) {
+	msg := common.Message{
+		Time:    time.Now(),
+		Subject: strings.Repeat("long subject ", 100),
+		Body:    strings.Repeat("line with emoji 👍 and `code`\n", 500),
+	}
+
+	// plain mode has no markup so the whole text is what Telegram counts
+	chunks := formatMessage(modePlain, msg)
+	if len(chunks) < 2 {
+		t.Fatalf("Expected message to be split, got %d chunks", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if length := common.UTF16.Length(chunk); length > 4096 {
+			t.Errorf("Chunk %d is %d long", i, length)
+		}
+		if i > 0 && strings.Contains(chunk, "Subject:") {
+			t.Errorf("Chunk %d repeats message fields", i)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for name, expected := range map[string]string{"": modeMarkdown, "markdownV2": modeMarkdown, "HTML": modeHTML, "plain": modePlain} {
+		if mode, err := parseMode(name); err != nil || mode != expected {
+			t.Errorf("%q: expected %q, got %q, %v", name, expected, mode, err)
+		}
+	}
+	if _, err := parseMode("bbcode"); err == nil {
+		t.Errorf("Unknown parse mode accepted")
+	}
+}
+
+func TestFormatMessageParts(t *testing.T) {
+	parts := []common.Part{
+		{Title: "1. Backup OK", Text: "From: root\n\nbacked up *42* files"},
+		{Title: "2. Logwatch", Text: strings.Repeat("line with emoji 👍\n", 400)},
+	}
+	msg := common.Message{
+		Time:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Subject: "Digest nightly: 2 messages",
+		Body:    "2 messages\n\n" + common.JoinParts(parts),
+		Parts:   parts,
+	}
+
+	chunks := formatMessage(modeMarkdown, msg)
+	if len(chunks) != 4 {
+		t.Fatalf("Expected header, short part and long part split in two, got %d: %q", len(chunks), chunks)
+	}
+	if !strings.HasSuffix(chunks[0], "```\n2 messages\n```") {
+		t.Errorf("Unexpected first chunk %q", chunks[0])
+	}
+	if chunks[1] != "\\(2/4\\)\n*1\\. Backup OK*\n**>From: root\n>\n>backed up \\*42\\* files||\n" {
+		t.Errorf("Unexpected second chunk %q", chunks[1])
+	}
+	if !strings.HasPrefix(chunks[2], "\\(3/4\\)\n*2\\. Logwatch \\(1/2\\)*\n**>line") || !strings.HasPrefix(chunks[3], "\\(4/4\\)\n*2\\. Logwatch \\(2/2\\)*\n**>") {
+		t.Errorf("Unexpected chunks of long part %q", chunks[2:])
+	}
+
+	// parts are collapsed only if they are what the body ends with
+	msg.Body = "changed"
+	if chunks := formatMessage(modeHTML, msg); len(chunks) != 1 || strings.Contains(chunks[0], "blockquote") {
+		t.Errorf("Changed body shown as parts: %q", chunks)
+	}
+	msg.Body = common.JoinParts(parts)
+	if chunks := formatMessage(modePlain, msg); strings.Contains(chunks[0], "||") {
+		t.Errorf("Parts of plain text message collapsed: %q", chunks)
+	}
+}
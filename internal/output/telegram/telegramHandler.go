@@ -1,88 +1,281 @@
 package telegram
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
-	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
-// SendTelegramMsg sends a message to Telegram communicator
+// Telegram Bot API limits of uploaded files
+const (
+	maxDocumentSize = 50 << 20
+	maxPhotoSize    = 10 << 20
+)
+
+// limit is the longest text of a message, Telegram counts UTF-16 code units
+// of up to 4096 long text after entities parsing so markdown and escaping
+// don't count, room is left for "(n/m)" numbering
+var limit = common.Limit{Size: 4096 - 16, Unit: common.UTF16}
+
+// uploadTimeout is time allowed for uploading a single attachment
+const uploadTimeout = 2 * time.Minute
+
+// Config is Telegram specific configuration
+//
+// ParseMode is formatting used for messages: MarkdownV2 (default), HTML or
+// plain. Template, if set, is Go text/template used to render messages
+// instead of the default message fields in bold followed by preformatted
+// body. ApiUrl allows to use own Bot API server instead of api.telegram.org.
+type Config struct {
+	Enabled     bool
+	UserId      int64                    `yaml:"userId"`
+	BotKey      string                   `yaml:"botKey"`
+	ApiUrl      string                   `yaml:"apiUrl,omitempty"`
+	ParseMode   string                   `yaml:"parseMode,omitempty"`
+	Template    string                   `yaml:"template,omitempty"`
+	Attachments output.AttachmentsConfig `yaml:"attachments,omitempty"`
+}
+
+// Telegram is the Telegram output channel
+type Telegram struct {
+	name string
+	conf Config
+	bot  *gotgbot.Bot
+	tmpl *format.Template
+	mode string
+}
+
+func init() {
+	output.Register("telegram", New, Config{
+		Enabled:   true,
+		UserId:    123456789,
+		BotKey:    "your_telegram_bot_api_key",
+		ParseMode: "MarkdownV2",
+		Attachments: output.AttachmentsConfig{
+			Enabled: true,
+			MaxSize: 20 << 20,
+			Skip:    []string{"*.exe", "*.bat"},
+		},
+	})
+}
+
+// New creates Telegram channel from its configuration
+func New(name string, conf *yaml.Node) (output.Channel, error) {
+	t := &Telegram{name: name}
+	if err := conf.Decode(&t.conf); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Name returns name of the channel
+func (t *Telegram) Name() string {
+	return t.name
+}
+
+// Init validates configuration and creates the bot
+func (t *Telegram) Init(ctx context.Context) (err error) {
+	if len(t.conf.BotKey) == 0 {
+		return errors.New("botKey not set")
+	}
+	if t.conf.UserId == 0 {
+		return errors.New("userId not set")
+	}
+	if len(t.conf.Template) != 0 {
+		if t.tmpl, err = format.NewTemplate(t.name, t.conf.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	if t.mode, err = parseMode(t.conf.ParseMode); err != nil {
+		return err
+	}
+	if err = t.conf.Attachments.Validate(); err != nil {
+		return err
+	}
+
+	// the token is checked by Validate so that an unreachable Bot API
+	// doesn't leave the channel out
+	opts := &gotgbot.BotOpts{DisableTokenCheck: true}
+	if len(t.conf.ApiUrl) != 0 {
+		opts.BotClient = &gotgbot.BaseBotClient{
+			DefaultRequestOpts: &gotgbot.RequestOpts{
+				Timeout: gotgbot.DefaultTimeout,
+				APIURL:  t.conf.ApiUrl,
+			},
+		}
+	}
+	t.bot, err = gotgbot.NewBot(t.conf.BotKey, opts)
+	if err != nil {
+		return fmt.Errorf("error creating new bot: %w", err)
+	}
+	return nil
+}
+
+// Validate checks the bot token by asking Telegram who the bot is (getMe)
+func (t *Telegram) Validate(ctx context.Context) error {
+	var opts *gotgbot.GetMeOpts
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = &gotgbot.GetMeOpts{RequestOpts: &gotgbot.RequestOpts{Timeout: time.Until(deadline)}}
+	}
+	me, err := t.bot.GetMe(opts)
+	if err != nil {
+		return fmt.Errorf("invalid bot token: %w", err)
+	}
+	t.bot.User = *me
+	return nil
+}
+
+// SendsSilently tells that silent messages are sent without notification
+func (t *Telegram) SendsSilently() bool {
+	return true
+}
+
+// Close does nothing, there is nothing to release
+func (t *Telegram) Close() error {
+	return nil
+}
+
+// Send sends a message to Telegram communicator
 //
-// This function takes 2 arguments, 'conf' being Telegram specific configuration
-// as defined in accompanying configuration file and the actual message to be sent 'msg'.
+// This function formats the message, splits it into chunks Telegram can
+// accept and sends them one by one to the configured user. Attachments, if
+// enabled, follow as documents or photos.
 //
 // Parameters:
 //
-// - conf (TelegramChannel): Telegram configuration struct
-// - msg (string): message to be sent
+// - ctx (context.Context): context
+// - newMessage (common.Message): message to be sent
 //
 // Returns:
 // - err (error): if any or nil
-func SendTelegramMsg(log *zap.SugaredLogger, conf common.TelegramChannel, newMessage common.Message) (err error) {
-	b, err := gotgbot.NewBot(conf.BotKey, nil)
+func (t *Telegram) Send(ctx context.Context, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	chunkedMsgs, err := t.render(newMessage)
 	if err != nil {
-		log.Errorf("Error creating new bot: %v", err)
 		return err
 	}
-
-	msgFmtd := formatTelegramMessage(log, newMessage)
-	// Telegram can take up to 4096 long message with all formating included
-	chunkedMsgs := common.Splitter(4050, msgFmtd)
-	totalMsgs := len(chunkedMsgs)
-	msgCount := 1
 	for chunkId, chunk := range chunkedMsgs {
-		if err != nil {
+		if err = ctx.Err(); err != nil {
 			return err
 		}
-		chunk = fmt.Sprintf("(%d/%d)\n%s", msgCount, totalMsgs, chunk)
-		_, err = b.SendMessage(conf.UserId, markdownMessage(chunk), &gotgbot.SendMessageOpts{
-			ParseMode: "MarkdownV2",
+		_, err = t.bot.SendMessage(t.conf.UserId, chunk, &gotgbot.SendMessageOpts{
+			ParseMode:           t.mode,
+			DisableNotification: newMessage.Silent,
 		})
 		if err != nil {
 			log.Errorf("Error sending Telegram message %d: %v", chunkId, err)
 			return err
 		}
-		msgCount++
+		metrics.ChunkSent(t.name)
+	}
+
+	if err = t.sendAttachments(ctx, newMessage.Attachments, newMessage.Silent); err != nil {
+		log.Errorf("Error sending Telegram attachment: %v", err)
+		return err
 	}
 
 	log.Infof("Telegram message sent")
 	return nil
 }
 
-// formatTelegramMessage formats message to Telegram communicator
+// sendAttachments uploads attachments selected by configuration
 //
-// This function parses the 'message' struct and formats a message that is to be sent to the Telegram
-//
-// Parameters:
-//
-// - msg (message): the 'message' struct
-//
-// Returns:
-//
-// - msgFmtd (string): a formatted message as a code block
-func formatTelegramMessage(log *zap.SugaredLogger, msg common.Message) (msgFmtd string) {
-	msgFmtd = fmt.Sprintf("Time: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s",
-		msg.Time, msg.From, msg.To, msg.Subject, msg.Body)
-
-	replacer := strings.NewReplacer(
-		"{", "\\{",
-		"}", "\\}",
-		"-", "\\-",
-		".", "\\.",
-		"+", "\\+",
-		"=", "\\=",
-	)
-
-	replacer.Replace(msgFmtd)
-
-	return msgFmtd
+// Images small enough are sent as photos so they are displayed in the chat,
+// everything else as documents. Attachments which were not sent are listed in
+// a final message. Silent attachments are sent without notification.
+func (t *Telegram) sendAttachments(ctx context.Context, attachments []common.Attachment, silent bool) (err error) {
+	send, skipped := t.conf.Attachments.Filter(attachments, maxDocumentSize)
+
+	requestOpts := &gotgbot.RequestOpts{Timeout: uploadTimeout}
+	if len(t.conf.ApiUrl) != 0 {
+		requestOpts.APIURL = t.conf.ApiUrl
+	}
+
+	for _, attachment := range send {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		file := gotgbot.NamedFile{
+			File:     bytes.NewReader(attachment.Data),
+			FileName: attachment.Filename,
+		}
+		if isPhoto(attachment) {
+			_, err = t.bot.SendPhoto(t.conf.UserId, file, &gotgbot.SendPhotoOpts{
+				Caption:             attachment.Filename,
+				DisableNotification: silent,
+				RequestOpts:         requestOpts,
+			})
+		} else {
+			_, err = t.bot.SendDocument(t.conf.UserId, file, &gotgbot.SendDocumentOpts{
+				DisableNotification: silent,
+				RequestOpts:         requestOpts,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", attachment.Filename, err)
+		}
+	}
+
+	if len(skipped) != 0 {
+		note := "Attachments not sent:\n" + strings.Join(skipped, "\n")
+		_, err = t.bot.SendMessage(t.conf.UserId, escape(t.mode, note), &gotgbot.SendMessageOpts{
+			ParseMode:           t.mode,
+			DisableNotification: silent,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func markdownMessage(message string) (msgFmtd string) {
-	msgFmtd = fmt.Sprintf("```\n%s\n```", message)
-	return msgFmtd
+// isPhoto tells if attachment can be sent as a photo
+func isPhoto(attachment common.Attachment) bool {
+	if len(attachment.Data) > maxPhotoSize {
+		return false
+	}
+	contentType := strings.ToLower(attachment.ContentType)
+	for _, photoType := range []string{"image/jpeg", "image/png", "image/webp"} {
+		if strings.HasPrefix(contentType, photoType) {
+			return true
+		}
+	}
+	return false
+}
+
+// render formats message and splits it into parts ready to be sent
+//
+// Without template message fields are sent in bold and the body as
+// preformatted text, each part numbered. With template the rendered text is
+// sent as it is, numbered only if it had to be split.
+func (t *Telegram) render(newMessage common.Message) (chunks []string, err error) {
+	if t.tmpl == nil {
+		return formatMessage(t.mode, newMessage), nil
+	}
+
+	msgFmtd, err := t.tmpl.Render(newMessage)
+	if err != nil {
+		return nil, fmt.Errorf("can't render template: %w", err)
+	}
+	chunkedMsgs := common.Splitter(limit, msgFmtd)
+	for chunkId, chunk := range chunkedMsgs {
+		if len(chunkedMsgs) > 1 {
+			chunk = fmt.Sprintf("(%d/%d)\n%s", chunkId+1, len(chunkedMsgs), chunk)
+		}
+		chunks = append(chunks, escape(t.mode, chunk))
+	}
+	return chunks, nil
 }
@@ -0,0 +1,208 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+type apiCall struct {
+	method   string
+	filename string
+	data     string
+	text     string
+	silent   bool
+}
+
+// mockApi pretends to be Telegram Bot API recording all calls
+func mockApi(t *testing.T) (*httptest.Server, func() []apiCall) {
+	var mu sync.Mutex
+	calls := []apiCall{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCall{method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("Can't parse upload: %v", err)
+			}
+			for _, files := range r.MultipartForm.File {
+				f, _ := files[0].Open()
+				data, _ := io.ReadAll(f)
+				call.filename, call.data = files[0].Filename, string(data)
+			}
+			call.silent = r.FormValue("disable_notification") == "true"
+		} else {
+			params := struct {
+				Text                string `json:"text"`
+				DisableNotification string `json:"disable_notification"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				t.Errorf("Can't decode parameters: %v", err)
+			}
+			call.text, call.silent = params.Text, params.DisableNotification == "true"
+		}
+
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "invalid"):
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"ok":false,"error_code":401,"description":"Unauthorized"}`)
+		case call.method == "getMe":
+			io.WriteString(w, `{"ok":true,"result":{"id":123,"is_bot":true,"first_name":"relay","username":"relay_bot"}}`)
+		default:
+			io.WriteString(w, `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1,"type":"private"}}}`)
+		}
+	}))
+
+	return server, func() []apiCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func TestSendAttachments(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	telegram := &Telegram{name: "telegram", conf: Config{
+		Enabled: true,
+		UserId:  1,
+		BotKey:  "123:abc",
+		ApiUrl:  server.URL,
+		Attachments: output.AttachmentsConfig{
+			Enabled: true,
+			Skip:    []string{"*.exe"},
+		},
+	}}
+	if err := telegram.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	testMsg := common.Message{
+		Time:    time.Now(),
+		From:    "cron@example.com",
+		To:      "user@example.com",
+		Subject: "report",
+		Body:    "see attached",
+		Attachments: []common.Attachment{
+			{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n1,2\n")},
+			{Filename: "chart.png", ContentType: "image/png", Data: []byte("png")},
+			{Filename: "setup.exe", ContentType: "application/octet-stream", Data: []byte("MZ")},
+		},
+	}
+	if err := telegram.Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	expected := []apiCall{
+		{method: "sendMessage"},
+		{method: "sendDocument", filename: "report.csv", data: "a,b\n1,2\n"},
+		{method: "sendPhoto", filename: "chart.png", data: "png"},
+		{method: "sendMessage"},
+	}
+	received := calls()
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d API calls, got %+v", len(expected), received)
+	}
+	for i, call := range received {
+		if call.method != expected[i].method || call.filename != expected[i].filename || call.data != expected[i].data {
+			t.Errorf("Call %d: expected %+v, got %+v", i, expected[i], call)
+		}
+	}
+	if !strings.Contains(received[3].text, "setup\\.exe") {
+		t.Errorf("Skipped attachment not reported: %q", received[3].text)
+	}
+}
+
+func TestSendSilent(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, calls := mockApi(t)
+	defer server.Close()
+
+	telegram := &Telegram{name: "telegram", conf: Config{
+		Enabled:     true,
+		UserId:      1,
+		BotKey:      "123:abc",
+		ApiUrl:      server.URL,
+		Attachments: output.AttachmentsConfig{Enabled: true},
+	}}
+	if err := telegram.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	testMsg := common.Message{
+		Time:        time.Now(),
+		Subject:     "nightly report",
+		Body:        "all good",
+		Attachments: []common.Attachment{{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n")}},
+	}
+	for _, silent := range []bool{false, true} {
+		testMsg.Silent = silent
+		if err := telegram.Send(ctx, testMsg); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	received := calls()
+	if len(received) != 4 {
+		t.Fatalf("Expected 4 API calls, got %+v", received)
+	}
+	for i, call := range received {
+		if expected := i >= 2; call.silent != expected {
+			t.Errorf("Call %d (%s): expected disable_notification %v", i, call.method, expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	server, _ := mockApi(t)
+	defer server.Close()
+
+	for _, test := range []struct {
+		botKey string
+		valid  bool
+	}{
+		{"123:abc", true},
+		{"123:invalid", false},
+	} {
+		telegram := &Telegram{name: "telegram", conf: Config{Enabled: true, UserId: 1, BotKey: test.botKey, ApiUrl: server.URL}}
+		if err := telegram.Init(ctx); err != nil {
+			t.Fatalf("Can't initialise channel: %v", err)
+		}
+		err := telegram.Validate(ctx)
+		if test.valid != (err == nil) {
+			t.Errorf("%s: expected valid %t, got %v", test.botKey, test.valid, err)
+		}
+		if test.valid && telegram.bot.Username != "relay_bot" {
+			t.Errorf("%s: bot user not set: %+v", test.botKey, telegram.bot.User)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/format"
+	"smtp2communicator/internal/metrics"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultApiUrl = "https://graph.facebook.com/v19.0"
+	// error code returned when the 24h customer service window is closed
+	reEngagementErrorCode = 131047
+)
+
+// limit is the longest text of a message, WhatsApp allows up to 4096
+// characters, room is left for "(n/m)" numbering
+var limit = common.Limit{Size: 4096 - 16, Unit: common.Runes}
+
+// Template is WhatsApp message template used outside of the 24h session window
+//
+// Parameters lists message fields, in order, that are filled into the
+// template body placeholders, one of: time, from, to, subject, body.
+type Template struct {
+	Name       string
+	Language   string
+	Parameters []string
+}
+
+// Config is WhatsApp specific configuration
+//
+// TextTemplate, if set, is Go text/template used to render text messages
+// instead of the default message fields followed by the body; it's not
+// named template as that's the approved WhatsApp template.
+//
+// UseTemplate is one of: 'auto' (send text and fall back to the template if
+// the session window is closed), 'always' or 'never'.
+//
+// The fallback of 'auto' works only when the Cloud API rejects the text
+// message right away with error 131047. The API may as well accept the
+// message and report its failure later in a status webhook, which this
+// channel doesn't receive, and then the message is lost without notice. Use
+// 'always' for recipients who don't write to the business number
+// regularly.
+type Config struct {
+	Enabled       bool
+	ApiUrl        string   `yaml:"apiUrl,omitempty"`
+	PhoneNumberId string   `yaml:"phoneNumberId"`
+	AccessToken   string   `yaml:"accessToken"`
+	Recipients    []string `yaml:"recipients"`
+	UseTemplate   string   `yaml:"useTemplate"`
+	Template      Template
+	TextTemplate  string `yaml:"textTemplate,omitempty"`
+}
+
+// WhatsApp is the WhatsApp Business Cloud API output channel
+type WhatsApp struct {
+	name   string
+	conf   Config
+	client *http.Client
+	tmpl   *format.Template
+}
+
+// apiError is error reported by the Cloud API
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    int    `json:"code"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%s, code %d)", e.Message, e.Type, e.Code)
+}
+
+func init() {
+	output.Register("whatsapp", New, Config{
+		Enabled:       false,
+		PhoneNumberId: "your_phone_number_id",
+		AccessToken:   "your_whatsapp_access_token",
+		Recipients:    []string{"48123456789"},
+		UseTemplate:   "auto",
+		Template: Template{
+			Name:       "new_mail",
+			Language:   "en_US",
+			Parameters: []string{"subject", "from", "body"},
+		},
+	})
+}
+
+// New creates WhatsApp channel from its configuration
+func New(name string, conf *yaml.Node) (output.Channel, error) {
+	w := &WhatsApp{name: name}
+	if err := conf.Decode(&w.conf); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Name returns name of the channel
+func (w *WhatsApp) Name() string {
+	return w.name
+}
+
+// Init validates configuration and creates HTTP client
+func (w *WhatsApp) Init(ctx context.Context) (err error) {
+	if len(w.conf.PhoneNumberId) == 0 {
+		return errors.New("phoneNumberId not set")
+	}
+	if len(w.conf.AccessToken) == 0 {
+		return errors.New("accessToken not set")
+	}
+	if len(w.conf.Recipients) == 0 {
+		return errors.New("recipients not set")
+	}
+	if len(w.conf.ApiUrl) == 0 {
+		w.conf.ApiUrl = defaultApiUrl
+	}
+	w.conf.ApiUrl = strings.TrimSuffix(w.conf.ApiUrl, "/")
+
+	switch w.conf.UseTemplate {
+	case "":
+		w.conf.UseTemplate = "auto"
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("useTemplate must be one of auto, always, never, got '%s'", w.conf.UseTemplate)
+	}
+	if w.conf.UseTemplate != "never" && len(w.conf.Template.Name) == 0 {
+		return errors.New("template name not set")
+	}
+	if len(w.conf.Template.Language) == 0 {
+		w.conf.Template.Language = "en_US"
+	}
+	for _, param := range w.conf.Template.Parameters {
+		if _, err := messageField(common.Message{}, param); err != nil {
+			return err
+		}
+	}
+	if len(w.conf.TextTemplate) != 0 {
+		if w.tmpl, err = format.NewTemplate(w.name, w.conf.TextTemplate); err != nil {
+			return fmt.Errorf("invalid textTemplate: %w", err)
+		}
+	}
+
+	w.client = &http.Client{Timeout: 30 * time.Second}
+	return nil
+}
+
+// Close does nothing, there is nothing to release
+func (w *WhatsApp) Close() error {
+	return nil
+}
+
+// Send sends a message to all configured WhatsApp recipients
+//
+// This function sends the message as text split into chunks. If the 24h
+// session window with a recipient is closed (or templates are to be used
+// always) then the configured template is sent instead. Recipients the
+// message was delivered to by earlier attempts are skipped.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - newMessage (common.Message): message to be sent
+//
+// Returns:
+// - err (error): if any or nil, output.RecipientsError if the message was delivered to some recipients only
+func (w *WhatsApp) Send(ctx context.Context, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	var errs []error
+	var delivered []string
+	for _, recipient := range w.conf.Recipients {
+		if slices.Contains(newMessage.DeliveredTo, recipient) {
+			log.Debugf("WhatsApp message already delivered to %s, skipping", recipient)
+			continue
+		}
+		if err = w.sendTo(ctx, recipient, newMessage); err != nil {
+			log.Errorf("Error sending WhatsApp message to %s: %v", recipient, err)
+			errs = append(errs, err)
+			continue
+		}
+		delivered = append(delivered, recipient)
+	}
+	if len(errs) > 0 {
+		if len(delivered) > 0 {
+			return &output.RecipientsError{Delivered: delivered, Err: errors.Join(errs...)}
+		}
+		return errors.Join(errs...)
+	}
+
+	log.Infof("WhatsApp message sent")
+	return nil
+}
+
+// sendTo sends a message to a single recipient
+func (w *WhatsApp) sendTo(ctx context.Context, recipient string, newMessage common.Message) (err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	if w.conf.UseTemplate == "always" {
+		return w.post(ctx, w.templatePayload(recipient, newMessage))
+	}
+
+	msgFmtd, err := w.render(newMessage)
+	if err != nil {
+		return err
+	}
+	chunkedMsgs := common.Splitter(limit, msgFmtd)
+	totalMsgs := len(chunkedMsgs)
+	for chunkId, chunk := range chunkedMsgs {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// rendered template is numbered only if it had to be split
+		if w.tmpl == nil || totalMsgs > 1 {
+			chunk = fmt.Sprintf("(%d/%d)\n%s", chunkId+1, totalMsgs, chunk)
+		}
+
+		err = w.post(ctx, textPayload(recipient, chunk))
+
+		var apiErr *apiError
+		// only synchronous rejection is seen here, failures reported later
+		// by webhook aren't, see Config
+		if chunkId == 0 && w.conf.UseTemplate == "auto" && errors.As(err, &apiErr) && apiErr.Code == reEngagementErrorCode {
+			log.Debugf("session window with %s closed, sending template", recipient)
+			return w.post(ctx, w.templatePayload(recipient, newMessage))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render formats text message with template if configured or with all its
+// fields
+func (w *WhatsApp) render(newMessage common.Message) (msgFmtd string, err error) {
+	if w.tmpl == nil {
+		return fmt.Sprintf("Time: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s",
+			newMessage.Time, newMessage.From, newMessage.To, newMessage.Subject, newMessage.Body), nil
+	}
+
+	msgFmtd, err = w.tmpl.Render(newMessage)
+	if err != nil {
+		return "", fmt.Errorf("can't render template: %w", err)
+	}
+	return msgFmtd, nil
+}
+
+// post sends a single payload to the messages endpoint
+func (w *WhatsApp) post(ctx context.Context, payload map[string]any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/%s/messages", w.conf.ApiUrl, w.conf.PhoneNumberId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+w.conf.AccessToken)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		result := struct {
+			Error *apiError `json:"error"`
+		}{}
+		if json.Unmarshal(body, &result) == nil && result.Error != nil {
+			return result.Error
+		}
+		return fmt.Errorf("unexpected response status %s: %s", resp.Status, body)
+	}
+	metrics.ChunkSent(w.name)
+	return nil
+}
+
+// textPayload builds free form text message
+func textPayload(recipient, text string) map[string]any {
+	return map[string]any{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                recipient,
+		"type":              "text",
+		"text": map[string]any{
+			"preview_url": false,
+			"body":        text,
+		},
+	}
+}
+
+// templatePayload builds template message with message fields as parameters
+func (w *WhatsApp) templatePayload(recipient string, msg common.Message) map[string]any {
+	template := map[string]any{
+		"name":     w.conf.Template.Name,
+		"language": map[string]string{"code": w.conf.Template.Language},
+	}
+
+	if len(w.conf.Template.Parameters) > 0 {
+		parameters := []map[string]string{}
+		for _, param := range w.conf.Template.Parameters {
+			value, _ := messageField(msg, param)
+			parameters = append(parameters, map[string]string{
+				"type": "text",
+				"text": templateText(value),
+			})
+		}
+		template["components"] = []map[string]any{
+			{"type": "body", "parameters": parameters},
+		}
+	}
+
+	return map[string]any{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                recipient,
+		"type":              "template",
+		"template":          template,
+	}
+}
+
+// messageField returns value of a message field by its name
+func messageField(msg common.Message, name string) (value string, err error) {
+	switch name {
+	case "time":
+		return msg.Time.String(), nil
+	case "from":
+		return msg.From, nil
+	case "to":
+		return msg.To, nil
+	case "subject":
+		return msg.Subject, nil
+	case "body":
+		return msg.Body, nil
+	}
+	return "", fmt.Errorf("unknown template parameter '%s'", name)
+}
+
+// templateText makes text acceptable as template parameter
+//
+// Template parameters can't contain new lines, tabs or more than 4
+// consecutive spaces and are limited in length.
+func templateText(text string) string {
+	text = format.Truncate(1000, format.OneLine(text))
+	if len(text) == 0 {
+		// empty parameters are rejected
+		return "-"
+	}
+	return text
+}
@@ -0,0 +1,200 @@
+package whatsapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/output"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+// mockApi is a minimal stand-in for the Cloud API messages endpoint
+//
+// Recipients listed in closedWindow get re-engagement error for text messages.
+func mockApi(t *testing.T, closedWindow map[string]bool, received *[]map[string]any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/12345/messages" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected authorization: %s", r.Header.Get("Authorization"))
+		}
+
+		payload := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Can't decode payload: %v", err)
+		}
+		*received = append(*received, payload)
+
+		if payload["type"] == "text" && closedWindow[payload["to"].(string)] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Re-engagement message","type":"OAuthException","code":131047}}`))
+			return
+		}
+		w.Write([]byte(`{"messaging_product":"whatsapp","messages":[{"id":"wamid.1"}]}`))
+	}))
+}
+
+func TestSend(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	received := []map[string]any{}
+	server := mockApi(t, map[string]bool{"222": true}, &received)
+	defer server.Close()
+
+	w := &WhatsApp{conf: Config{
+		Enabled:       true,
+		ApiUrl:        server.URL,
+		PhoneNumberId: "12345",
+		AccessToken:   "token",
+		Recipients:    []string{"111", "222"},
+		Template: Template{
+			Name:       "new_mail",
+			Parameters: []string{"subject", "body"},
+		},
+	}}
+	if err := w.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	testMsg := common.Message{
+		Time:    time.Now(),
+		From:    "cron@example.com",
+		To:      "user@example.com",
+		Subject: "hello test",
+		Body:    "line 1\nline 2",
+	}
+	if err := w.Send(ctx, testMsg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// text to 111, rejected text to 222 and template to 222
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(received))
+	}
+	if received[0]["to"] != "111" || received[0]["type"] != "text" {
+		t.Fatalf("Expected text message to 111, got %v", received[0])
+	}
+	if received[2]["to"] != "222" || received[2]["type"] != "template" {
+		t.Fatalf("Expected template message to 222, got %v", received[2])
+	}
+
+	template := received[2]["template"].(map[string]any)
+	parameters := template["components"].([]any)[0].(map[string]any)["parameters"].([]any)
+	if text := parameters[1].(map[string]any)["text"]; text != "line 1 line 2" {
+		t.Fatalf("Unexpected template body parameter: '%v'", text)
+	}
+}
+
+func TestSendPartial(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	received := []map[string]any{}
+	server := mockApi(t, map[string]bool{"222": true}, &received)
+	defer server.Close()
+
+	w := &WhatsApp{conf: Config{
+		Enabled:       true,
+		ApiUrl:        server.URL,
+		PhoneNumberId: "12345",
+		AccessToken:   "token",
+		Recipients:    []string{"111", "222"},
+		UseTemplate:   "never",
+	}}
+	if err := w.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+
+	testMsg := common.Message{Time: time.Now(), Subject: "hello test", Body: "body"}
+	err := w.Send(ctx, testMsg)
+	var partial *output.RecipientsError
+	if !errors.As(err, &partial) || !reflect.DeepEqual(partial.Delivered, []string{"111"}) {
+		t.Fatalf("Expected delivery to 111 only, got %v", err)
+	}
+
+	// retry skips the recipient the message was delivered to
+	received = received[:0]
+	testMsg.DeliveredTo = partial.Delivered
+	if err = w.Send(ctx, testMsg); err == nil || errors.As(err, &partial) {
+		t.Fatalf("Expected failed delivery to 222, got %v", err)
+	}
+	if len(received) != 1 || received[0]["to"] != "222" {
+		t.Fatalf("Expected retry to 222 only, got %v", received)
+	}
+}
+
+func TestSendTextTemplate(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	received := []map[string]any{}
+	server := mockApi(t, nil, &received)
+	defer server.Close()
+
+	w := &WhatsApp{conf: Config{
+		Enabled:       true,
+		ApiUrl:        server.URL,
+		PhoneNumberId: "12345",
+		AccessToken:   "token",
+		Recipients:    []string{"111"},
+		UseTemplate:   "never",
+		TextTemplate:  `*{{ .Subject }}* {{ .Body | firstLine }}`,
+	}}
+	if err := w.Init(ctx); err != nil {
+		t.Fatalf("Can't initialise channel: %v", err)
+	}
+	if err := w.Send(ctx, common.Message{Subject: "disk full", Body: "sda1 at 99%\nmore"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(received))
+	}
+	if text := received[0]["text"].(map[string]any)["body"]; text != "*disk full* sda1 at 99%" {
+		t.Fatalf("Unexpected text: %q", text)
+	}
+}
+
+func TestInitValidation(t *testing.T) {
+	w := &WhatsApp{conf: Config{
+		PhoneNumberId: "12345",
+		AccessToken:   "token",
+		Recipients:    []string{"111"},
+		UseTemplate:   "auto",
+		Template:      Template{Name: "new_mail", Parameters: []string{"unknown"}},
+	}}
+	if err := w.Init(context.Background()); err == nil {
+		t.Fatalf("Expected error for unknown template parameter")
+	}
+}
+
+func TestTemplateText(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"disk\tfull\n\n     on sda1", "disk full on sda1"},
+		{" \n", "-"},
+		{strings.Repeat("é", 1001), strings.Repeat("é", 999) + "…"},
+	}
+	for _, test := range tests {
+		if text := templateText(test.text); text != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, text)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package quiet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+)
+
+// Action is what happens to a message delivered during quiet hours
+type Action int
+
+const (
+	// None means the message is delivered as usual
+	None Action = iota
+	// Silent means the message is delivered without notification
+	Silent
+	// Defer means the message is delivered once quiet hours end
+	Defer
+	// Drop means the message is not delivered at all
+	Drop
+)
+
+// actions are configuration names of actions
+var actions = map[string]Action{
+	"":       Defer,
+	"defer":  Defer,
+	"silent": Silent,
+	"drop":   Drop,
+}
+
+// String returns configuration name of the action
+func (a Action) String() string {
+	switch a {
+	case Silent:
+		return "silent"
+	case Defer:
+		return "defer"
+	case Drop:
+		return "drop"
+	default:
+		return "none"
+	}
+}
+
+// weekdays are day names accepted in configuration
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// QuietHours decides what happens to messages delivered to channels during
+// their quiet hours
+type QuietHours struct {
+	windows []window
+}
+
+// window is compiled common.QuietHours
+type window struct {
+	name     string
+	channels map[string]bool
+	// days has bits of days of week the window starts on set
+	days uint8
+	// from and to are minutes since midnight
+	from, to int
+	location *time.Location
+	action   Action
+}
+
+// New compiles quiet hours configuration
+//
+// Channels which are not among known (enabled) channels are dropped with
+// a warning. Silent action is accepted only for channels able to deliver
+// messages without notification, others would notify anyway.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - conf ([]common.QuietHours): quiet hours configuration
+// - channels ([]string): names of known channels
+// - silent ([]string): names of known channels able to deliver messages silently
+//
+// Returns:
+//
+// - q (*QuietHours): quiet hours
+// - err (error): error if any or nil
+func New(ctx context.Context, conf []common.QuietHours, channels []string, silent []string) (q *QuietHours, err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	known := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		known[channel] = true
+	}
+	silencing := make(map[string]bool, len(silent))
+	for _, channel := range silent {
+		silencing[channel] = true
+	}
+
+	q = &QuietHours{}
+	for i, c := range conf {
+		name := c.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("quiet hours %d", i+1)
+		}
+
+		w := window{
+			name:     name,
+			channels: map[string]bool{},
+			location: time.Local,
+		}
+		for _, channel := range c.Channels {
+			if !known[channel] {
+				log.Warnf("%s: unknown or disabled channel '%s', ignoring it", name, channel)
+				continue
+			}
+			w.channels[channel] = true
+		}
+
+		if w.days, err = parseDays(c.Days); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if w.from, err = parseTime(c.From); err != nil {
+			return nil, fmt.Errorf("%s: from: %w", name, err)
+		}
+		if w.to, err = parseTime(c.To); err != nil {
+			return nil, fmt.Errorf("%s: to: %w", name, err)
+		}
+		if len(c.TimeZone) != 0 {
+			if w.location, err = time.LoadLocation(c.TimeZone); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		action, ok := actions[strings.ToLower(c.Action)]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown action %q, use defer, silent or drop", name, c.Action)
+		}
+		w.action = action
+		if action == Silent {
+			for channel := range w.channels {
+				if !silencing[channel] {
+					return nil, fmt.Errorf("%s: channel '%s' can't deliver messages silently, use defer or drop", name, channel)
+				}
+			}
+		}
+
+		q.windows = append(q.windows, w)
+	}
+	return q, nil
+}
+
+// Defers tells if messages to any channel may be deferred
+func (q *QuietHours) Defers() bool {
+	if q == nil {
+		return false
+	}
+	for _, w := range q.windows {
+		if w.action == Defer && len(w.channels) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns what to do with a message delivered to a channel now
+//
+// If several quiet hours of the channel are in effect the most restrictive
+// action is taken. Urgent messages are always delivered. Nil QuietHours
+// never keeps a message from being delivered.
+//
+// Parameters:
+//
+// - channel (string): name of the channel
+// - msg (common.Message): message to deliver
+// - now (time.Time): time of delivery
+//
+// Returns:
+//
+// - action (Action): what to do with the message
+// - until (time.Time): when quiet hours that decided the action end
+func (q *QuietHours) Check(channel string, msg common.Message, now time.Time) (action Action, until time.Time) {
+	if q == nil || msg.Urgent {
+		return None, time.Time{}
+	}
+
+	for _, w := range q.windows {
+		if !w.channels[channel] {
+			continue
+		}
+		end, ok := w.active(now)
+		if !ok {
+			continue
+		}
+		if w.action > action || w.action == action && end.After(until) {
+			action, until = w.action, end
+		}
+	}
+	return action, until
+}
+
+// active tells if the window is in effect at given time and when it ends
+func (w *window) active(now time.Time) (end time.Time, ok bool) {
+	t := now.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<t.Weekday()) != 0
+	yesterday := w.days&(1<<((t.Weekday()+6)%7)) != 0
+
+	at := func(days int, minutes int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+days, 0, minutes, 0, 0, w.location)
+	}
+
+	if w.from < w.to {
+		// within a single day
+		return at(0, w.to), today && minute >= w.from && minute < w.to
+	}
+
+	// spanning midnight, or whole day if from and to are the same
+	if today && minute >= w.from {
+		return at(1, w.to), true
+	}
+	if yesterday && minute < w.to {
+		return at(0, w.to), true
+	}
+	return time.Time{}, false
+}
+
+// parseDays returns bit set of listed days of week, all days if none listed
+func parseDays(days []string) (bits uint8, err error) {
+	if len(days) == 0 {
+		return 0x7f, nil
+	}
+
+	for _, day := range days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		first, last, isRange := strings.Cut(day, "-")
+		if !isRange {
+			last = first
+		}
+		from, ok := weekdays[first]
+		if !ok {
+			return 0, fmt.Errorf("unknown day %q", day)
+		}
+		to, ok := weekdays[last]
+		if !ok {
+			return 0, fmt.Errorf("unknown day %q", day)
+		}
+
+		// ranges may wrap, e.g. fri-mon
+		for d := from; ; d = (d + 1) % 7 {
+			bits |= 1 << d
+			if d == to {
+				break
+			}
+		}
+	}
+	return bits, nil
+}
+
+// parseTime returns minutes since midnight of time of day in 15:04 format
+func parseTime(value string) (minutes int, err error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,113 @@
+package quiet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf := []common.QuietHours{
+		{
+			Name:     "night",
+			Channels: []string{"telegram", "whatsapp"},
+			From:     "22:00",
+			To:       "07:00",
+			TimeZone: "Europe/Warsaw",
+		},
+		{
+			Name:     "weekend",
+			Channels: []string{"telegram", "slack"},
+			Days:     []string{"sat-sun"},
+			From:     "00:00",
+			To:       "00:00",
+			TimeZone: "Europe/Warsaw",
+			Action:   "silent",
+		},
+		{
+			Name:     "lunch",
+			Channels: []string{"slack"},
+			Days:     []string{"mon-fri"},
+			From:     "12:00",
+			To:       "13:00",
+			TimeZone: "Europe/Warsaw",
+			Action:   "drop",
+		},
+	}
+	// whatsapp is not enabled so it's dropped from quiet hours
+	q, err := New(ctx, conf, []string{"telegram", "slack"}, []string{"telegram", "slack"})
+	if err != nil {
+		t.Fatalf("Can't create quiet hours: %v", err)
+	}
+	if !q.Defers() {
+		t.Fatalf("Quiet hours with defer action not reported")
+	}
+
+	warsaw, _ := time.LoadLocation("Europe/Warsaw")
+	at := func(day, hour, minute int) time.Time {
+		// 2024-03-04 is Monday
+		return time.Date(2024, 3, day, hour, minute, 0, 0, warsaw)
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		now     time.Time
+		urgent  bool
+		action  Action
+		until   time.Time
+	}{
+		{"day", "telegram", at(4, 10, 0), false, None, time.Time{}},
+		{"late evening", "telegram", at(4, 22, 0), false, Defer, at(5, 7, 0)},
+		{"early morning", "telegram", at(5, 6, 59), false, Defer, at(5, 7, 0)},
+		{"morning", "telegram", at(5, 7, 0), false, None, time.Time{}},
+		{"urgent", "telegram", at(4, 23, 0), true, None, time.Time{}},
+		{"other channel", "slack", at(4, 23, 0), false, None, time.Time{}},
+		{"not enabled channel", "whatsapp", at(4, 23, 0), false, None, time.Time{}},
+		{"drop", "slack", at(4, 12, 30), false, Drop, at(4, 13, 0)},
+		{"weekend", "slack", at(9, 12, 30), false, Silent, at(10, 0, 0)},
+		{"most restrictive", "telegram", at(9, 12, 30), false, Silent, at(10, 0, 0)},
+		{"most restrictive at night", "telegram", at(9, 23, 0), false, Defer, at(10, 7, 0)},
+		{"other time zone", "telegram", time.Date(2024, 3, 4, 21, 30, 0, 0, time.UTC), false, Defer, at(5, 7, 0)},
+	}
+	for _, test := range tests {
+		action, until := q.Check(test.channel, common.Message{Urgent: test.urgent}, test.now)
+		if action != test.action || !until.Equal(test.until) {
+			t.Errorf("%s: expected %s until %s, got %s until %s", test.name, test.action, test.until, action, until)
+		}
+	}
+
+	var none *QuietHours
+	if action, _ := none.Check("telegram", common.Message{}, at(4, 23, 0)); action != None || none.Defers() {
+		t.Errorf("Nil quiet hours keep messages from being delivered")
+	}
+}
+
+func TestInvalidQuietHours(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	invalid := []common.QuietHours{
+		{From: "22:00", To: "7am"},
+		{From: "25:00", To: "07:00"},
+		{From: "22:00", To: "07:00", Days: []string{"someday"}},
+		{From: "22:00", To: "07:00", TimeZone: "Mars/Olympus"},
+		{From: "22:00", To: "07:00", Action: "mute"},
+		{From: "22:00", To: "07:00", Action: "silent", Channels: []string{"telegram", "slack"}},
+	}
+	for _, conf := range invalid {
+		if _, err := New(ctx, []common.QuietHours{conf}, []string{"telegram", "slack"}, []string{"telegram"}); err == nil {
+			t.Errorf("Invalid quiet hours accepted: %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+)
+
+// regexPrefix marks a pattern as regular expression, other patterns are globs
+const regexPrefix = "re:"
+
+// Router decides which channels a message is sent to
+type Router struct {
+	routes       []route
+	defaultRoute []string
+}
+
+// route is compiled common.Route
+type route struct {
+	name     string
+	from     *regexp.Regexp
+	to       *regexp.Regexp
+	subject  *regexp.Regexp
+	headers  map[string]*regexp.Regexp
+	channels []string
+	stop     bool
+	urgent   bool
+	digest   *common.RouteDigest
+}
+
+// New creates router from routing configuration
+//
+// This function compiles all patterns of the routes. Channels of routes and
+// the default route which are not among known (enabled) channels are
+// dropped with a warning. If there is no default route then messages not
+// matched by any route are sent to all channels.
+//
+// Parameters:
+//
+// - ctx (context.Context): context
+// - routes ([]common.Route): routes in order of evaluation
+// - defaultRoute ([]string): channels for messages not matched by any route
+// - channels ([]string): names of known channels
+//
+// Returns:
+//
+// - router (*Router): router
+// - err (error): error if any or nil
+func New(ctx context.Context, routes []common.Route, defaultRoute []string, channels []string) (router *Router, err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	known := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		known[channel] = true
+	}
+	knownOnly := func(where string, names []string) (result []string) {
+		result = []string{}
+		for _, name := range names {
+			if !known[name] {
+				log.Warnf("%s: unknown or disabled channel '%s', ignoring it", where, name)
+				continue
+			}
+			result = append(result, name)
+		}
+		return
+	}
+
+	router = &Router{}
+	digests := map[string]bool{}
+
+	if defaultRoute == nil {
+		router.defaultRoute = append([]string{}, channels...)
+	} else {
+		router.defaultRoute = knownOnly("defaultRoute", defaultRoute)
+	}
+
+	for i, r := range routes {
+		name := r.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("route %d", i+1)
+		}
+
+		compiled := route{
+			name:     name,
+			channels: knownOnly(name, r.Channels),
+			stop:     r.Stop,
+			urgent:   r.Urgent,
+			headers:  map[string]*regexp.Regexp{},
+			digest:   r.Digest,
+		}
+		if r.Digest != nil {
+			// digests are kept under route names
+			if digests[name] {
+				return nil, fmt.Errorf("%s: name of route with digest is not unique", name)
+			}
+			digests[name] = true
+		}
+		if compiled.from, err = compile(r.Match.From); err != nil {
+			return nil, fmt.Errorf("%s: from: %w", name, err)
+		}
+		if compiled.to, err = compile(r.Match.To); err != nil {
+			return nil, fmt.Errorf("%s: to: %w", name, err)
+		}
+		if compiled.subject, err = compile(r.Match.Subject); err != nil {
+			return nil, fmt.Errorf("%s: subject: %w", name, err)
+		}
+		for header, pattern := range r.Match.Headers {
+			if compiled.headers[textproto.CanonicalMIMEHeaderKey(header)], err = compile(pattern); err != nil {
+				return nil, fmt.Errorf("%s: header %s: %w", name, header, err)
+			}
+		}
+
+		router.routes = append(router.routes, compiled)
+	}
+
+	return router, nil
+}
+
+// Route returns names of channels the message is to be sent to right away
+//
+// Routes are evaluated in order and channels of all matching routes are
+// collected until a matching route with 'stop' set. If no route matched
+// then channels of the default route are returned. Channels of matching
+// routes with digest are not returned, see Digests.
+//
+// Parameters:
+//
+// - msg (common.Message): message to route
+//
+// Returns:
+//
+// - channels ([]string): sorted names of channels
+func (r *Router) Route(msg common.Message) (channels []string) {
+	selected := map[string]bool{}
+
+	routes := r.matching(msg)
+	for _, route := range routes {
+		if route.digest != nil {
+			continue
+		}
+		for _, channel := range route.channels {
+			selected[channel] = true
+		}
+	}
+
+	if len(routes) == 0 {
+		for _, channel := range r.defaultRoute {
+			selected[channel] = true
+		}
+	}
+
+	for channel := range selected {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return
+}
+
+// Digests returns names of matching routes with digest
+//
+// Routes are evaluated the same way as by Route.
+//
+// Parameters:
+//
+// - msg (common.Message): message to route
+//
+// Returns:
+//
+// - digests ([]string): names of routes the message is to be collected by
+func (r *Router) Digests(msg common.Message) (digests []string) {
+	for _, route := range r.matching(msg) {
+		if route.digest != nil {
+			digests = append(digests, route.name)
+		}
+	}
+	return
+}
+
+// Urgent tells if the message is matched by a route marked urgent
+//
+// Routes are evaluated the same way as by Route.
+func (r *Router) Urgent(msg common.Message) bool {
+	for _, route := range r.matching(msg) {
+		if route.urgent {
+			return true
+		}
+	}
+	return false
+}
+
+// DigestRoutes returns digest configuration of all routes with digest keyed
+// by route name
+func (r *Router) DigestRoutes() map[string]common.RouteDigest {
+	digests := map[string]common.RouteDigest{}
+	for _, route := range r.routes {
+		if route.digest != nil {
+			digests[route.name] = *route.digest
+		}
+	}
+	return digests
+}
+
+// DigestChannels returns names of channels of the route with digest
+func (r *Router) DigestChannels(name string) []string {
+	for _, route := range r.routes {
+		if route.digest != nil && route.name == name {
+			return route.channels
+		}
+	}
+	return nil
+}
+
+// RouteChannels returns names of channels of the route with given name
+func (r *Router) RouteChannels(name string) (channels []string, ok bool) {
+	for _, route := range r.routes {
+		if route.name == name {
+			return route.channels, true
+		}
+	}
+	return nil, false
+}
+
+// matching returns routes matching the message
+//
+// Routes are evaluated in order until a matching route with 'stop' set.
+func (r *Router) matching(msg common.Message) (routes []*route) {
+	for i := range r.routes {
+		route := &r.routes[i]
+		if !route.matches(msg) {
+			continue
+		}
+		routes = append(routes, route)
+		if route.stop {
+			break
+		}
+	}
+	return
+}
+
+// matches returns true if all conditions of the route match the message
+func (r *route) matches(msg common.Message) bool {
+	if r.from != nil && !matchAddresses(r.from, msg.From) {
+		return false
+	}
+	if r.to != nil && !matchAddresses(r.to, msg.To) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(msg.Subject) {
+		return false
+	}
+	for header, pattern := range r.headers {
+		value, ok := msg.Headers[header]
+		if !ok || !pattern.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAddresses matches pattern against the whole field and each address in it
+func matchAddresses(pattern *regexp.Regexp, field string) bool {
+	if pattern.MatchString(field) {
+		return true
+	}
+	addresses, _ := mail.ParseAddressList(field)
+	for _, address := range addresses {
+		if pattern.MatchString(address.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile compiles glob or, if prefixed with 're:', regular expression
+//
+// Globs are case insensitive and must match the whole value, '*' matches
+// any number of any characters and '?' a single one. Regular expressions
+// are used as they are. Empty pattern gives nil meaning 'match anything'.
+func compile(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(pattern, regexPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+	}
+
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.ReplaceAll(glob, `\*`, `.*`)
+	glob = strings.ReplaceAll(glob, `\?`, `.`)
+	return regexp.Compile(`(?is)^` + glob + `$`)
+}
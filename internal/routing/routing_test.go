@@ -0,0 +1,179 @@
+package routing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/pkg/logger"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var testRoutes = `
+routes:
+  - name: backups
+    match:
+      from: "*@backup.example.com"
+    channels: [file]
+    stop: true
+  - name: security
+    match:
+      subject: "re:(?i)\\b(intrusion|failed login)\\b"
+    channels: [telegram, slack]
+  - name: urgent
+    match:
+      headers:
+        x-priority: "1*"
+    channels: [telegram, whatsapp]
+defaultRoute: [telegram]
+`
+
+func TestRoute(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	conf := common.Configuration{}
+	if err := yaml.Unmarshal([]byte(testRoutes), &conf); err != nil {
+		t.Fatalf("Can't unmarshal test configuration: %v", err)
+	}
+
+	// whatsapp is not enabled so it's dropped from the routes
+	router, err := New(ctx, conf.Routes, conf.DefaultRoute, []string{"file", "slack", "telegram"})
+	if err != nil {
+		t.Fatalf("Can't create router: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		msg      common.Message
+		channels []string
+	}{
+		{
+			name:     "stop on first match",
+			msg:      common.Message{From: "Backup <nightly@BACKUP.example.com>", Subject: "failed login"},
+			channels: []string{"file"},
+		},
+		{
+			name:     "regex subject",
+			msg:      common.Message{From: "root@example.com", Subject: "Intrusion detected"},
+			channels: []string{"slack", "telegram"},
+		},
+		{
+			name: "several routes match",
+			msg: common.Message{
+				From:    "root@example.com",
+				Subject: "failed login",
+				Headers: map[string]string{"X-Priority": "1 (Highest)"},
+			},
+			channels: []string{"slack", "telegram"},
+		},
+		{
+			name:     "default route",
+			msg:      common.Message{From: "root@example.com", Subject: "cron output"},
+			channels: []string{"telegram"},
+		},
+	}
+
+	for _, test := range tests {
+		if channels := router.Route(test.msg); !reflect.DeepEqual(channels, test.channels) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.channels, channels)
+		}
+	}
+}
+
+func TestRouteWithoutRoutes(t *testing.T) {
+	router, err := New(context.Background(), nil, nil, []string{"file", "telegram"})
+	if err != nil {
+		t.Fatalf("Can't create router: %v", err)
+	}
+	if channels := router.Route(common.Message{}); !reflect.DeepEqual(channels, []string{"file", "telegram"}) {
+		t.Fatalf("Expected all channels, got %v", channels)
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	routes := []common.Route{{Match: common.Match{Subject: "re:("}, Channels: []string{"file"}}}
+	if _, err := New(context.Background(), routes, nil, []string{"file"}); err == nil {
+		t.Fatalf("Expected error for invalid regular expression")
+	}
+}
+
+func TestRouteDigest(t *testing.T) {
+	ctx := context.Background()
+	l, _ := zap.NewDevelopment()
+	ctx = logger.ContextWithLogger(ctx, l.Sugar())
+
+	routes := []common.Route{
+		{
+			Name:     "backups",
+			Match:    common.Match{From: "*@backup.example.com"},
+			Channels: []string{"telegram"},
+			Digest:   &common.RouteDigest{Schedule: "0 7 * * *"},
+			Stop:     true,
+		},
+		{
+			Match:    common.Match{Subject: "*failed*"},
+			Channels: []string{"slack"},
+		},
+	}
+	router, err := New(ctx, routes, []string{"file"}, []string{"file", "slack", "telegram"})
+	if err != nil {
+		t.Fatalf("Can't create router: %v", err)
+	}
+
+	// message collected by digest isn't sent anywhere right away
+	backup := common.Message{From: "root@backup.example.com", Subject: "backup failed"}
+	if channels := router.Route(backup); len(channels) != 0 {
+		t.Fatalf("Expected no channels, got %v", channels)
+	}
+	if digests := router.Digests(backup); !reflect.DeepEqual(digests, []string{"backups"}) {
+		t.Fatalf("Expected backups digest, got %v", digests)
+	}
+	if channels := router.DigestChannels("backups"); !reflect.DeepEqual(channels, []string{"telegram"}) {
+		t.Fatalf("Expected digest channels [telegram], got %v", channels)
+	}
+
+	other := common.Message{From: "root@example.com", Subject: "login failed"}
+	if channels := router.Route(other); !reflect.DeepEqual(channels, []string{"slack"}) || len(router.Digests(other)) != 0 {
+		t.Fatalf("Expected only slack, got %v and digests %v", channels, router.Digests(other))
+	}
+
+	if digests := router.DigestRoutes(); len(digests) != 1 || digests["backups"].Schedule != "0 7 * * *" {
+		t.Fatalf("Unexpected digest routes: %v", digests)
+	}
+
+	if channels, ok := router.RouteChannels("route 2"); !ok || !reflect.DeepEqual(channels, []string{"slack"}) {
+		t.Fatalf("Expected channels of unnamed route [slack], got %v", channels)
+	}
+	if _, ok := router.RouteChannels("unknown"); ok {
+		t.Fatalf("Unknown route found")
+	}
+
+	routes[1].Name = "backups"
+	routes[1].Digest = &common.RouteDigest{Schedule: "1h"}
+	if _, err := New(ctx, routes, nil, []string{"slack", "telegram"}); err == nil {
+		t.Fatalf("Expected error for digest routes with the same name")
+	}
+}
+
+func TestRouteUrgent(t *testing.T) {
+	routes := []common.Route{
+		{Match: common.Match{Subject: "re:(?i)disk full|down"}, Channels: []string{"telegram"}, Urgent: true},
+		{Match: common.Match{From: "*@example.com"}, Channels: []string{"slack"}},
+	}
+	router, err := New(context.Background(), routes, nil, []string{"slack", "telegram"})
+	if err != nil {
+		t.Fatalf("Can't create router: %v", err)
+	}
+
+	if !router.Urgent(common.Message{From: "root@example.com", Subject: "Server down"}) {
+		t.Fatalf("Message matched by urgent route not urgent")
+	}
+	if router.Urgent(common.Message{From: "root@example.com", Subject: "Backup OK"}) {
+		t.Fatalf("Message not matched by urgent route urgent")
+	}
+}
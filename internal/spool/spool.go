@@ -0,0 +1,363 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"smtp2communicator/internal/common"
+	"smtp2communicator/internal/statefile"
+)
+
+const (
+	defaultRetryMin = 30 * time.Second
+	defaultRetryMax = time.Hour
+	defaultMaxAge   = 5 * 24 * time.Hour
+
+	entryExt = ".json"
+)
+
+// ErrExpired is returned by Update when an entry has been given up on
+var ErrExpired = errors.New("message is too old, giving up delivery")
+
+// Delivery is delivery state of a message to a single channel
+type Delivery struct {
+	Done        bool
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+	// Recipients are recipients of the channel the message was delivered
+	// to while delivery to others failed
+	Recipients []string `json:",omitempty"`
+}
+
+// Entry is a single spooled message together with its delivery state
+type Entry struct {
+	Id         string
+	Received   time.Time
+	Message    common.Message
+	Deliveries map[string]*Delivery
+
+	lock *os.File
+}
+
+// Spool is a directory holding messages until they are delivered to all
+// their channels
+//
+// Every message is stored in its own file. While a message is being
+// delivered its lock file is locked so that several processes (the daemon
+// and short lived sendmail invocations) can share one spool directory
+// without delivering the same message twice.
+type Spool struct {
+	dir      string
+	retryMin time.Duration
+	retryMax time.Duration
+	maxAge   time.Duration
+}
+
+// New opens spool directory creating it if needed
+//
+// Parameters:
+//
+// - conf (common.SpoolConfig): spool configuration
+//
+// Returns:
+//
+// - s (*Spool): opened spool
+// - err (error): error if any or nil
+func New(conf common.SpoolConfig) (s *Spool, err error) {
+	if len(conf.DirPath) == 0 {
+		return nil, errors.New("spool dirPath not set")
+	}
+
+	s = &Spool{
+		dir:      conf.DirPath,
+		retryMin: conf.RetryMin,
+		retryMax: conf.RetryMax,
+		maxAge:   conf.MaxAge,
+	}
+	if s.retryMin <= 0 {
+		s.retryMin = defaultRetryMin
+	}
+	if s.retryMax < s.retryMin {
+		s.retryMax = max(defaultRetryMax, s.retryMin)
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultMaxAge
+	}
+
+	if err = os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("can't create spool directory: %w", err)
+	}
+	return s, nil
+}
+
+// RetryInterval returns how often spool should be checked for due deliveries
+func (s *Spool) RetryInterval() time.Duration {
+	return s.retryMin
+}
+
+// Add stores a new message in the spool
+//
+// The returned entry is locked and must be passed to Update once delivery
+// has been attempted.
+//
+// Parameters:
+//
+// - msg (common.Message): message to store
+// - channels ([]string): names of channels the message is to be delivered to
+//
+// Returns:
+//
+// - entry (*Entry): stored, locked entry
+// - err (error): error if any or nil
+func (s *Spool) Add(msg common.Message, channels []string) (entry *Entry, err error) {
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry = &Entry{
+		Id:         id,
+		Received:   now,
+		Message:    msg,
+		Deliveries: map[string]*Delivery{},
+	}
+	for _, channel := range channels {
+		entry.Deliveries[channel] = &Delivery{NextAttempt: now}
+	}
+
+	if entry.lock, err = s.lock(id); err != nil {
+		return nil, err
+	}
+	if err = s.write(entry); err != nil {
+		s.unlock(entry)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Due returns locked entries with at least one delivery due at given time
+//
+// Entries locked by someone else are skipped, they are being delivered.
+//
+// Parameters:
+//
+// - now (time.Time): time to compare next delivery attempts against
+//
+// Returns:
+//
+// - entries ([]*Entry): locked entries, each must be passed to Update
+// - err (error): error if any or nil
+func (s *Spool) Due(now time.Time) (entries []*Entry, err error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		lock, err := s.lock(id)
+		if err != nil {
+			continue
+		}
+
+		entry, err := s.read(id)
+		if err != nil {
+			// delivered and removed in the meantime or unreadable
+			s.unlock(&Entry{Id: id, lock: lock})
+			continue
+		}
+		entry.lock = lock
+
+		if len(entry.Pending(now)) == 0 {
+			s.unlock(entry)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Len returns number of messages in the spool
+func (s *Spool) Len() int {
+	ids, _ := s.ids()
+	return len(ids)
+}
+
+// Delivered marks delivery to a channel as successful
+func (s *Spool) Delivered(entry *Entry, channel string) {
+	if d, ok := entry.Deliveries[channel]; ok {
+		d.Done = true
+		d.Attempts++
+		d.LastError = ""
+	}
+}
+
+// Failed records failed delivery to a channel and schedules next attempt
+//
+// Next attempt is scheduled with exponential backoff starting at retryMin
+// and capped at retryMax.
+func (s *Spool) Failed(entry *Entry, channel string, err error) {
+	d, ok := entry.Deliveries[channel]
+	if !ok {
+		return
+	}
+	d.Attempts++
+	d.LastError = err.Error()
+
+	backoff := s.retryMin
+	for i := 1; i < d.Attempts && backoff < s.retryMax; i++ {
+		backoff *= 2
+	}
+	d.NextAttempt = time.Now().Add(min(backoff, s.retryMax))
+}
+
+// Reached records recipients of a channel the message was delivered to
+// although delivery to the others failed, see Recipients
+func (s *Spool) Reached(entry *Entry, channel string, recipients []string) {
+	d, ok := entry.Deliveries[channel]
+	if !ok {
+		return
+	}
+	for _, recipient := range recipients {
+		if !slices.Contains(d.Recipients, recipient) {
+			d.Recipients = append(d.Recipients, recipient)
+		}
+	}
+}
+
+// Deferred postpones delivery to a channel until given time
+//
+// Unlike Failed it doesn't count as a delivery attempt.
+func (s *Spool) Deferred(entry *Entry, channel string, until time.Time) {
+	if d, ok := entry.Deliveries[channel]; ok {
+		d.NextAttempt = until
+	}
+}
+
+// Update saves entry state and releases its lock
+//
+// Entries delivered to all their channels are removed from the spool, so
+// are the ones older than maxAge in which case ErrExpired is returned.
+func (s *Spool) Update(entry *Entry) (err error) {
+	defer s.unlock(entry)
+
+	if len(entry.Undelivered()) == 0 {
+		return s.remove(entry.Id)
+	}
+
+	if time.Since(entry.Received) > s.maxAge {
+		if err = s.remove(entry.Id); err != nil {
+			return err
+		}
+		return ErrExpired
+	}
+
+	return s.write(entry)
+}
+
+// Pending returns sorted names of channels with delivery due at given time
+func (e *Entry) Pending(now time.Time) (channels []string) {
+	for channel, d := range e.Deliveries {
+		if !d.Done && !d.NextAttempt.After(now) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return
+}
+
+// Recipients returns recipients of a channel the message was already
+// delivered to by earlier attempts
+func (e *Entry) Recipients(channel string) []string {
+	if d, ok := e.Deliveries[channel]; ok {
+		return d.Recipients
+	}
+	return nil
+}
+
+// Undelivered returns sorted names of channels message hasn't been delivered to yet
+func (e *Entry) Undelivered() (channels []string) {
+	for channel, d := range e.Deliveries {
+		if !d.Done {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return
+}
+
+// ids returns ids of all entries in the spool, oldest first
+func (s *Spool) ids() (ids []string, err error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.Type().IsRegular() && strings.HasSuffix(name, entryExt) {
+			ids = append(ids, strings.TrimSuffix(name, entryExt))
+		}
+	}
+	// ids start with timestamp and ReadDir returns them sorted
+	return ids, nil
+}
+
+// lock locks entry of given id, it fails if it's already locked
+func (s *Spool) lock(id string) (lock *os.File, err error) {
+	return statefile.Lock(filepath.Join(s.dir, id), false)
+}
+
+// unlock releases entry lock
+func (s *Spool) unlock(entry *Entry) {
+	if entry.lock == nil {
+		return
+	}
+	// remove lock file of entries which no longer exist
+	if _, err := os.Stat(filepath.Join(s.dir, entry.Id+entryExt)); errors.Is(err, fs.ErrNotExist) {
+		os.Remove(entry.lock.Name())
+	}
+	entry.lock.Close()
+	entry.lock = nil
+}
+
+// read loads entry from the spool
+func (s *Spool) read(id string) (entry *Entry, err error) {
+	entry = &Entry{}
+	if err = statefile.Read(filepath.Join(s.dir, id+entryExt), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// write atomically saves entry to the spool
+func (s *Spool) write(entry *Entry) (err error) {
+	return statefile.Write(filepath.Join(s.dir, entry.Id+entryExt), entry)
+}
+
+// remove deletes entry from the spool
+func (s *Spool) remove(id string) error {
+	err := os.Remove(filepath.Join(s.dir, id+entryExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// newId returns new, time ordered, entry id
+func newId() (id string, err error) {
+	random := make([]byte, 4)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
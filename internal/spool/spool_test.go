@@ -0,0 +1,135 @@
+package spool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"smtp2communicator/internal/common"
+)
+
+func TestSpoolRetry(t *testing.T) {
+	s, err := New(common.SpoolConfig{
+		DirPath:  t.TempDir(),
+		RetryMin: time.Minute,
+		RetryMax: 3 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Can't create spool: %v", err)
+	}
+
+	testMsg := common.Message{Subject: "hello test", Body: "body body body"}
+	entry, err := s.Add(testMsg, []string{"telegram", "slack"})
+	if err != nil {
+		t.Fatalf("Can't add message: %v", err)
+	}
+
+	// entry is locked until updated so nobody else can pick it up
+	if due, _ := s.Due(time.Now()); len(due) != 0 {
+		t.Fatalf("Locked entry returned as due")
+	}
+
+	s.Delivered(entry, "telegram")
+	s.Reached(entry, "slack", []string{"U1"})
+	s.Failed(entry, "slack", errors.New("network down"))
+	if err = s.Update(entry); err != nil {
+		t.Fatalf("Can't update entry: %v", err)
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("Expected 1 message in spool, got %d", s.Len())
+	}
+
+	// nothing is due before backoff passes
+	if due, _ := s.Due(time.Now()); len(due) != 0 {
+		t.Fatalf("Entry due before its next attempt")
+	}
+
+	due, err := s.Due(time.Now().Add(time.Minute + time.Second))
+	if err != nil || len(due) != 1 {
+		t.Fatalf("Expected 1 due entry, got %d (%v)", len(due), err)
+	}
+	entry = due[0]
+	if entry.Message.Subject != testMsg.Subject {
+		t.Fatalf("Spooled SUBJECT is not matching expected one: '%s' != '%s'", entry.Message.Subject, testMsg.Subject)
+	}
+	if pending := entry.Pending(time.Now().Add(time.Hour)); len(pending) != 1 || pending[0] != "slack" {
+		t.Fatalf("Expected only slack pending, got %v", pending)
+	}
+	s.Reached(entry, "slack", []string{"U1", "U2"})
+	if recipients := entry.Recipients("slack"); len(recipients) != 2 || recipients[0] != "U1" || recipients[1] != "U2" {
+		t.Fatalf("Unexpected recipients delivered to: %v", recipients)
+	}
+
+	// backoff doubles and is capped at RetryMax
+	s.Failed(entry, "slack", errors.New("network down"))
+	if next := time.Until(entry.Deliveries["slack"].NextAttempt); next < time.Minute+50*time.Second {
+		t.Fatalf("Backoff didn't grow: %s", next)
+	}
+	s.Failed(entry, "slack", errors.New("network down"))
+	s.Failed(entry, "slack", errors.New("network down"))
+	if next := time.Until(entry.Deliveries["slack"].NextAttempt); next > 3*time.Minute {
+		t.Fatalf("Backoff not capped: %s", next)
+	}
+
+	s.Delivered(entry, "slack")
+	if err = s.Update(entry); err != nil {
+		t.Fatalf("Can't update entry: %v", err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("Delivered message not removed from spool")
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	s, err := New(common.SpoolConfig{DirPath: t.TempDir(), MaxAge: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Can't create spool: %v", err)
+	}
+
+	entry, err := s.Add(common.Message{}, []string{"telegram"})
+	if err != nil {
+		t.Fatalf("Can't add message: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	s.Failed(entry, "telegram", errors.New("network down"))
+	if err = s.Update(entry); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Expected ErrExpired, got %v", err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("Expired message not removed from spool")
+	}
+}
+
+func TestSpoolDeferred(t *testing.T) {
+	s, err := New(common.SpoolConfig{DirPath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Can't create spool: %v", err)
+	}
+
+	entry, err := s.Add(common.Message{Subject: "night", Urgent: true}, []string{"telegram"})
+	if err != nil {
+		t.Fatalf("Can't add message: %v", err)
+	}
+	until := time.Now().Add(8 * time.Hour)
+	s.Deferred(entry, "telegram", until)
+	if err = s.Update(entry); err != nil {
+		t.Fatalf("Can't update entry: %v", err)
+	}
+
+	if due, _ := s.Due(until.Add(-time.Minute)); len(due) != 0 {
+		t.Fatalf("Deferred entry due before quiet hours end")
+	}
+	due, err := s.Due(until)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("Expected 1 due entry, got %d (%v)", len(due), err)
+	}
+	if attempts := due[0].Deliveries["telegram"].Attempts; attempts != 0 {
+		t.Fatalf("Deferring counted as %d attempts", attempts)
+	}
+	if !due[0].Message.Urgent {
+		t.Fatalf("Urgent flag not kept in spool")
+	}
+	s.Update(due[0])
+}
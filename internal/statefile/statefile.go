@@ -0,0 +1,110 @@
+// Package statefile keeps state in JSON files shared by several processes
+//
+// The daemon and short lived sendmail invocations may use the same state
+// files at once, so every file is changed only while its lock file is
+// locked and saved atomically so that nobody reads it half written.
+package statefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LockExt is appended to the path of a state file to get its lock file
+const LockExt = ".lock"
+
+// Lock locks state file at given path
+//
+// The lock is held until the returned file is closed.
+//
+// Parameters:
+//
+// - path (string): path of the state file, its lock file is path with LockExt
+// - wait (bool): true to wait for the lock, otherwise fail if it's held by someone else
+//
+// Returns:
+//
+// - lock (*os.File): locked lock file
+// - err (error): error if any or nil
+func Lock(path string, wait bool) (lock *os.File, err error) {
+	lock, err = os.OpenFile(path+LockExt, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err = syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Read loads state saved as JSON
+//
+// Errors of reading the file are returned as they are so that callers can
+// tell a missing file with errors.Is(err, fs.ErrNotExist).
+//
+// Parameters:
+//
+// - path (string): path of the state file
+// - v (any): pointer to the value to load the state into
+//
+// Returns:
+//
+// - err (error): error if any or nil
+func Read(path string, v any) (err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("can't read %s: %w", path, err)
+	}
+	return nil
+}
+
+// Write atomically saves state as JSON
+//
+// The state is written into a temporary file in the same directory which
+// then replaces the state file.
+//
+// Parameters:
+//
+// - path (string): path of the state file
+// - v (any): value to save
+//
+// Returns:
+//
+// - err (error): error if any or nil
+func Write(path string, v any) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,55 @@
+package statefile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state := map[string]int{}
+	if err := Read(path, &state); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected missing state file, got %v", err)
+	}
+
+	if err := Write(path, map[string]int{"first": 1, "second": 2}); err != nil {
+		t.Fatalf("Can't write state: %v", err)
+	}
+	if err := Read(path, &state); err != nil || len(state) != 2 || state["second"] != 2 {
+		t.Fatalf("Unexpected state %v (%v)", state, err)
+	}
+
+	// only the state file is left behind
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("Temporary file left behind: %v", files)
+	}
+
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := Read(path, &state); err == nil {
+		t.Fatalf("Broken state file read")
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	lock, err := Lock(path, false)
+	if err != nil {
+		t.Fatalf("Can't lock: %v", err)
+	}
+	if _, err := Lock(path, false); err == nil {
+		t.Fatalf("Locked twice")
+	}
+
+	lock.Close()
+	again, err := Lock(path, true)
+	if err != nil {
+		t.Fatalf("Can't lock after release: %v", err)
+	}
+	again.Close()
+}